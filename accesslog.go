@@ -0,0 +1,123 @@
+package main
+
+// Access logging, a line per response in either Apache's Common Log Format
+// with the latency in microseconds appended, like its %D, or as JSON. For
+// busy servers the log can leave out responses below a status or to given
+// paths, like health checks, and keep only a sample of the rest. JSON lines
+// also say what TLS the connection negotiated.
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type accessLogger struct {
+	json      bool
+	minStatus int
+	skip      []string // Paths, or with a trailing slash the paths below them.
+	sample    float64  // Fraction of the responses passing the filters to log.
+
+	mu sync.Mutex // Keeps lines from interleaving.
+	w  io.Writer
+}
+
+// Where responses are logged, nil to not log them.
+var accessLog *accessLogger
+
+func newAccessLogger(w io.Writer, format string) (*accessLogger, error) {
+	switch format {
+	case "common", "json":
+		return &accessLogger{w: w, json: format == "json", sample: 1}, nil
+	}
+	return nil, fmt.Errorf("access log format must be common or json, not %q", format)
+}
+
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Query     string  `json:"query,omitempty"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	LatencyMS float64 `json:"latency_ms"`
+	Principal string  `json:"principal,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	// For requests over TLS.
+	TLSVersion string `json:"tls_version,omitempty"`
+	TLSCipher  string `json:"tls_cipher,omitempty"`
+	ALPN       string `json:"alpn,omitempty"`
+	SNI        string `json:"sni,omitempty"`
+	PeerCert   string `json:"peer_cert,omitempty"`
+}
+
+// Reports whether the response to r with status gets a line.
+func (l *accessLogger) wants(r *request, status int) bool {
+	if status < l.minStatus {
+		return false
+	}
+	for _, p := range l.skip {
+		if r.path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(r.path, p) {
+			return false
+		}
+	}
+	return l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// Logs the response to r, which sent bytes of body with the status.
+func (l *accessLogger) log(r *request, status int, bytes int64, start time.Time) {
+	if !l.wants(r, status) {
+		return
+	}
+	now := time.Now()
+	host := "-"
+	if ip := r.remoteIP(); ip != nil {
+		host = ip.String()
+	} else if vsock, ok := r.remoteAddr.(*vsockAddr); ok {
+		host = vsock.String()
+	}
+	var line []byte
+	if l.json {
+		entry := accessLogEntry{
+			Time:      now.UTC().Format(time.RFC3339Nano),
+			Remote:    host,
+			Method:    r.method,
+			Path:      r.path,
+			Query:     r.rawQuery,
+			Proto:     r.proto,
+			Status:    status,
+			Bytes:     bytes,
+			LatencyMS: float64(now.Sub(start)) / float64(time.Millisecond),
+			Principal: r.principal,
+			Country:   r.country,
+		}
+		if s := r.tls; s != nil {
+			entry.TLSVersion, entry.TLSCipher = tls.VersionName(s.Version), tls.CipherSuiteName(s.CipherSuite)
+			entry.ALPN, entry.SNI, entry.PeerCert = s.NegotiatedProtocol, s.ServerName, r.peerSubject()
+		}
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		user := r.principal
+		if user == "" {
+			user = "-"
+		}
+		size := "-"
+		if bytes > 0 {
+			size = fmt.Sprint(bytes)
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %s %d\n", host, user,
+			now.Format("02/Jan/2006:15:04:05 -0700"), r.method+" "+r.uri+" "+r.proto,
+			status, size, now.Sub(start)/time.Microsecond))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
@@ -0,0 +1,232 @@
+package main
+
+// Adaptation, in the manner of ICAP. With -adaptation_socket each request,
+// and each response on its way out, is first shown to a separate service
+// listening on a Unix socket, which can let it through, replace it, or
+// veto it with a status of its own. Filters written in any language can
+// then plug in without being built into the server.
+//
+// Every message gets a connection of its own. The server sends a line,
+//
+//	REQMOD                      for a request, or
+//	RESPMOD <method> <uri>      for the response to that request,
+//
+// then the request or response as HTTP/1.1 puts it on the wire, with a
+// Content-Length. The service answers with a line of its own:
+//
+//	CONTINUE                    to leave it as it is,
+//	REPLACE                     followed by the message to use instead, in
+//	                            the same form, or
+//	VETO <status> [<reason>]    to answer the client with that status, and
+//	                            the reason as the body.
+//
+// Responses are buffered whole to be sent to the service.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type adapter struct {
+	socket  string // Path of the service's Unix socket.
+	reqmod  bool
+	respmod bool
+	// How long the service has to answer each message.
+	timeout time.Duration
+	// Serve messages unadapted when the service fails, instead of 502.
+	bypass bool
+	// Largest body a replacement request may have.
+	maxBody int64
+}
+
+// The service's answer to a message.
+type adaptation struct {
+	verb   string // CONTINUE, REPLACE or VETO.
+	status int    // For a VETO.
+	reason string
+	// The rest of the answer, holding a replacement message.
+	rest *bufio.Reader
+}
+
+// Parses -adaptation_mode: req, resp or both.
+func newAdapter(socket, mode string, timeout time.Duration, bypass bool, maxBody int64) (*adapter, error) {
+	a := &adapter{socket: socket, timeout: timeout, bypass: bypass, maxBody: maxBody}
+	switch mode {
+	case "req":
+		a.reqmod = true
+	case "resp":
+		a.respmod = true
+	case "both":
+		a.reqmod, a.respmod = true, true
+	default:
+		return nil, fmt.Errorf("-adaptation_mode must be req, resp or both, not %q", mode)
+	}
+	return a, nil
+}
+
+// Sends the message to the service, and reads the first line of its
+// answer. The caller closes the socket once it has read the rest.
+func (a *adapter) exchange(msg []byte) (*adaptation, *netSocket, error) {
+	socket, err := dialUnix(a.socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.timeout > 0 {
+		if err := socket.SetDeadline(time.Now().Add(a.timeout)); err != nil {
+			socket.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := socket.Write(msg); err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+	b := bufio.NewReader(socket)
+	line, err := b.ReadString('\n')
+	if err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	ad := &adaptation{verb: fields[0], rest: b}
+	switch ad.verb {
+	case "CONTINUE", "REPLACE":
+	case "VETO":
+		if len(fields) < 2 {
+			err = errors.New("VETO without a status")
+			break
+		}
+		if ad.status, err = strconv.Atoi(fields[1]); err != nil || ad.status < 200 || ad.status > 599 {
+			err = fmt.Errorf("VETO with invalid status %q", fields[1])
+			break
+		}
+		if len(fields) == 3 {
+			ad.reason = fields[2]
+		}
+	default:
+		err = fmt.Errorf("unknown answer %q", line)
+	}
+	if err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+	return ad, socket, nil
+}
+
+// Adapts the request, then the response, as the mode has it.
+func (a *adapter) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if a.reqmod {
+			handled, err := a.adaptRequest(w, r)
+			if handled || err != nil {
+				return err
+			}
+		}
+		// There's no body to show for HEAD, and no knowing what it'd be.
+		if !a.respmod || r.method == "HEAD" {
+			return next(w, r)
+		}
+		rec, err := recordResponse(next, r)
+		if err != nil {
+			return err
+		}
+		return a.adaptResponse(w, r, rec)
+	}
+}
+
+// Reports whether it answered the request itself, with a veto or because
+// the service failed.
+func (a *adapter) adaptRequest(w responseWriter, r *request) (bool, error) {
+	var msg strings.Builder
+	msg.WriteString("REQMOD\n")
+	msg.WriteString(r.method + " " + r.uri + " HTTP/1.1\r\n")
+	writeHeaderAndBody(&msg, r.header, r.body)
+	ad, socket, err := a.exchange([]byte(msg.String()))
+	if err != nil {
+		return a.failed(w, "REQMOD", err)
+	}
+	defer socket.Close()
+	switch ad.verb {
+	case "VETO":
+		return true, writeStatus(w, ad.status, ad.reason+"\n")
+	case "REPLACE":
+		req, err := readRequest(ad.rest, func(*request) int64 { return a.maxBody }, nil, nil)
+		if err == nil {
+			err = req.setURI(req.uri)
+		}
+		if err != nil {
+			return a.failed(w, "REQMOD", err)
+		}
+		// The connection's details, like the client's address, stay.
+		r.setURI(req.uri)
+		r.method, r.header, r.body = req.method, req.header, req.body
+		r.multipartForm = nil
+	}
+	return false, nil
+}
+
+func (a *adapter) adaptResponse(w responseWriter, r *request, rec *recordedResponse) error {
+	var msg strings.Builder
+	msg.WriteString("RESPMOD " + r.method + " " + r.uri + "\n")
+	fmt.Fprintf(&msg, "HTTP/1.1 %d %s\r\n", rec.status, statusText[rec.status])
+	writeHeaderAndBody(&msg, rec.header, rec.body)
+	ad, socket, err := a.exchange([]byte(msg.String()))
+	if err != nil {
+		if handled, err := a.failed(w, "RESPMOD", err); handled || err != nil {
+			return err
+		}
+		return rec.writeTo(w)
+	}
+	defer socket.Close()
+	switch ad.verb {
+	case "VETO":
+		return writeStatus(w, ad.status, ad.reason+"\n")
+	case "REPLACE":
+		resp, err := readResponse(ad.rest, r.method)
+		if err != nil {
+			if handled, err := a.failed(w, "RESPMOD", err); handled || err != nil {
+				return err
+			}
+			return rec.writeTo(w)
+		}
+		resp.header.Set("Content-Length", strconv.Itoa(len(resp.body)))
+		rec = &recordedResponse{status: resp.status, header: resp.header, body: resp.body}
+	}
+	return rec.writeTo(w)
+}
+
+// Writes the headers, with a Content-Length for body, a blank line and
+// the body.
+func writeHeaderAndBody(b *strings.Builder, header map[string][]string, body []byte) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "Content-Length" || k == "Transfer-Encoding" {
+			continue
+		}
+		for _, v := range header[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	b.Write(body)
+}
+
+// Logs a failed exchange and, unless bypassing, answers 502. Reports
+// whether it answered.
+func (a *adapter) failed(w responseWriter, mode string, err error) (bool, error) {
+	log.Printf("adaptation %s: %v", mode, err)
+	if a.bypass {
+		return false, nil
+	}
+	return true, writeStatus(w, 502, "adaptation service failed\n")
+}
@@ -0,0 +1,78 @@
+package main
+
+// Admission control. At most a set number of requests run at once; the
+// next few wait in a bounded queue for a slot, and the rest, along with
+// any that wait too long, are turned away with 503. A spike then costs
+// some latency and a few refusals instead of every request slowing down
+// together. Critical requests skip the limit, and background ones don't
+// wait.
+
+import (
+	"strconv"
+	"time"
+)
+
+type admission struct {
+	priorities *prioritizer
+	slots      chan struct{} // Holds a token per running request.
+	waiting    chan struct{} // Holds a token per queued request.
+	maxWait    time.Duration
+	// Seconds to tell refused clients to wait.
+	retryAfter string
+}
+
+func newAdmission(priorities *prioritizer, concurrency, queue int, maxWait time.Duration) *admission {
+	secs := int64((maxWait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return &admission{
+		priorities: priorities,
+		slots:      make(chan struct{}, concurrency),
+		waiting:    make(chan struct{}, queue),
+		maxWait:    maxWait,
+		retryAfter: "Retry-After: " + strconv.FormatInt(secs, 10),
+	}
+}
+
+// Waits for a slot, counting the wait as the request's queue phase.
+func (a *admission) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		p := a.priorities.classify(r)
+		if p == priorityCritical {
+			return next(w, r)
+		}
+		select {
+		case a.slots <- struct{}{}:
+		default:
+			if p == priorityBackground || !a.wait(r) {
+				return writeStatus(w, 503, "server busy\n", a.retryAfter)
+			}
+		}
+		defer func() { <-a.slots }()
+		return next(w, r)
+	}
+}
+
+// Queues for a slot, reporting whether one came up in time and before the
+// client gave up.
+func (a *admission) wait(r *request) bool {
+	select {
+	case a.waiting <- struct{}{}:
+	default:
+		return false // The queue is full.
+	}
+	defer func() { <-a.waiting }()
+	start := clock.Now()
+	t := clock.NewTimer(a.maxWait)
+	defer t.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		r.recordPhase("queue", clock.Now().Sub(start))
+		return true
+	case <-t.Chan():
+		return false
+	case <-r.context().Done():
+		return false
+	}
+}
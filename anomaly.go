@@ -0,0 +1,134 @@
+package main
+
+// Anomaly detection. Inspectors look at each request once it's parsed,
+// before it's routed, and report anything suspicious about it. A finding is
+// logged, and the request refused with 403 if its inspector is set to
+// block.
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Examines a request, returning a description of what's wrong with it or
+// "" if nothing is.
+type inspectFunc func(r *request) string
+
+type inspector struct {
+	name    string
+	inspect inspectFunc
+	block   bool // Refuse requests it flags rather than only logging them.
+}
+
+type anomalyDetector struct {
+	inspectors []inspector
+}
+
+func (d *anomalyDetector) addInspector(name string, f inspectFunc, block bool) {
+	d.inspectors = append(d.inspectors, inspector{name: name, inspect: f, block: block})
+}
+
+// Runs every inspector on the request, then next unless one that blocks
+// flagged it.
+func (d *anomalyDetector) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		blocked := false
+		for _, in := range d.inspectors {
+			finding := in.inspect(r)
+			if finding == "" {
+				continue
+			}
+			action := "logged"
+			if in.block {
+				action, blocked = "blocked", true
+			}
+			log.Printf("anomaly %s (%s): %s %q: %s", in.name, action, r.method, r.uri, finding)
+		}
+		if blocked {
+			return writeStatus(w, 403, "forbidden\n")
+		}
+		return next(w, r)
+	}
+}
+
+// Flags requests with more than max header fields.
+func tooManyHeaders(max int) inspectFunc {
+	return func(r *request) string {
+		n := 0
+		for _, vs := range r.header {
+			n += len(vs)
+		}
+		if n > max {
+			return fmt.Sprintf("%d header fields, more than %d", n, max)
+		}
+		return ""
+	}
+}
+
+// Flags paths with a NUL byte, raw or percent-encoded, which only makes
+// sense as an attempt to truncate the path in something written in C.
+func nullBytePath(r *request) string {
+	p := r.uri
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	if strings.IndexByte(p, 0) >= 0 {
+		return "NUL byte in path"
+	}
+	if unescaped, err := url.PathUnescape(p); err == nil && strings.IndexByte(unescaped, 0) >= 0 {
+		return "encoded NUL byte in path"
+	}
+	return ""
+}
+
+// User agents of scanning and attack tools, matched case-insensitively.
+var suspiciousAgents = []string{
+	"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei", "dirbuster",
+	"gobuster", "wpscan", "acunetix", "netsparker", "havij", "hydra", "fimap",
+}
+
+// Flags requests from known attack tools, and ones with no user agent at
+// all, which no browser sends.
+func suspiciousUserAgent(r *request) string {
+	agent := r.header.Get("User-Agent")
+	if agent == "" {
+		return "no User-Agent"
+	}
+	lower := strings.ToLower(agent)
+	for _, tool := range suspiciousAgents {
+		if strings.Contains(lower, tool) {
+			return "User-Agent " + agent
+		}
+	}
+	return ""
+}
+
+// Builds a detector from a comma separated list of inspector names, each
+// optionally followed by ":block".
+func parseAnomalyDetector(spec string, maxHeaders int) (*anomalyDetector, error) {
+	d := &anomalyDetector{}
+	for _, item := range strings.Split(spec, ",") {
+		name, action := item, ""
+		if i := strings.IndexByte(item, ':'); i >= 0 {
+			name, action = item[:i], item[i+1:]
+		}
+		if action != "" && action != "block" {
+			return nil, fmt.Errorf("anomaly inspector %s: unknown action %q", name, action)
+		}
+		var f inspectFunc
+		switch name {
+		case "headers":
+			f = tooManyHeaders(maxHeaders)
+		case "null_path":
+			f = nullBytePath
+		case "user_agent":
+			f = suspiciousUserAgent
+		default:
+			return nil, fmt.Errorf("unknown anomaly inspector %q", name)
+		}
+		d.addInspector(name, f, action == "block")
+	}
+	return d, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+// API keys for bearer token authentication. Keys are managed from the
+// command line with -create_api_key, -revoke_api_key and -list_api_keys and
+// stored in a JSON file that only holds their SHA-256 hashes, so the file
+// leaking doesn't leak the keys. A running server rereads the file on
+// SIGHUP. Each key carries the scopes it may use and an optional rate
+// limit.
+//
+// A key is sent as "Authorization: Bearer sk_<id>_<secret>". The id picks
+// the stored entry and the hash of the whole key must match it.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+type apiKey struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Hash          string     `json:"hash"` // Hex SHA-256 of the full key.
+	Scopes        []string   `json:"scopes"`
+	RatePerMinute int        `json:"rate_per_minute,omitempty"` // 0 for no limit.
+	Created       time.Time  `json:"created"`
+	Revoked       *time.Time `json:"revoked,omitempty"`
+}
+
+func (k *apiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests allowed so far in the current minute, for rate limited keys.
+type keyWindow struct {
+	start time.Time
+	count int
+}
+
+type apiKeyStore struct {
+	file string
+
+	mu      sync.Mutex
+	keys    map[string]*apiKey
+	windows map[string]*keyWindow
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Opens the store in file. A missing file is an empty store.
+func openAPIKeyStore(file string) (*apiKeyStore, error) {
+	s := &apiKeyStore{file: file, windows: make(map[string]*keyWindow)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *apiKeyStore) load() error {
+	keys := make(map[string]*apiKey)
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var list []*apiKey
+		if err := json.Unmarshal(b, &list); err != nil {
+			return fmt.Errorf("%s: %v", s.file, err)
+		}
+		for _, k := range list {
+			keys[k.ID] = k
+		}
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Writes the store back to its file, replacing it atomically.
+func (s *apiKeyStore) save() error {
+	s.mu.Lock()
+	list := s.sorted()
+	s.mu.Unlock()
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".apikeys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Keys sorted by creation time. Callers hold s.mu.
+func (s *apiKeyStore) sorted() []*apiKey {
+	list := make([]*apiKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Creates a key and saves the store, returning the key itself. Only its
+// hash is stored, so this is the one time it can be shown.
+func (s *apiKeyStore) create(name string, scopes []string, ratePerMinute int) (string, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	k := &apiKey{
+		ID:            hex.EncodeToString(id),
+		Name:          name,
+		Scopes:        scopes,
+		RatePerMinute: ratePerMinute,
+		Created:       clock.Now().UTC(),
+	}
+	key := "sk_" + k.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = hashAPIKey(key)
+	s.mu.Lock()
+	s.keys[k.ID] = k
+	s.mu.Unlock()
+	return key, s.save()
+}
+
+func (s *apiKeyStore) revoke(id string) error {
+	s.mu.Lock()
+	k, ok := s.keys[id]
+	if ok && k.Revoked == nil {
+		now := clock.Now().UTC()
+		k.Revoked = &now
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errors.New("no API key with id " + id)
+	}
+	return s.save()
+}
+
+func (s *apiKeyStore) list(out io.Writer) error {
+	s.mu.Lock()
+	list := s.sorted()
+	s.mu.Unlock()
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tRATE\tCREATED\tREVOKED")
+	for _, k := range list {
+		rate, revoked := "-", "-"
+		if k.RatePerMinute > 0 {
+			rate = strconv.Itoa(k.RatePerMinute) + "/min"
+		}
+		if k.Revoked != nil {
+			revoked = k.Revoked.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, strings.Join(k.Scopes, ","),
+			rate, k.Created.Format(time.RFC3339), revoked)
+	}
+	return tw.Flush()
+}
+
+// Rereads the file whenever the process receives SIGHUP, to pick up keys
+// created or revoked since the server started. A file that fails to parse
+// leaves the previous keys in place.
+func (s *apiKeyStore) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := s.load(); err != nil {
+			log.Printf("Keeping previous API keys: %v", err)
+			continue
+		}
+		log.Printf("Reloaded API keys from %s", s.file)
+	}
+}
+
+var (
+	errNoAPIKey      = errors.New("missing bearer token")
+	errBadAPIKey     = errors.New("invalid API key")
+	errAPIKeyScope   = errors.New("API key lacks the required scope")
+	errAPIKeyLimited = errors.New("API key rate limit exceeded")
+)
+
+// Finds the key a bearer token names and checks it may be used for scope
+// now.
+func (s *apiKeyStore) authorize(token, scope string, now time.Time) (*apiKey, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != "sk" {
+		return nil, errBadAPIKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[parts[1]]
+	if !ok || k.Revoked != nil ||
+		subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(k.Hash)) != 1 {
+		return nil, errBadAPIKey
+	}
+	if !k.hasScope(scope) {
+		return nil, errAPIKeyScope
+	}
+	if k.RatePerMinute > 0 {
+		win := s.windows[k.ID]
+		if win == nil || now.Sub(win.start) >= time.Minute {
+			win = &keyWindow{start: now}
+			s.windows[k.ID] = win
+		}
+		if win.count >= k.RatePerMinute {
+			return nil, errAPIKeyLimited
+		}
+		win.count++
+	}
+	return k, nil
+}
+
+// Requires a bearer token for an API key with scope. The key's id becomes
+// the request's principal.
+func requireAPIKey(s *apiKeyStore, scope string) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			const prefix = "Bearer "
+			token := r.header.Get("Authorization")
+			var err error
+			if !strings.HasPrefix(token, prefix) {
+				err = errNoAPIKey
+			}
+			var k *apiKey
+			if err == nil {
+				k, err = s.authorize(strings.TrimSpace(token[len(prefix):]), scope, clock.Now())
+			}
+			switch err {
+			case nil:
+			case errAPIKeyScope:
+				return writeStatus(w, 403, err.Error()+"\n")
+			case errAPIKeyLimited:
+				return writeStatus(w, 429, err.Error()+"\n", "Retry-After: 60")
+			default:
+				return writeStatus(w, 401, err.Error()+"\n", `WWW-Authenticate: Bearer realm="api"`)
+			}
+			r.principal = k.ID
+			return next(w, r)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// Directory archives. A directory the file server would list can instead be
+// fetched whole with ?archive=zip or ?archive=tar.gz. The archive is
+// written while the directory is walked, so nothing is staged on disk or in
+// memory, and as its length isn't known up front it goes out chunked. The
+// file server's policy decides what's left out, and symlinked directories
+// always are, so a link to an ancestor can't make an archive endless.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+var archiveTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// Writes the directory name under root as an archive in format.
+func writeArchive(w responseWriter, r *request, root, name, format string, policy filePolicy) error {
+	contentType, ok := archiveTypes[format]
+	if !ok {
+		return writeStatus(w, 400, "archive must be zip or tar.gz\n")
+	}
+	base := path.Base(name)
+	if base == "/" {
+		base = filepath.Base(root)
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+"."+format))
+	// Sent now, as otherwise it'd say Content-Length: 0, when GET doesn't
+	// know the length either.
+	if r.method == "HEAD" {
+		return w.writeHead()
+	}
+
+	if format == "zip" {
+		zw := zip.NewWriter(w)
+		err := walkArchive(root, name, "", policy, func(rel string, fi os.FileInfo, f *os.File) error {
+			hdr, err := zip.FileInfoHeader(fi)
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			if f == nil {
+				hdr.Name += "/"
+				_, err = zw.CreateHeader(hdr)
+				return err
+			}
+			hdr.Method = zip.Deflate
+			fw, err := zw.CreateHeader(hdr)
+			if err == nil {
+				_, err = io.Copy(fw, f)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := walkArchive(root, name, "", policy, func(rel string, fi os.FileInfo, f *os.File) error {
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if f == nil {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = "", "", 0, 0
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if f != nil {
+			_, err = io.CopyN(tw, f, hdr.Size)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Calls add for each entry the policy lets through below the directory name
+// in root, in name order and parents first, with its slash separated path
+// relative to the walk's start, rel. f is the open file for regular files
+// and nil for directories.
+func walkArchive(root, name, rel string, policy filePolicy, add func(rel string, fi os.FileInfo, f *os.File) error) error {
+	dir, err := policy.open(root, name)
+	if err != nil {
+		return err
+	}
+	entries, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		linked := e.Mode()&os.ModeSymlink != 0
+		if policy.hides(e.Name()) || linked && policy.symlinks == symlinksNone {
+			continue
+		}
+		entryName, entryRel := path.Join(name, e.Name()), path.Join(rel, e.Name())
+		f, err := policy.open(root, entryName)
+		switch {
+		case err == errEscapesRoot || err == errSymlinkPath || os.IsNotExist(err) || os.IsPermission(err):
+			continue // Left out just as fileServer would refuse it.
+		case err != nil:
+			return err
+		}
+		fi, err := f.Stat()
+		switch {
+		case err != nil:
+		case fi.Mode().IsRegular():
+			err = add(entryRel, fi, f)
+		case fi.IsDir() && !linked:
+			if err = add(entryRel, fi, nil); err == nil {
+				err = walkArchive(root, entryName, entryRel, policy, add)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+// Fingerprinted static assets. Every file under the asset directory is
+// hashed at startup and served at a path containing its hash, for example
+// css/site.css at /assets/css/site.3f2a9c1d.css. Because the URL changes
+// whenever the content does, responses can be cached forever. Templates
+// find the URL for a logical name with the asset function from funcs, and
+// scripts in /assets/manifest.json.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type assetManifest struct {
+	dir    string
+	prefix string            // URL prefix like /assets/
+	urls   map[string]string // logical name -> fingerprinted URL
+	files  map[string]string // fingerprinted URL -> file path
+}
+
+// Hashes every regular file under dir.
+func buildAssetManifest(dir, prefix string) (*assetManifest, error) {
+	m := &assetManifest{
+		dir:    dir,
+		prefix: prefix,
+		urls:   make(map[string]string),
+		files:  make(map[string]string),
+	}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		ext := path.Ext(name)
+		url := prefix + strings.TrimSuffix(name, ext) + "." + sum[:8] + ext
+		m.urls[name] = url
+		m.files[url] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fingerprinted %d assets under %s", len(m.urls), dir)
+	return m, nil
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Resolves a logical name like css/site.css to its fingerprinted URL. Unknown
+// names resolve to the unfingerprinted path so a typo shows up as a 404
+// rather than a broken page.
+func (m *assetManifest) url(name string) string {
+	if u, ok := m.urls[strings.TrimPrefix(name, "/")]; ok {
+		return u
+	}
+	return m.prefix + strings.TrimPrefix(name, "/")
+}
+
+// Template functions exposing the manifest, used as {{asset "css/site.css"}}.
+func (m *assetManifest) funcs() template.FuncMap {
+	return template.FuncMap{"asset": m.url}
+}
+
+func (m *assetManifest) handler(w responseWriter, r *request) error {
+	uri := r.path
+	if uri == m.prefix+"manifest.json" {
+		return writeJSON(w, 200, m.urls)
+	}
+	file, ok := m.files[uri]
+	if !ok {
+		return notFound(w, r)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The URL changes with the content, so any copy the client has is
+	// current.
+	if notModified(w, r, fileETag(fi), fi.ModTime()) {
+		return nil
+	}
+	contentType := mime.TypeByExtension(path.Ext(file))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	h.Set("ETag", fileETag(fi))
+	if r.method == "HEAD" {
+		return nil
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
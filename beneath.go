@@ -0,0 +1,76 @@
+package main
+
+// Opening files strictly beneath a root directory, so request paths served
+// from disk can't escape the root through .. or symlinks.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errEscapesRoot = errors.New("path escapes root directory")
+	errSymlinkPath = errors.New("path contains a symlink")
+
+	// Returned by openBeneathKernel when the kernel can't resolve paths
+	// beneath a directory itself.
+	errNoKernelResolve = errors.New("kernel path resolution unavailable")
+)
+
+// Opens the slash separated path name read-only relative to root. Fails
+// with errEscapesRoot if name resolves outside root and, with noSymlinks,
+// with errSymlinkPath if any component of name is a symlink.
+func openBeneath(root, name string, noSymlinks bool) (*os.File, error) {
+	rel := filepath.FromSlash(strings.TrimLeft(name, "/"))
+	if rel == "" {
+		rel = "."
+	}
+	f, err := openBeneathKernel(root, rel, noSymlinks)
+	if err != errNoKernelResolve {
+		return f, err
+	}
+	return openBeneathUserspace(root, rel, noSymlinks)
+}
+
+// The fallback checks the path before opening it, so it's racy against
+// concurrent renames within root; the kernel resolution isn't.
+func openBeneathUserspace(root, rel string, noSymlinks bool) (*os.File, error) {
+	rel = filepath.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return nil, errEscapesRoot
+	}
+	full := filepath.Join(root, rel)
+
+	if noSymlinks {
+		p := root
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if part == "." {
+				continue
+			}
+			p = filepath.Join(p, part)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return nil, err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return nil, errSymlinkPath
+			}
+		}
+		return os.Open(full)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return nil, err
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+		return nil, errEscapesRoot
+	}
+	return os.Open(real)
+}
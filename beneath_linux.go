@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// openat2(2) arrived in Linux 5.6, after the syscall package stopped
+// taking new system calls; its number, sysOpenat2, is in the openat2_linux
+// files, as mips numbers it differently.
+
+const (
+	resolveNoMagiclinks = 0x02
+	resolveNoSymlinks   = 0x04
+	resolveBeneath      = 0x08
+)
+
+// struct open_how from linux/openat2.h.
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// Set once openat2 has failed with ENOSYS, or with EPERM from a seccomp
+// profile older than it, so later opens skip straight to the fallback.
+var openat2Missing int32
+
+func openBeneathKernel(root, rel string, noSymlinks bool) (*os.File, error) {
+	if atomic.LoadInt32(&openat2Missing) != 0 {
+		return nil, errNoKernelResolve
+	}
+	dirfd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer syscall.Close(dirfd)
+
+	p, err := syscall.BytePtrFromString(rel)
+	if err != nil {
+		return nil, err
+	}
+	how := openHow{
+		flags:   syscall.O_RDONLY | syscall.O_CLOEXEC,
+		resolve: resolveBeneath | resolveNoMagiclinks,
+	}
+	if noSymlinks {
+		how.resolve |= resolveNoSymlinks
+	}
+	fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	switch errno {
+	case 0:
+		return os.NewFile(fd, filepath.Join(root, rel)), nil
+	case syscall.ENOSYS, syscall.EPERM:
+		atomic.StoreInt32(&openat2Missing, 1)
+		return nil, errNoKernelResolve
+	case syscall.EXDEV:
+		return nil, errEscapesRoot
+	case syscall.ELOOP:
+		if noSymlinks {
+			return nil, errSymlinkPath
+		}
+	}
+	return nil, &os.PathError{Op: "openat2", Path: filepath.Join(root, rel), Err: errno}
+}
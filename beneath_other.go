@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func openBeneathKernel(root, rel string, noSymlinks bool) (*os.File, error) {
+	return nil, errNoKernelResolve
+}
@@ -0,0 +1,254 @@
+package main
+
+// Traffic capture. With -capture, the bytes of every connection are
+// written to a PCAP-NG file as they're read and written, after TLS is
+// taken off, framed in made-up IP and TCP headers so Wireshark follows the
+// HTTP as if it had seen it on the wire. Each connection gets a
+// handshake, its data in order, and a close.
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 1
+	pcapngEnhancedPacket = 6
+	pcapngByteOrder      = 0x1A2B3C4D
+	linkTypeRaw          = 101 // Packets start at the IP header.
+	ipProtoTCP           = 6
+	tcpFin, tcpSyn       = 0x01, 0x02
+	tcpPsh, tcpAck       = 0x08, 0x10
+	captureMaxSegment    = 65000
+	captureClientISN     = 1000
+	captureServerISN     = 5000
+)
+
+// Stand in for the addresses of a connection that isn't over TCP, like
+// one on a Unix socket.
+var captureFakeClient, captureFakeServer = net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+
+type pcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// Numbers the connections without a port of their own.
+	conns uint16
+}
+
+// Where connections are captured, nil to not capture them.
+var capture *pcapWriter
+
+// Opens file for appending a new PCAP-NG section to, leaving any earlier
+// captures in it.
+func newPcapWriter(file string) (*pcapWriter, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{w: f}
+	// The section length of -1 means it isn't known.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	// A snap length of 0 means there isn't one.
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	if err := p.writeBlock(pcapngSectionHeader, shb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := p.writeBlock(pcapngInterface, idb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Writes a block: its type and length, the body padded to four bytes, and
+// the length again.
+func (p *pcapWriter) writeBlock(typ uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	b := make([]byte, 12+padded)
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(b)))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(b)
+	return err
+}
+
+// Writes a packet, timestamped in microseconds as the interface defaults
+// to.
+func (p *pcapWriter) writePacket(t time.Time, pkt []byte) error {
+	body := make([]byte, 20+len(pkt))
+	us := uint64(t.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(body[4:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(us))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	copy(body[20:], pkt)
+	return p.writeBlock(pcapngEnhancedPacket, body)
+}
+
+// One side of a captured connection.
+type captureEnd struct {
+	ip   net.IP
+	port int
+	seq  uint32 // The next sequence number it sends.
+}
+
+// Captures the bytes read from and written to a connection, as the client
+// and server halves of a TCP stream.
+type captureConn struct {
+	io.ReadWriter
+	p              *pcapWriter
+	client, server captureEnd
+	mu             sync.Mutex
+}
+
+// Wraps conn, the plaintext of the connection on rw, writing its
+// handshake to the capture.
+func (p *pcapWriter) wrap(conn io.ReadWriter, rw *netSocket) *captureConn {
+	c := &captureConn{ReadWriter: conn, p: p}
+	c.client = captureEndFor(rw.RemoteAddr(), captureClientISN)
+	c.server = captureEndFor(rw.LocalAddr(), captureServerISN)
+	if c.client.ip == nil || c.server.ip == nil || (c.client.ip.To4() == nil) != (c.server.ip.To4() == nil) {
+		p.mu.Lock()
+		p.conns++
+		port := 1024 + int(p.conns)%64000
+		p.mu.Unlock()
+		c.client = captureEnd{ip: captureFakeClient, port: port, seq: captureClientISN}
+		c.server = captureEnd{ip: captureFakeServer, port: 80, seq: captureServerISN}
+	}
+	now := time.Now()
+	c.segment(now, &c.client, &c.server, tcpSyn, nil)
+	c.segment(now, &c.server, &c.client, tcpSyn|tcpAck, nil)
+	c.segment(now, &c.client, &c.server, tcpAck, nil)
+	return c
+}
+
+func captureEndFor(addr net.Addr, isn uint32) captureEnd {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return captureEnd{ip: tcp.IP, port: tcp.Port, seq: isn}
+	}
+	return captureEnd{seq: isn}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriter.Read(b)
+	if n > 0 {
+		c.data(&c.client, &c.server, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriter.Write(b)
+	if n > 0 {
+		c.data(&c.server, &c.client, b[:n])
+	}
+	return n, err
+}
+
+// Writes the server closing the connection, and the client following.
+func (c *captureConn) close() {
+	now := time.Now()
+	c.segment(now, &c.server, &c.client, tcpFin|tcpAck, nil)
+	c.segment(now, &c.client, &c.server, tcpFin|tcpAck, nil)
+	c.segment(now, &c.server, &c.client, tcpAck, nil)
+}
+
+func (c *captureConn) data(from, to *captureEnd, b []byte) {
+	now := time.Now()
+	for len(b) > 0 {
+		n := len(b)
+		if n > captureMaxSegment {
+			n = captureMaxSegment
+		}
+		c.segment(now, from, to, tcpPsh|tcpAck, b[:n])
+		b = b[n:]
+	}
+}
+
+// Writes a segment from one end to the other, advancing from's sequence
+// number past it. The capture is best effort, so errors are dropped.
+func (c *captureConn) segment(t time.Time, from, to *captureEnd, flags byte, payload []byte) {
+	c.mu.Lock()
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(from.port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(to.port))
+	binary.BigEndian.PutUint32(tcp[4:], from.seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], to.seq)
+	}
+	tcp[12] = 5 << 4 // Header length in words.
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	from.seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		from.seq++
+	}
+	pkt := ipPacket(from.ip, to.ip, tcp)
+	c.mu.Unlock()
+	c.p.writePacket(t, pkt)
+}
+
+// Puts an IPv4 or IPv6 header in front of the TCP segment, and fills in
+// its checksum.
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+	var pkt, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt = make([]byte, 20+len(tcp))
+		pkt[0] = 0x45 // Version 4, five-word header.
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8] = 64 // TTL
+		pkt[9] = ipProtoTCP
+		copy(pkt[12:], src4)
+		copy(pkt[16:], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+		pseudo = append(append([]byte(nil), src4...), dst4...)
+		copy(pkt[20:], tcp)
+	} else {
+		pkt = make([]byte, 40+len(tcp))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+		pkt[6] = ipProtoTCP
+		pkt[7] = 64 // Hop limit
+		copy(pkt[8:], src.To16())
+		copy(pkt[24:], dst.To16())
+		pseudo = append(append([]byte(nil), src.To16()...), dst.To16()...)
+		copy(pkt[40:], tcp)
+	}
+	var sum uint32
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(pseudo[i])<<8 | uint32(pseudo[i+1])
+	}
+	sum += ipProtoTCP + uint32(len(tcp))
+	seg := pkt[len(pkt)-len(tcp):]
+	binary.BigEndian.PutUint16(seg[16:], checksum(seg, sum))
+	return pkt
+}
+
+// The Internet checksum of b, starting from a partial sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
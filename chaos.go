@@ -0,0 +1,184 @@
+package main
+
+// Chaos checks, run as part of -self_test. Each serves a short keep-alive
+// conversation over a connection wrapped in a chaosConn, which cuts reads
+// short, splits writes up, or fails them with EAGAIN or a reset once a
+// given number of bytes has gone through. Trickling bytes must not change
+// any response; failures may end the conversation, but the server has to
+// close the connection and carry on, without panicking or keeping the fd.
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// Offsets into the conversation to fail at, by what the server reads and
+// what it writes, from the first byte to well into the streamed response.
+var (
+	chaosReadOffsets  = []int64{0, 1, 16, 37, 38, 60, 90, 120}
+	chaosWriteOffsets = []int64{0, 1, 30, 90, 150, 400, maxPendingBody + 100}
+)
+
+// Injects faults into the connection it wraps.
+type chaosConn struct {
+	io.ReadWriter
+	// Largest read and write passed through at once, 0 for no limit.
+	maxRead, maxWrite int
+	// Bytes that get through before reads or writes fail, -1 for never.
+	readFailAt, writeFailAt int64
+	readErr, writeErr       error
+	// Whether every read or write after a failure fails too, as on a reset
+	// connection, rather than just the one.
+	sticky bool
+
+	read, written int64
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	if c.readFailAt >= 0 && c.read >= c.readFailAt {
+		if !c.sticky {
+			c.readFailAt = -1
+		}
+		return 0, c.readErr
+	}
+	if c.maxRead > 0 && len(b) > c.maxRead {
+		b = b[:c.maxRead]
+	}
+	// The read stops at the fault, so the next one hits it.
+	if c.readFailAt >= 0 && int64(len(b)) > c.readFailAt-c.read {
+		b = b[:c.readFailAt-c.read]
+	}
+	n, err := c.ReadWriter.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+// Writes b in pieces, failing part way through if the fault falls inside
+// it.
+func (c *chaosConn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if c.writeFailAt >= 0 && c.written >= c.writeFailAt {
+			if !c.sticky {
+				c.writeFailAt = -1
+			}
+			return n, c.writeErr
+		}
+		p := b
+		if c.maxWrite > 0 && len(p) > c.maxWrite {
+			p = p[:c.maxWrite]
+		}
+		if c.writeFailAt >= 0 && int64(len(p)) > c.writeFailAt-c.written {
+			p = p[:c.writeFailAt-c.written]
+		}
+		m, err := c.ReadWriter.Write(p)
+		n += m
+		c.written += int64(m)
+		b = b[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+type chaosScenario struct {
+	name string
+	conn chaosConn
+	// Whether the conversation has to get through it.
+	survives bool
+}
+
+func chaosScenarios() []chaosScenario {
+	none := chaosConn{readFailAt: -1, writeFailAt: -1}
+	trickle := func(maxRead, maxWrite int) chaosConn {
+		c := none
+		c.maxRead, c.maxWrite = maxRead, maxWrite
+		return c
+	}
+	scenarios := []chaosScenario{
+		{"short reads", trickle(1, 0), true},
+		{"split writes", trickle(0, 7), true},
+		{"short reads and split writes", trickle(3, 5), true},
+	}
+	faults := []struct {
+		name   string
+		err    error
+		sticky bool
+	}{
+		{"EAGAIN", syscall.EAGAIN, false},
+		{"reset", syscall.ECONNRESET, true},
+	}
+	for _, f := range faults {
+		for _, at := range chaosReadOffsets {
+			c := none
+			c.readFailAt, c.readErr, c.sticky = at, f.err, f.sticky
+			scenarios = append(scenarios, chaosScenario{name: fmt.Sprintf("read %s at byte %d", f.name, at), conn: c})
+		}
+		for _, at := range chaosWriteOffsets {
+			c := none
+			c.writeFailAt, c.writeErr, c.sticky = at, f.err, f.sticky
+			scenarios = append(scenarios, chaosScenario{name: fmt.Sprintf("write %s at byte %d", f.name, at), conn: c})
+		}
+	}
+	return scenarios
+}
+
+// The requests each chaos check makes, stopping at the first to fail.
+func chaosConversation(c *clientConn) error {
+	if err := expectResponse(c, "GET", "/hello", nil, 200, "hello\n"); err != nil {
+		return err
+	}
+	if err := expectResponse(c, "POST", "/echo", []byte("ping"), 200, "ping"); err != nil {
+		return err
+	}
+	var stream []byte
+	for _, piece := range selfTestStream {
+		stream = append(stream, piece...)
+	}
+	return expectResponse(c, "GET", "/stream", nil, 200, string(stream))
+}
+
+// Runs every scenario on a server of its own, writing a line for each to
+// out, and returns how many failed.
+func chaosChecks(out io.Writer) (total, failed int) {
+	for _, sc := range chaosScenarios() {
+		total++
+		err := runChaos(sc)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL chaos %s: %v\n", sc.name, err)
+		} else {
+			fmt.Fprintf(out, "ok   chaos %s\n", sc.name)
+		}
+	}
+	return total, failed
+}
+
+func runChaos(sc chaosScenario) error {
+	s, err := newServer(nil, selfTestMux().dispatch, selfTestConfig(), true, false)
+	if err != nil {
+		return err
+	}
+	s.wrapConn = func(conn io.ReadWriter) io.ReadWriter {
+		c := sc.conn
+		c.ReadWriter = conn
+		return &c
+	}
+	c, err := s.selfTestConn()
+	if err != nil {
+		return err
+	}
+	c.timeout = 2 * time.Second
+	convErr := chaosConversation(c)
+	c.Close()
+	if !waitServed(s, 5*time.Second) {
+		return fmt.Errorf("connection still being served after the client closed it")
+	}
+	if sc.survives && convErr != nil {
+		return convErr
+	}
+	return nil
+}
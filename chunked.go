@@ -0,0 +1,165 @@
+package main
+
+// Chunked transfer coding. Request bodies sent with Transfer-Encoding:
+// chunked are decoded while parsing the request. Responses written without
+// a Content-Length are chunked by connWriter for HTTP/1.1 clients, so a
+// handler can stream a body of unknown length simply by leaving the header
+// out; HTTP/1.0 clients get the body delimited by closing the connection.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var errBadChunk = errors.New("malformed chunked encoding")
+
+// Longest chunk size line, extensions and all, or line ending after a
+// chunk's data. Nothing needs much more than the size.
+const maxChunkLine = 4 << 10
+
+// Reads a line of chunk framing without its line ending, failing with
+// errBadChunk past maxChunkLine bytes rather than buffering a line that
+// never ends.
+func readChunkLine(b *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := b.ReadSlice('\n')
+		if len(line)+len(frag) > maxChunkLine {
+			return "", errBadChunk
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+// Reads a chunked body and the trailer fields after it, failing with
+// errBodyTooLarge once the body passes maxBody bytes unless maxBody is 0.
+// Framing lines are held to maxChunkLine, and the trailer to
+// maxHeaderBytes, as a head is.
+func readChunked(tp *textproto.Reader, maxBody int64) ([]byte, textproto.MIMEHeader, error) {
+	var body bytes.Buffer
+	for {
+		line, err := readChunkLine(tp.R)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Chunk extensions after ';' carry nothing this server uses.
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return nil, nil, errBadChunk
+		}
+		if size == 0 {
+			block, err := readHead(nil, tp.R)
+			if err != nil {
+				return nil, nil, err
+			}
+			trailer, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+			if _, ok := err.(textproto.ProtocolError); ok {
+				return nil, nil, errBadChunk
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			return body.Bytes(), trailer, nil
+		}
+		// Subtracting, since adding could overflow.
+		if maxBody > 0 && size > maxBody-int64(body.Len()) {
+			return nil, nil, errBodyTooLarge
+		}
+		// Copied rather than read into space made for it, so a chunk only
+		// takes the memory of the bytes that actually arrive.
+		if _, err := io.CopyN(&body, tp.R, size); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+		if crlf, err := readChunkLine(tp.R); err != nil || crlf != "" {
+			return nil, nil, errBadChunk
+		}
+	}
+}
+
+// Fields a trailer can't add to the header: ones that frame, route or
+// authenticate the message, or that say how to handle it, which have all
+// been acted on by the time the body has been read.
+var forbiddenTrailers = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Cookie":              true,
+	"Expect":              true,
+	"Host":                true,
+	"Idempotency-Key":     true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Set-Cookie":          true,
+	"Signature":           true,
+	"Signature-Input":     true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"X-Api-Key":           true,
+}
+
+// Adds the trailer fields that header announced in its Trailer field to
+// it, unless they're forbidden. The rest are dropped.
+func mergeTrailer(header, trailer textproto.MIMEHeader) {
+	announced := make(map[string]bool)
+	for _, v := range header["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			announced[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for k, v := range trailer {
+		if announced[k] && !forbiddenTrailers[k] {
+			header[k] = append(header[k], v...)
+		}
+	}
+}
+
+// Writes b as a single chunk. Empty writes are skipped since an empty chunk
+// would end the body.
+func writeChunk(w io.Writer, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	frame := make([]byte, 0, len(b)+20)
+	frame = append(frame, fmt.Sprintf("%x\r\n", len(b))...)
+	frame = append(frame, b...)
+	frame = append(frame, "\r\n"...)
+	if _, err := w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Ends a chunked body with the last chunk and an empty trailer.
+func writeLastChunk(w io.Writer) error {
+	_, err := io.WriteString(w, "0\r\n\r\n")
+	return err
+}
@@ -0,0 +1,325 @@
+package main
+
+// A client made the same way as the server: it connects with system calls
+// and reads the response with the same textproto and chunked decoding
+// parseRequest uses, so tests and proxying don't depend on net/http. A
+// clientConn sends requests one after another over a single connection for
+// as long as the server keeps it open.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errConnClosed = errors.New("connection closed by the server")
+
+// Largest response body the client reads; one past it fails with
+// errResponseTooLarge.
+const maxResponseBytes = 256 << 20
+
+var (
+	errResponseTooLarge  = fmt.Errorf("response body over %d bytes", maxResponseBytes)
+	errResponseHeadLarge = fmt.Errorf("response head over %d bytes", maxHeaderBytes)
+)
+
+type clientResponse struct {
+	proto  string // "HTTP/1.1"
+	status int
+	reason string // "OK"
+	header textproto.MIMEHeader
+	// Trailer fields are merged into header as parseRequest does, those
+	// announced and allowed only.
+	body []byte
+	// Set when there was no length, so the body ran until the connection
+	// closed.
+	untilClose bool
+}
+
+// Connects a socket to ip and port, giving up after timeout unless it's 0.
+// The connect itself blocks for as long as the system lets it.
+func dialSocket(ip net.IP, port int, timeout time.Duration) (*netSocket, error) {
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else if ip6 := ip.To16(); ip6 != nil {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip6)
+		sa = sa6
+	} else {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	syscall.ForkLock.Lock()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	fdTrack.add(fd, "client")
+	ns := &netSocket{fd: fd}
+	if timeout > 0 {
+		// The send timeout bounds connect too, on the systems that have it.
+		if err := ns.SetDeadline(time.Now().Add(timeout)); err != nil {
+			sysClose(fd)
+			return nil, err
+		}
+	}
+	for {
+		err = syscall.Connect(fd, sa)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		sysClose(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	return ns, nil
+}
+
+type clientConn struct {
+	socket *netSocket
+	conn   io.ReadWriter // socket, or a TLS connection over it.
+	r      *bufio.Reader
+	// Sent as the Host header.
+	host string
+	// How long each request has, 0 for no limit.
+	timeout time.Duration
+	// Set once the server has said it'll close the connection.
+	closed bool
+}
+
+// Connects to addr, a host:port, for requests with the given Host. With
+// tlsConfig set the connection is made over TLS.
+func dialClient(addr, host string, tlsConfig *tls.Config, timeout time.Duration) (*clientConn, error) {
+	hostname, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip := net.ParseIP(hostname)
+	if ip == nil {
+		ips, err := net.LookupIP(hostname)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	socket, err := dialSocket(ip, port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &clientConn{socket: socket, conn: socket, host: host, timeout: timeout}
+	if tlsConfig != nil {
+		tc := tls.Client(socket, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			socket.Close()
+			return nil, err
+		}
+		c.conn = tc
+	}
+	c.r = bufio.NewReader(c.conn)
+	return c, nil
+}
+
+// Connects to the host in an http or https URL, verifying https servers
+// against the system's roots.
+func dialURL(u *url.URL, timeout time.Duration) (*clientConn, error) {
+	var tlsConfig *tls.Config
+	port := "80"
+	switch u.Scheme {
+	case "http":
+	case "https":
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		port = "443"
+	default:
+		return nil, fmt.Errorf("unsupported scheme in %q", u)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return dialClient(net.JoinHostPort(u.Hostname(), port), u.Host, tlsConfig, timeout)
+}
+
+func (c *clientConn) Close() error {
+	return c.socket.Close()
+}
+
+// Sends a request and reads the response to it. Headers, which may be nil,
+// go out sorted, after Host; a Content-Length is added for a body.
+func (c *clientConn) do(method, uri string, header textproto.MIMEHeader, body []byte) (*clientResponse, error) {
+	if c.closed {
+		return nil, errConnClosed
+	}
+	if c.timeout > 0 {
+		if err := c.socket.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	var b strings.Builder
+	b.WriteString(method + " " + uri + " HTTP/1.1\r\n")
+	if header.Get("Host") == "" {
+		b.WriteString("Host: " + c.host + "\r\n")
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		for _, v := range header[name] {
+			b.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	if len(body) > 0 || method == "POST" || method == "PUT" || method == "PATCH" {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(body); err != nil {
+		return nil, err
+	}
+	resp, err := readResponse(c.r, method)
+	if err != nil {
+		c.closed = true
+		return nil, err
+	}
+	conn := strings.ToLower(strings.Join(resp.header["Connection"], ","))
+	if resp.untilClose || strings.Contains(conn, "close") ||
+		resp.proto == "HTTP/1.0" && !strings.Contains(conn, "keep-alive") {
+		c.closed = true
+	}
+	return resp, nil
+}
+
+// Reads the response to a method request from b, skipping any 1xx
+// responses ahead of it.
+func readResponse(b *bufio.Reader, method string) (*clientResponse, error) {
+	tp := textproto.NewReader(b)
+	for {
+		head, err := readHead(nil, b)
+		var bad *badRequestError
+		if errors.As(err, &bad) {
+			return nil, errResponseHeadLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+		eol := bytes.IndexByte(head, '\n')
+		line := strings.TrimRight(string(head[:eol]), "\r")
+		// A reason phrase is optional, and may have spaces in it.
+		sp := strings.SplitN(line, " ", 3)
+		if len(sp) < 2 || !strings.HasPrefix(sp[0], "HTTP/") {
+			return nil, errors.New("malformed status line: " + line)
+		}
+		resp := &clientResponse{proto: sp[0]}
+		if resp.status, err = strconv.Atoi(sp[1]); err != nil || len(sp[1]) != 3 {
+			return nil, errors.New("malformed status line: " + line)
+		}
+		if len(sp) == 3 {
+			resp.reason = sp[2]
+		}
+		if resp.header, err = textproto.NewReader(bufio.NewReader(bytes.NewReader(head[eol+1:]))).ReadMIMEHeader(); err != nil {
+			return nil, err
+		}
+		if resp.status >= 100 && resp.status < 200 {
+			continue
+		}
+		return resp, readResponseBody(tp, method, resp)
+	}
+}
+
+func readResponseBody(tp *textproto.Reader, method string, resp *clientResponse) error {
+	if method == "HEAD" || resp.status == 204 || resp.status == 304 {
+		return nil
+	}
+	if te := resp.header.Get("Transfer-Encoding"); te != "" {
+		if !strings.EqualFold(te, "chunked") {
+			return errors.New("unsupported Transfer-Encoding: " + te)
+		}
+		body, trailer, err := readChunked(tp, maxResponseBytes)
+		if err == errBodyTooLarge {
+			return errResponseTooLarge
+		}
+		if err != nil {
+			return err
+		}
+		mergeTrailer(resp.header, trailer)
+		resp.header.Del("Transfer-Encoding")
+		resp.body = body
+		return nil
+	}
+	if cl := resp.header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("invalid Content-Length: " + cl)
+		}
+		if n > maxResponseBytes {
+			return errResponseTooLarge
+		}
+		// Copied rather than read into space made for it, so a length the
+		// body doesn't live up to doesn't take the memory.
+		var body bytes.Buffer
+		if _, err := io.CopyN(&body, tp.R, n); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		resp.body = body.Bytes()
+		return nil
+	}
+	// Without either, the body runs until the server closes the connection.
+	resp.untilClose = true
+	var body bytes.Buffer
+	if _, err := io.CopyN(&body, tp.R, maxResponseBytes+1); err != io.EOF {
+		if err == nil {
+			err = errResponseTooLarge
+		}
+		return err
+	}
+	resp.body = body.Bytes()
+	return nil
+}
+
+// Makes a single request to an http or https URL on a connection of its
+// own.
+func fetch(method, rawURL string, header textproto.MIMEHeader, body []byte, timeout time.Duration) (*clientResponse, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialURL(u, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.do(method, u.RequestURI(), header, body)
+}
@@ -0,0 +1,123 @@
+package main
+
+// The clock. Decisions that hang on the time, like expiring cache and
+// store entries, rate limiting, checking signatures and keys, waiting for
+// admission or warm-up, scheduling tasks and the Date header, read it
+// from clock rather than the time package. A simulation or test can swap
+// in a fakeClock and step time forward to see timeouts and expiries play
+// out without sleeping. Deadlines on sockets are the exception: the kernel
+// keeps those, in real time.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type clockSource interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+	Sleep(d time.Duration)
+}
+
+// A time.Timer, or a fakeClock's.
+type clockTimer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+}
+
+var clock clockSource = systemClock{}
+
+// The real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) clockTimer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) Chan() <-chan time.Time { return t.C }
+
+// A clock that only moves when advance is called, firing the timers that
+// come due on the way, in order.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock(start time.Time) *fakeClock {
+	return &fakeClock{now: start}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.fire(c.now)
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+// Blocks until the clock has been advanced by d.
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).Chan()
+}
+
+// Moves the clock forward by d.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	for len(c.timers) > 0 && !c.timers[0].when.After(c.now) {
+		c.timers[0].fire(c.timers[0].when)
+		c.timers = c.timers[1:]
+	}
+}
+
+// How many timers are waiting to fire, so a test can tell when whatever
+// it's driving has gone to sleep.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.c }
+
+// Called with the clock locked.
+func (t *fakeTimer) fire(now time.Time) {
+	t.c <- now
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+// Response compression. Bodies of compressible types are gzipped or
+// deflated, whichever the client prefers, once they reach a minimum size;
+// shorter ones aren't worth the bytes the compression format adds.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types that are worth compressing, besides text/*.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// Returns the coding out of gzip and deflate the Accept-Encoding header
+// prefers, or "" if it takes neither.
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		coding, q := item, 1.0
+		if i := strings.IndexByte(item, ';'); i >= 0 {
+			coding = item[:i]
+			param := strings.TrimSpace(item[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "*" {
+			coding = "gzip"
+		}
+		// Ties go to gzip, which everything decodes the same way.
+		if (coding == "gzip" || coding == "deflate") && (q > bestQ || q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// Compressors are big, so they're reused.
+var (
+	gzipWriters sync.Pool
+	zlibWriters sync.Pool
+)
+
+// Compresses response bodies of at least minBytes.
+func compressFilter(minBytes int) outputFilter {
+	return func(r *request, header textproto.MIMEHeader, w io.Writer) io.WriteCloser {
+		if header.Get("Content-Encoding") != "" || !isCompressible(header.Get("Content-Type")) {
+			return nil
+		}
+		// The response differs by Accept-Encoding even when it goes out as
+		// it is.
+		if !strings.Contains(strings.ToLower(strings.Join(header["Vary"], ",")), "accept-encoding") {
+			header.Add("Vary", "Accept-Encoding")
+		}
+		coding := negotiateEncoding(r.header.Get("Accept-Encoding"))
+		if coding == "" {
+			return nil
+		}
+		if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil && n < minBytes {
+			return nil
+		}
+		return &compressWriter{coding: coding, header: header, w: w, minBytes: minBytes}
+	}
+}
+
+// Holds the body back until it reaches minBytes, then compresses the rest
+// of it as it's written. A range of the body goes out as it is, since the
+// range would be of the compressed body otherwise.
+type compressWriter struct {
+	coding   string
+	header   textproto.MIMEHeader
+	w        io.Writer
+	minBytes int
+	started  bool
+	partial  bool
+	buf      bytes.Buffer
+	enc      io.WriteCloser // Set once the body is known to be big enough.
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		c.partial = c.header.Get("Content-Range") != ""
+	}
+	if c.partial {
+		return c.w.Write(p)
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() < c.minBytes {
+		return len(p), nil
+	}
+	c.start()
+	if _, err := c.enc.Write(c.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	c.buf.Reset()
+	return len(p), nil
+}
+
+// Commits to compressing. Nothing has been written to w, so the headers
+// can still change.
+func (c *compressWriter) start() {
+	c.header.Set("Content-Encoding", c.coding)
+	// Filters ahead of this one may have set the length they wrote.
+	c.header.Del("Content-Length")
+	bodyRewritten(c.header)
+	if c.coding == "gzip" {
+		gz, _ := gzipWriters.Get().(*gzip.Writer)
+		if gz == nil {
+			gz = gzip.NewWriter(c.w)
+		} else {
+			gz.Reset(c.w)
+		}
+		c.enc = gz
+	} else {
+		zw, _ := zlibWriters.Get().(*zlib.Writer)
+		if zw == nil {
+			zw = zlib.NewWriter(c.w)
+		} else {
+			zw.Reset(c.w)
+		}
+		c.enc = zw
+	}
+}
+
+func (c *compressWriter) Close() error {
+	if c.partial {
+		return nil
+	}
+	if c.enc == nil {
+		// Too short to bother, so it goes out as it is.
+		c.header.Set("Content-Length", strconv.Itoa(c.buf.Len()))
+		_, err := c.w.Write(c.buf.Bytes())
+		return err
+	}
+	err := c.enc.Close()
+	switch enc := c.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *zlib.Writer:
+		zlibWriters.Put(enc)
+	}
+	return err
+}
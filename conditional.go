@@ -0,0 +1,63 @@
+package main
+
+// Conditional requests. Handlers that know a response's validators, an
+// ETag and or a modification time, call notModified before writing it, and
+// repeat visitors that already have it get a bodiless 304 instead.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// An ETag for a file, from its size and modification time. It changes
+// whenever the file is rewritten, without reading it.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// Reports whether the If-None-Match list names etag, comparing weakly as
+// RFC 7232 says to, so a W/ prefix on either side doesn't matter.
+func etagListMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers a GET or HEAD with 304 if the client's copy, going by
+// If-None-Match or else If-Modified-Since, is still current. etag and
+// modTime may be empty or zero if the response doesn't have them. Reports
+// whether it answered.
+func notModified(w responseWriter, r *request, etag string, modTime time.Time) bool {
+	if r.method != "GET" && r.method != "HEAD" {
+		return false
+	}
+	if inm := r.header.Get("If-None-Match"); inm != "" {
+		if etag == "" || !etagListMatches(inm, etag) {
+			return false
+		}
+	} else {
+		since, err := time.Parse(httpDate, r.header.Get("If-Modified-Since"))
+		// HTTP dates only go down to the second.
+		if err != nil || modTime.IsZero() || modTime.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	h := w.Header()
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(httpDate))
+	}
+	w.WriteHeader(304)
+	return true
+}
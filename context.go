@@ -0,0 +1,83 @@
+package main
+
+// Request contexts. Each request carries a context.Context, r.context(),
+// that's done once its client hangs up before the response is finished or
+// the server stops waiting for it to drain at shutdown, so a handler can
+// give up on work nobody will see, and pass the context on to bound what
+// it starts. The context holds the connection under connContextKey, and
+// whatever values the middleware in front attaches with withValue.
+//
+// A client gone quiet isn't noticed until its connection closes, and one
+// that shuts down its sending side after the request looks the same as one
+// that's gone. Under -event_loop handlers mustn't block anyway, and their
+// contexts are never done.
+
+import (
+	"context"
+	"time"
+)
+
+// How often a connection is checked for its client going away while a
+// request on it is being served.
+const peerCheckInterval = 100 * time.Millisecond
+
+// Keys for the values the server puts in a request's context, so they
+// can't collide with anyone else's.
+type contextKey struct{ name string }
+
+func (k *contextKey) String() string { return "context key " + k.name }
+
+// The *netSocket the request came in on.
+var connContextKey = &contextKey{"conn"}
+
+func (r *request) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Attaches val to the request's context under key, for the handlers after
+// this one to find with value.
+func (r *request) withValue(key, val interface{}) {
+	r.ctx = context.WithValue(r.context(), key, val)
+}
+
+func (r *request) value(key interface{}) interface{} {
+	return r.context().Value(key)
+}
+
+// The connection a request's context came from, nil if it has none.
+func connFromContext(ctx context.Context) *netSocket {
+	ns, _ := ctx.Value(connContextKey).(*netSocket)
+	return ns
+}
+
+// Calls cancel if the client on rw goes away, until the returned func is
+// called to stop watching.
+func watchPeer(rw *netSocket, cancel context.CancelFunc) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(peerCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				if peerGone(rw.fd) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	// Waiting for the watcher means it's done with the fd before the
+	// connection can close it.
+	return func() {
+		close(quit)
+		<-done
+	}
+}
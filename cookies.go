@@ -0,0 +1,134 @@
+package main
+
+// Cookies, as RFC 6265 has them: the Cookie header is read into name-value
+// pairs, and setCookie writes a Set-Cookie header with its attributes.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cookie struct {
+	name  string
+	value string
+
+	// Attributes, only sent in Set-Cookie.
+	path     string
+	domain   string
+	expires  time.Time // Zero for a session cookie.
+	maxAge   int       // Seconds; 0 leaves it out, below 0 deletes the cookie.
+	secure   bool
+	httpOnly bool
+	sameSite string // "Strict", "Lax", "None" or "" to leave it out.
+}
+
+// The cookies the client sent, in order. Pairs that aren't valid are
+// skipped.
+func (r *request) cookies() []cookie {
+	var cookies []cookie
+	for _, line := range r.header["Cookie"] {
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			i := strings.IndexByte(pair, '=')
+			if i <= 0 {
+				continue
+			}
+			name, value := pair[:i], pair[i+1:]
+			if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if !isCookieName(name) || !isCookieValue(value) {
+				continue
+			}
+			cookies = append(cookies, cookie{name: name, value: value})
+		}
+	}
+	return cookies
+}
+
+// The first cookie with the name, if there is one.
+func (r *request) cookie(name string) (cookie, bool) {
+	for _, c := range r.cookies() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return cookie{}, false
+}
+
+// Adds a Set-Cookie header for c to the response.
+func setCookie(w responseWriter, c cookie) error {
+	if !isCookieName(c.name) {
+		return fmt.Errorf("invalid cookie name %q", c.name)
+	}
+	if !isCookieValue(c.value) {
+		return fmt.Errorf("invalid value for cookie %s", c.name)
+	}
+	var b strings.Builder
+	b.WriteString(c.name + "=")
+	// Spaces and commas are only safe quoted.
+	if strings.ContainsAny(c.value, " ,") {
+		b.WriteString(`"` + c.value + `"`)
+	} else {
+		b.WriteString(c.value)
+	}
+	if c.path != "" {
+		b.WriteString("; Path=" + c.path)
+	}
+	if c.domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.domain, "."))
+	}
+	if !c.expires.IsZero() {
+		b.WriteString("; Expires=" + c.expires.UTC().Format(httpDate))
+	}
+	switch {
+	case c.maxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.maxAge))
+	case c.maxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.httpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	// Browsers drop SameSite=None cookies that aren't Secure.
+	if c.secure || c.sameSite == "None" {
+		b.WriteString("; Secure")
+	}
+	switch c.sameSite {
+	case "":
+	case "Strict", "Lax", "None":
+		b.WriteString("; SameSite=" + c.sameSite)
+	default:
+		return fmt.Errorf("cookie %s: SameSite must be Strict, Lax or None, not %q", c.name, c.sameSite)
+	}
+	w.Header().Add("Set-Cookie", b.String())
+	return nil
+}
+
+// Reports whether s is an HTTP token, which cookie names have to be.
+func isCookieName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether s is made of bytes allowed in a cookie value. Spaces and
+// commas are let through too, since browsers send them.
+func isCookieValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c >= 0x7f || c == '"' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
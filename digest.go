@@ -0,0 +1,104 @@
+package main
+
+// Request body integrity checks using Content-MD5 (RFC 1864), Digest
+// (RFC 3230), and Content-Digest and Repr-Digest (RFC 9530), plus an
+// optional Content-Digest on responses.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strings"
+)
+
+// Algorithms by their lowercase RFC 3230 and RFC 9530 names.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+type digestValue struct {
+	alg  string
+	want []byte
+}
+
+// Parses "alg=base64, ..." from a Digest header, or the RFC 9530
+// dictionary form "alg=:base64:, ..." from Content-Digest and Repr-Digest.
+// Algorithms this server doesn't know are skipped.
+func parseDigests(header string) ([]digestValue, bool) {
+	var digests []digestValue
+	for _, item := range strings.Split(header, ",") {
+		i := strings.IndexByte(item, '=')
+		if i < 0 {
+			return nil, false
+		}
+		alg := strings.ToLower(strings.TrimSpace(item[:i]))
+		if digestAlgorithms[alg] == nil {
+			continue
+		}
+		v := strings.Trim(strings.TrimSpace(item[i+1:]), ":")
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, false
+		}
+		digests = append(digests, digestValue{alg, sum})
+	}
+	return digests, true
+}
+
+func digestOf(alg string, b []byte) []byte {
+	h := digestAlgorithms[alg]()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Rejects requests whose body doesn't match a digest sent with it. Without
+// content codings the content and representation digests are the same
+// bytes, so all the headers are checked against the body as received.
+func verifyDigests(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		var digests []digestValue
+		if v := r.header.Get("Content-MD5"); v != "" {
+			sum, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return writeStatus(w, 400, "malformed Content-MD5 header\n")
+			}
+			digests = append(digests, digestValue{"md5", sum})
+		}
+		for _, name := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+			for _, v := range r.header[name] {
+				ds, ok := parseDigests(v)
+				if !ok {
+					return writeStatus(w, 400, "malformed "+name+" header\n")
+				}
+				digests = append(digests, ds...)
+			}
+		}
+		for _, d := range digests {
+			if !bytes.Equal(d.want, digestOf(d.alg, r.body)) {
+				return writeStatus(w, 400, d.alg+" digest does not match the request body\n")
+			}
+		}
+		return next(w, r)
+	}
+}
+
+// Adds a SHA-256 Content-Digest header to responses. The response is
+// buffered so the digest can go in the header block ahead of the body.
+func contentDigest(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		rec, err := recordResponse(next, r)
+		if err != nil {
+			return err
+		}
+		sum := base64.StdEncoding.EncodeToString(digestOf("sha-256", rec.body))
+		rec.header.Set("Content-Digest", "sha-256=:"+sum+":")
+		return rec.writeTo(w)
+	}
+}
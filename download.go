@@ -0,0 +1,248 @@
+package main
+
+// Resumable directory downloads. GET /download/{dir} streams an uncompressed
+// tarball of dir built on the fly. The archive layout is computed up front
+// from file sizes, so its length is known and any byte range of it can be
+// produced without generating the bytes before it, which lets download
+// managers resume with Range and If-Range.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A piece of the archive: literal bytes for headers and padding, or a span
+// of a file's contents.
+type tarSegment struct {
+	off  int64
+	size int64
+	data []byte
+	file string
+}
+
+type tarLayout struct {
+	segments []tarSegment
+	size     int64
+	etag     string // Changes whenever any file's name, size or mtime does.
+}
+
+const tarBlockSize = 512
+
+func layoutTar(dir string) (*tarLayout, error) {
+	l := &tarLayout{}
+	h := sha256.New()
+	add := func(seg tarSegment) {
+		seg.off = l.size
+		l.segments = append(l.segments, seg)
+		l.size += seg.size
+	}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil // Skip symlinks, devices, sockets, etc.
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// Drop fields that vary by machine so the archive, and its ETag, only
+		// depend on the files.
+		hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = "", "", 0, 0
+		fmt.Fprintf(h, "%s %d %d\n", hdr.Name, hdr.Size, hdr.ModTime.UnixNano())
+
+		// tar.Writer writes the header blocks as soon as WriteHeader is
+		// called, so a throwaway writer yields exactly the header bytes.
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+			return err
+		}
+		add(tarSegment{size: int64(buf.Len()), data: buf.Bytes()})
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			add(tarSegment{size: hdr.Size, file: file})
+			if pad := (tarBlockSize - hdr.Size%tarBlockSize) % tarBlockSize; pad > 0 {
+				add(tarSegment{size: pad, data: make([]byte, pad)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Two zero blocks end the archive.
+	add(tarSegment{size: 2 * tarBlockSize, data: make([]byte, 2*tarBlockSize)})
+	l.etag = `"` + hex.EncodeToString(h.Sum(nil))[:16] + `"`
+	return l, nil
+}
+
+// Writes bytes [start, end) of the archive.
+func (l *tarLayout) writeRange(w io.Writer, start, end int64) error {
+	for _, seg := range l.segments {
+		segEnd := seg.off + seg.size
+		if segEnd <= start || seg.off >= end {
+			continue
+		}
+		from, to := max64(start, seg.off)-seg.off, min64(end, segEnd)-seg.off
+		if seg.file == "" {
+			if _, err := w.Write(seg.data[from:to]); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(seg.file)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(from, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(w, f, to-from)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Parses a single range "bytes=a-b", "bytes=a-" or "bytes=-n" against size
+// into [start, end). ok is false for syntax this server doesn't serve
+// ranges for, such as multiple ranges; satisfiable is false if the range
+// lies outside the content.
+func parseByteRange(header string, size int64) (start, end int64, ok, satisfiable bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return 0, 0, false, false
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return 0, 0, false, false
+	}
+	first, last := spec[:i], spec[i+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		return max64(size-n, 0), size, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false, false
+		}
+		end = min64(n+1, size)
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
+}
+
+func downloadHandler(prefix, root string) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if r.method != "GET" && r.method != "HEAD" {
+			return writeStatus(w, 405, "method not allowed\n", "Allow: GET, HEAD")
+		}
+		rel := strings.TrimPrefix(r.uri, prefix)
+		if i := strings.IndexByte(rel, '?'); i >= 0 {
+			rel = rel[:i]
+		}
+		rel = filepath.Clean("/" + rel)
+		dir := filepath.Join(root, filepath.FromSlash(rel))
+		// Refuse directories reached through symlinks out of the root.
+		f, err := openBeneath(root, rel, false)
+		if err != nil {
+			return notFound(w, r)
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil || !fi.IsDir() {
+			return notFound(w, r)
+		}
+		l, err := layoutTar(dir)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Base(dir)
+		if rel == "/" {
+			name = filepath.Base(root)
+		}
+		if notModified(w, r, l.etag, time.Time{}) {
+			return nil
+		}
+		code, start, end := 200, int64(0), l.size
+		rangeHeader := r.header.Get("Range")
+		// A resumed download only gets a range if the archive hasn't changed.
+		if ifRange := r.header.Get("If-Range"); ifRange != "" && ifRange != l.etag {
+			rangeHeader = ""
+		}
+		if rangeHeader != "" {
+			s, e, ok, satisfiable := parseByteRange(rangeHeader, l.size)
+			if ok && !satisfiable {
+				return writeStatus(w, 416, "range not satisfiable\n",
+					fmt.Sprintf("Content-Range: bytes */%d", l.size))
+			}
+			if ok {
+				code, start, end = 206, s, e
+			}
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "application/x-tar")
+		h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+		h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+		if code == 206 {
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, l.size))
+		}
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("ETag", l.etag)
+		w.WriteHeader(code)
+		if r.method == "HEAD" {
+			return nil
+		}
+		return l.writeRange(w, start, end)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+// Encrypted Client Hello. Even over TLS, a client names the site it wants
+// in the clear, in its ClientHello. With -tls_ech_key, clients that have
+// the server's ECH config encrypt their real ClientHello to it, inside an
+// outer one that only names -tls_ech_public_name. The key file holds an
+// X25519 private key and the ECHConfigList made for it, in the PEM blocks
+// OpenSSL uses, and is made if it doesn't exist yet. /debug/ech serves the
+// config list, for the ech parameter of the site's DNS HTTPS record, which
+// is where clients look for it.
+//
+// The certificate must cover the public name too: a client with a stale
+// config is sent the current one in a handshake for that name instead.
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	echVersion     = 0xfe0d // The ECH extension's code point.
+	hpkeX25519     = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	hpkeHKDFSHA256 = 0x0001
+	hpkeAES128GCM  = 0x0001
+	hpkeChaCha20   = 0x0003
+)
+
+type echKey struct {
+	publicName string
+	configList []byte // The ECHConfigList clients are given.
+	key        tls.EncryptedClientHelloKey
+}
+
+// Encodes an ECHConfig, as in RFC 9849, for the X25519 public key pub.
+func marshalECHConfig(id uint8, publicName string, pub []byte) []byte {
+	var c bytes.Buffer
+	c.WriteByte(id)
+	binary.Write(&c, binary.BigEndian, uint16(hpkeX25519))
+	binary.Write(&c, binary.BigEndian, uint16(len(pub)))
+	c.Write(pub)
+	suites := []uint16{hpkeHKDFSHA256, hpkeAES128GCM, hpkeHKDFSHA256, hpkeChaCha20}
+	binary.Write(&c, binary.BigEndian, uint16(2*len(suites)))
+	binary.Write(&c, binary.BigEndian, suites)
+	c.WriteByte(0) // No maximum name length, which leaves padding to clients.
+	c.WriteByte(byte(len(publicName)))
+	c.WriteString(publicName)
+	binary.Write(&c, binary.BigEndian, uint16(0)) // No extensions.
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(echVersion))
+	binary.Write(&b, binary.BigEndian, uint16(c.Len()))
+	b.Write(c.Bytes())
+	return b.Bytes()
+}
+
+// Loads the ECH key from file, or makes one for publicName and writes it
+// there if there's no file yet.
+func loadOrCreateECHKey(file, publicName string) (*echKey, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err := createECHKey(file, publicName); err != nil {
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keyDER, list []byte
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			keyDER = block.Bytes
+		case "ECHCONFIG":
+			list = block.Bytes
+		}
+	}
+	if keyDER == nil || list == nil {
+		return nil, errors.New(file + ": want PRIVATE KEY and ECHCONFIG PEM blocks")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	priv, ok := parsed.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, errors.New(file + ": key isn't X25519")
+	}
+	config, name, err := firstECHConfig(list, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &echKey{
+		publicName: name,
+		configList: list,
+		key:        tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv.Bytes(), SendAsRetry: true},
+	}, nil
+}
+
+func createECHKey(file, publicName string) error {
+	if publicName == "" {
+		return errors.New("making an ECH key needs a public name")
+	}
+	if !validECHPublicName(publicName) {
+		return fmt.Errorf("ECH public name %q isn't a DNS name of two labels or more, which clients insist on", publicName)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	config := marshalECHConfig(id[0], publicName, priv.PublicKey().Bytes())
+	list := make([]byte, 2, 2+len(config))
+	binary.BigEndian.PutUint16(list, uint16(len(config)))
+	list = append(list, config...)
+	out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: list})...)
+	return ioutil.WriteFile(file, out, 0600)
+}
+
+func validECHPublicName(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return false
+		}
+		for _, r := range l {
+			if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Splits the first ECHConfig, which must be for the X25519 key pub, out of
+// an ECHConfigList, along with its public name.
+func firstECHConfig(list, pub []byte) (config []byte, publicName string, err error) {
+	bad := errors.New("malformed ECHConfigList")
+	if len(list) < 6 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, "", bad
+	}
+	n := 4 + int(binary.BigEndian.Uint16(list[4:]))
+	if binary.BigEndian.Uint16(list[2:]) != echVersion || 2+n > len(list) {
+		return nil, "", bad
+	}
+	config = list[2 : 2+n]
+	c := config[4:]
+	// config_id, kem_id, then the public key.
+	if len(c) < 5 || binary.BigEndian.Uint16(c[1:]) != hpkeX25519 {
+		return nil, "", errors.New("ECH config isn't for X25519")
+	}
+	keyLen := int(binary.BigEndian.Uint16(c[3:]))
+	if len(c) < 5+keyLen || !bytes.Equal(c[5:5+keyLen], pub) {
+		return nil, "", errors.New("ECH config is for another key")
+	}
+	c = c[5+keyLen:]
+	// The cipher suites, maximum name length and public name.
+	if len(c) < 2 || len(c) < 2+int(binary.BigEndian.Uint16(c)) {
+		return nil, "", bad
+	}
+	c = c[2+int(binary.BigEndian.Uint16(c)):]
+	if len(c) < 2 || len(c) < 2+int(c[1]) {
+		return nil, "", bad
+	}
+	return config, string(c[2 : 2+int(c[1])]), nil
+}
+
+// Serves the ECHConfigList to publish.
+func (k *echKey) handler(w responseWriter, r *request) error {
+	return writeJSON(w, 200, map[string]string{
+		"public_name":     k.publicName,
+		"ech_config_list": base64.StdEncoding.EncodeToString(k.configList),
+	})
+}
@@ -0,0 +1,507 @@
+//go:build !windows
+
+package main
+
+// A single threaded event loop serving every connection from one goroutine.
+// Sockets are non-blocking and the loop waits on epoll (Linux) or kqueue
+// (BSD, macOS) for the ones that are ready, instead of parking a goroutine
+// in a blocking read per connection. Requests are parsed once all of their
+// bytes have arrived, and responses are buffered and written as the socket
+// accepts them. Handlers run on the loop, so a slow handler stalls every
+// connection.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Waits for file descriptors to become readable or writable. Descriptors
+// are always watched for reads and, with setWrite, also for writes.
+type poller interface {
+	add(fd int) error
+	setWrite(fd int, write bool) error
+	remove(fd int) error
+	wait(events []pollEvent, timeout time.Duration) (int, error)
+	close() error
+}
+
+type pollEvent struct {
+	fd       int
+	readable bool
+	writable bool
+}
+
+type loopConn struct {
+	ns         *netSocket
+	in         []byte // Received bytes not yet parsed into a request.
+	scanned    int    // How much of in has been searched for the end of the head.
+	out        []byte // Response bytes not yet written.
+	eof        bool   // The peer closed its side.
+	closing    bool   // Close once out is written.
+	writing    bool   // Watching for writability.
+	lastActive time.Time
+	remote     net.Addr
+	local      net.Addr
+	// When the request in c.in started arriving, and when the response in
+	// c.out was ready to write.
+	readStart  time.Time
+	writeStart time.Time
+	// Holds the headers of the request being served, nil to not use one.
+	arena *headerArena
+}
+
+type eventLoop struct {
+	listener *netSocket
+	poller   poller
+	serve    handlerFunc
+	cfg      connConfig
+	conns    map[int]*loopConn
+
+	// Shutdown closes quit to start draining, and force to close every
+	// connection still open. run closes done when it returns.
+	quit     chan struct{}
+	force    chan struct{}
+	done     chan struct{}
+	draining bool
+}
+
+func newEventLoop(listener *netSocket, serve handlerFunc, cfg connConfig) (*eventLoop, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(listener.fd, true); err != nil {
+		p.close()
+		return nil, err
+	}
+	if err := p.add(listener.fd); err != nil {
+		p.close()
+		return nil, err
+	}
+	return &eventLoop{
+		listener: listener,
+		poller:   p,
+		serve:    serve,
+		cfg:      cfg,
+		conns:    make(map[int]*loopConn),
+		quit:     make(chan struct{}),
+		force:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Serves connections until shutdown has drained them all, then returns
+// errServerClosed.
+func (l *eventLoop) run() error {
+	defer close(l.done)
+	defer l.poller.close()
+	events := make([]pollEvent, 128)
+	for {
+		if !l.draining {
+			select {
+			case <-l.quit:
+				l.drain()
+			default:
+			}
+		}
+		select {
+		case <-l.force:
+			for _, c := range l.conns {
+				l.closeConn(c)
+			}
+		default:
+		}
+		if l.draining && len(l.conns) == 0 {
+			return errServerClosed
+		}
+		n, err := l.poller.wait(events, time.Second)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, ev := range events[:n] {
+			if ev.fd == l.listener.fd {
+				l.accept()
+				continue
+			}
+			c := l.conns[ev.fd]
+			if c == nil {
+				continue // Closed earlier in this batch.
+			}
+			if ev.readable {
+				l.read(c)
+			}
+			if ev.writable && l.conns[ev.fd] != nil {
+				l.flush(c)
+			}
+		}
+		l.closeExpired()
+	}
+}
+
+// Stops accepting and closes the connections between requests. The rest
+// close once they've answered the request they're on.
+func (l *eventLoop) drain() {
+	l.draining = true
+	l.poller.remove(l.listener.fd)
+	l.listener.Close()
+	for _, c := range l.conns {
+		switch {
+		case len(c.out) > 0:
+			c.closing = true
+		case len(c.in) == 0:
+			l.closeConn(c)
+		}
+	}
+}
+
+// Drains the loop, which notices within the second it waits for events at
+// most, then waits for it to finish or ctx to be done.
+func (l *eventLoop) shutdown(ctx context.Context) error {
+	close(l.quit)
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		close(l.force)
+		<-l.done
+		return ctx.Err()
+	}
+}
+
+// Accepts every pending connection.
+func (l *eventLoop) accept() {
+	for {
+		nfd, _, err := syscall.Accept(l.listener.fd)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return
+		}
+		if err != nil {
+			log.Print("accept: ", err)
+			return
+		}
+		syscall.CloseOnExec(nfd)
+		if !l.cfg.conns.acquire() {
+			syscall.Close(nfd)
+			continue
+		}
+		if err := syscall.SetNonblock(nfd, true); err != nil {
+			l.cfg.conns.release()
+			syscall.Close(nfd)
+			continue
+		}
+		if err := l.poller.add(nfd); err != nil {
+			l.cfg.conns.release()
+			syscall.Close(nfd)
+			continue
+		}
+		fdTrack.add(nfd, "connection")
+		ns := &netSocket{fd: nfd}
+		c := &loopConn{ns: ns, lastActive: time.Now(), remote: ns.RemoteAddr(), local: ns.LocalAddr()}
+		if l.cfg.headerArena {
+			c.arena = new(headerArena)
+		}
+		l.conns[nfd] = c
+	}
+}
+
+// Reads everything the socket has, then serves any complete requests. A
+// panic while serving only takes down this connection.
+func (l *eventLoop) read(c *loopConn) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("panic serving connection: %v\n%s", e, debug.Stack())
+			l.closeConn(c)
+		}
+	}()
+	buf := make([]byte, 64<<10)
+	for !c.eof {
+		n, err := syscall.Read(c.ns.fd, buf)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			l.closeConn(c)
+			return
+		}
+		if n == 0 {
+			c.eof = true
+			break
+		}
+		if len(c.in) == 0 {
+			c.readStart = time.Now()
+		}
+		c.in = append(c.in, buf[:n]...)
+		// A head that won't fit is refused without reading any more of it.
+		if len(c.in) > maxHeaderBytes && c.headEnd() < 0 {
+			break
+		}
+	}
+	c.lastActive = time.Now()
+	l.process(c)
+	l.flush(c)
+}
+
+// Serves requests from c.in for as long as it holds a complete one.
+func (l *eventLoop) process(c *loopConn) {
+	for !c.closing {
+		parseStart := time.Now()
+		req, err := c.nextRequest(l.cfg.maxBody)
+		if req != nil {
+			req.remoteAddr, req.localAddr = c.remote, c.local
+			req.start = parseStart
+		}
+		if err == errIncomplete {
+			if c.eof {
+				c.closing = true // Truncated, or nothing more.
+			}
+			return
+		}
+		if err == errBodyTooLarge {
+			l.serveOne(c, req, bodyTooLarge)
+			c.closing = true
+			c.in, c.scanned = nil, 0
+			return
+		}
+		var bad *badRequestError
+		if errors.As(err, &bad) {
+			log.Printf("bad request from %v: %v", c.remote, bad)
+			l.serveOne(c, req, bad.serve)
+			c.closing = true
+			c.in, c.scanned = nil, 0
+			return
+		}
+		h := l.serve
+		if err == errBadRequestURI {
+			h, err = badRequestURI, nil
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Print("reading request: ", err)
+			}
+			c.closing = true
+			return
+		}
+		req.recordPhase("parse", time.Since(parseStart))
+		c.readStart = time.Now() // For whatever was pipelined after it.
+		if !l.serveOne(c, req, h) || l.draining {
+			c.closing = true
+			c.in, c.scanned = nil, 0
+		}
+	}
+}
+
+// Most response bytes a connection may have waiting to be written. Handlers
+// can't be made to wait for the socket, so a response that would go past
+// it, like a large download, or ones piling up for a client that pipelines
+// requests without reading the responses, is cut off and the connection
+// closed.
+const maxLoopOutput = 16 << 20
+
+var errLoopOutputFull = fmt.Errorf("response over the event loop's %d byte buffer", maxLoopOutput)
+
+// A buffer that refuses writes past maxLoopOutput bytes.
+type loopOutput struct {
+	*bytes.Buffer
+}
+
+func (o loopOutput) Write(b []byte) (int, error) {
+	if o.Len()+len(b) > maxLoopOutput {
+		return 0, errLoopOutputFull
+	}
+	return o.Buffer.Write(b)
+}
+
+// Serves req with h into c.out, reporting whether the connection can be
+// reused.
+func (l *eventLoop) serveOne(c *loopConn, req *request, h handlerFunc) bool {
+	out := loopOutput{bytes.NewBuffer(c.out)}
+	if len(c.out) == 0 {
+		c.writeStart = time.Now()
+	}
+	defer func() { c.out = out.Bytes() }()
+	idle := l.cfg.idleTimeout
+	if l.draining {
+		idle = 0 // Answer with Connection: close.
+	}
+	return serveRequest(h, newConnWriter(out, req, idle), req)
+}
+
+// Writes as much of c.out as the socket accepts, and closes c once it's
+// all written if c is closing.
+func (l *eventLoop) flush(c *loopConn) {
+	for len(c.out) > 0 {
+		n, err := syscall.Write(c.ns.fd, c.out)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			l.closeConn(c)
+			return
+		}
+		c.out = c.out[n:]
+		c.lastActive = time.Now()
+	}
+	if len(c.out) == 0 && c.closing {
+		l.closeConn(c)
+		return
+	}
+	if want := len(c.out) > 0; want != c.writing {
+		c.writing = want
+		l.poller.setWrite(c.ns.fd, want)
+	}
+}
+
+func (l *eventLoop) closeConn(c *loopConn) {
+	l.poller.remove(c.ns.fd)
+	c.ns.Close()
+	l.cfg.conns.release()
+	delete(l.conns, c.ns.fd)
+}
+
+// Closes connections that have sat idle too long, are taking too long to
+// send a request, or too long to take a response.
+func (l *eventLoop) closeExpired() {
+	now := time.Now()
+	cfg := l.cfg
+	for _, c := range l.conns {
+		var why string
+		switch {
+		case len(c.out) > 0:
+			if cfg.writeTimeout > 0 && now.Sub(c.writeStart) > cfg.writeTimeout {
+				why = "response took too long to send to"
+			}
+		case len(c.in) > 0:
+			took := now.Sub(c.readStart)
+			if cfg.readTimeout > 0 && took > cfg.readTimeout ||
+				cfg.headerTimeout > 0 && took > cfg.headerTimeout && c.headEnd() < 0 {
+				why = "request took too long to arrive from"
+			}
+		}
+		if why == "" && cfg.idleTimeout > 0 && now.Sub(c.lastActive) > cfg.idleTimeout {
+			why = "closing idle connection to"
+		}
+		if why != "" {
+			log.Print(why, " ", c.remote)
+			l.closeConn(c)
+		}
+	}
+}
+
+var errIncomplete = errors.New("request incomplete")
+
+// Reads from r, then fails with errIncomplete instead of io.EOF unless the
+// peer has closed, so parsing a partly received request stops rather than
+// treating the bytes so far as the whole request.
+type pendingReader struct {
+	r   *bytes.Reader
+	eof bool
+}
+
+func (p *pendingReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err == io.EOF && !p.eof {
+		err = errIncomplete
+	}
+	return n, err
+}
+
+// Parses the request at the start of c.in and drops its bytes, or fails
+// with errIncomplete if it hasn't all arrived. Errors are as for
+// parseRequest.
+func (c *loopConn) nextRequest(maxBody func(*request) int64) (*request, error) {
+	if !c.eof && c.headEnd() < 0 && len(c.in) > maxHeaderBytes {
+		// There's no telling yet what of it is the request line, so the
+		// request is answered knowing nothing about it.
+		return new(request), &badRequestError{431, "request header too large"}
+	}
+	if !c.eof && !c.mayBeComplete(maxBody) {
+		return nil, errIncomplete
+	}
+	src := &pendingReader{r: bytes.NewReader(c.in), eof: c.eof}
+	b := bufio.NewReader(src)
+	req, err := parseRequest(b, maxBody, c.arena, nil)
+	if err == io.ErrUnexpectedEOF && !c.eof {
+		err = errIncomplete
+	}
+	if err != nil && err != errBadRequestURI {
+		return req, err
+	}
+	c.in, c.scanned = c.in[len(c.in)-src.r.Len()-b.Buffered():], 0
+	return req, err
+}
+
+// Where the body of the request at the start of c.in starts, just past
+// the blank line ending its head, or -1 if the head hasn't all arrived.
+// Lines may end in a bare LF, as readHead allows. Only the bytes received
+// since the last call are searched, along with the two before them.
+func (c *loopConn) headEnd() int {
+	i := c.scanned - 2
+	if i < 0 {
+		i = 0
+	}
+	for {
+		j := bytes.IndexByte(c.in[i:], '\n')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+		if bytes.HasPrefix(c.in[i:], []byte("\n")) {
+			c.scanned = i - 1
+			return i + 1
+		}
+		if bytes.HasPrefix(c.in[i:], []byte("\r\n")) {
+			c.scanned = i - 1
+			return i + 2
+		}
+	}
+	c.scanned = len(c.in)
+	return -1
+}
+
+// A cheap check that avoids parsing the buffered bytes again on every read
+// while a request with a Content-Length body is still arriving. A body
+// over maxBody is refused without waiting for it.
+func (c *loopConn) mayBeComplete(maxBody func(*request) int64) bool {
+	end := c.headEnd()
+	if end < 0 {
+		return false
+	}
+	lines := strings.Split(string(c.in[:end]), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	var req request
+	if sp := strings.Split(lines[0], " "); len(sp) == 3 {
+		req.method, req.uri = sp[0], sp[1]
+	}
+	limit := maxBody(&req)
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Length") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		return err != nil || limit > 0 && int64(n) > limit || len(c.in) >= end+n
+	}
+	return true
+}
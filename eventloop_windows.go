@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// There's no poller for Windows yet, so the event loop is never made.
+type eventLoop struct {
+	conns map[sysfd]bool
+}
+
+func newEventLoop(listener *netSocket, serve handlerFunc, cfg connConfig) (*eventLoop, error) {
+	return nil, errors.New("-event_loop isn't supported on Windows")
+}
+
+func (l *eventLoop) run() error {
+	return errors.New("-event_loop isn't supported on Windows")
+}
+
+func (l *eventLoop) shutdown(ctx context.Context) error {
+	return nil
+}
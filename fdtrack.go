@@ -0,0 +1,136 @@
+package main
+
+// File descriptor accounting. With -debug_fds every socket the server
+// opens is recorded, with what it's for and where it was opened, until
+// it's closed, and /debug/fds lists them alongside everything else in the
+// process's fd table, so a count creeping up under load can be pinned on
+// whatever keeps leaving them open. Files aren't opened through one place
+// the way sockets are, so they're seen in the table, by path, instead.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type fdRecord struct {
+	FD     int       `json:"fd"`
+	Kind   string    `json:"kind"`
+	Opened time.Time `json:"opened"`
+	At     string    `json:"at"` // The file and line that opened it.
+}
+
+type fdTracker struct {
+	mu   sync.Mutex
+	open map[sysfd]fdRecord
+}
+
+// Where sockets are tracked, nil to not track them.
+var fdTrack *fdTracker
+
+func newFDTracker() *fdTracker {
+	return &fdTracker{open: make(map[sysfd]fdRecord)}
+}
+
+// Records fd as opened, for kind, by the caller.
+func (t *fdTracker) add(fd sysfd, kind string) {
+	if t == nil {
+		return
+	}
+	at := "?"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		at = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[fd] = fdRecord{FD: int(fd), Kind: kind, Opened: clock.Now(), At: at}
+}
+
+// Records fd as closed. It must be called before the close, or the fd
+// could already have been reused and added again.
+func (t *fdTracker) remove(fd sysfd) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.open, fd)
+}
+
+// The sockets open now, oldest first.
+func (t *fdTracker) records() []fdRecord {
+	t.mu.Lock()
+	recs := make([]fdRecord, 0, len(t.open))
+	for _, rec := range t.open {
+		recs = append(recs, rec)
+	}
+	t.mu.Unlock()
+	sort.Slice(recs, func(i, j int) bool {
+		if !recs[i].Opened.Equal(recs[j].Opened) {
+			return recs[i].Opened.Before(recs[j].Opened)
+		}
+		return recs[i].FD < recs[j].FD
+	})
+	return recs
+}
+
+// The sockets opened since start and still open.
+func (t *fdTracker) openedSince(start time.Time) []fdRecord {
+	var recs []fdRecord
+	for _, rec := range t.records() {
+		if !rec.Opened.Before(start) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func (rec fdRecord) String() string {
+	return fmt.Sprintf("fd %d, %s, opened at %s %v ago", rec.FD, rec.Kind, rec.At, clock.Now().Sub(rec.Opened).Round(time.Millisecond))
+}
+
+// An entry in the process's fd table.
+type fdEntry struct {
+	FD     int    `json:"fd"`
+	Target string `json:"target,omitempty"` // What it's open on, where the system says.
+}
+
+// Lists the process's open fds, or nil if there's no telling.
+func fdTable() []fdEntry {
+	dir := "/proc/self/fd"
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		dir = "/dev/fd"
+		if fis, err = ioutil.ReadDir(dir); err != nil {
+			return nil
+		}
+	}
+	var entries []fdEntry
+	for _, fi := range fis {
+		fd, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		// One of them is the directory being read, gone by now.
+		target, err := os.Readlink(filepath.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		entries = append(entries, fdEntry{FD: fd, Target: target})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FD < entries[j].FD })
+	return entries
+}
+
+func (t *fdTracker) handler(w responseWriter, r *request) error {
+	return writeJSON(w, 200, map[string]interface{}{
+		"sockets": t.records(),
+		"table":   fdTable(),
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+// Output filters transform response bodies as they're written, for things
+// like minification, compression or injecting a banner. A route's filters
+// are set up on the first body write, once the handler has set its
+// headers, so each can look at the response and decide whether to apply.
+
+import (
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// Returns a writer that transforms what's written to it into w, or nil to
+// leave the response alone. It may change the headers, which aren't sent
+// before the first write to w; one that changes the body's length has to
+// set or delete Content-Length by then. Close flushes anything still
+// buffered into w, without closing w.
+type outputFilter func(r *request, header textproto.MIMEHeader, w io.Writer) io.WriteCloser
+
+// Filters run in stages, whatever order they're added in: transforms of
+// the content first, then picking out a requested range of it, then
+// encoding it, since nothing can transform a body once it's encoded.
+type filterStage int
+
+const (
+	stageTransform filterStage = iota
+	stageRange
+	stageEncoding
+)
+
+type stagedFilter struct {
+	stage  filterStage
+	filter outputFilter
+}
+
+func addFilters(w responseWriter, r *request, stage filterStage, fs []outputFilter) {
+	for _, f := range fs {
+		w.state.filters = append(w.state.filters, stagedFilter{stage, f})
+	}
+	w.state.filterRequest = r
+}
+
+// Filters the bodies of a route's responses. The first filter listed sees
+// the handler's output first, so minification goes ahead of compression.
+func withOutputFilters(fs ...outputFilter) routeOption {
+	return withMiddleware(filterOutput(fs...))
+}
+
+// Filters the bodies of the responses next writes. Filters added by
+// middleware further out see the handler's output first.
+func filterOutput(fs ...outputFilter) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			addFilters(w, r, stageTransform, fs)
+			return next(w, r)
+		}
+	}
+}
+
+// Applies a content coding to the bodies of the responses next writes,
+// after every other filter.
+func filterEncoding(f outputFilter) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			addFilters(w, r, stageEncoding, []outputFilter{f})
+			return next(w, r)
+		}
+	}
+}
+
+// Drops the validators describing a body a filter has changed.
+func bodyRewritten(header textproto.MIMEHeader) {
+	header.Del("Content-Digest")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// Writes the body unfiltered, past any filters.
+type bodyWriter struct {
+	w responseWriter
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.writeBody(p)
+}
+
+// Builds the filters that apply to the response on top of the body.
+func (w responseWriter) startFilters() {
+	s := w.state
+	var dst io.Writer = bodyWriter{w}
+	filters := s.filters
+	sort.SliceStable(filters, func(i, j int) bool { return filters[i].stage < filters[j].stage })
+	for i := len(filters) - 1; i >= 0; i-- {
+		if fw := filters[i].filter(s.filterRequest, s.header, dst); fw != nil {
+			s.filterChain = append(s.filterChain, fw)
+			dst = fw
+		}
+	}
+	s.filtered = dst
+}
+
+// Flushes the filters, the one the handler writes to first.
+func (w responseWriter) closeFilters() error {
+	s := w.state
+	for i := len(s.filterChain) - 1; i >= 0; i-- {
+		if err := s.filterChain[i].Close(); err != nil {
+			return err
+		}
+	}
+	s.filterChain = nil
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+// GeoIP access policy. The client's address is looked up in a MaxMind DB
+// country database, like GeoLite2-Country, and requests are allowed or
+// refused by country. The country is kept on the request for logging, and
+// requests are counted per country at /debug/geoip. Addresses the database
+// has no country for, such as loopback and private ones, are labelled "-"
+// and let through even with an allow list, unless the deny list names "-".
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+type geoCounts struct {
+	Allowed int64 `json:"allowed"`
+	Denied  int64 `json:"denied"`
+}
+
+type geoPolicy struct {
+	db    *mmdbReader
+	allow map[string]bool // When set, only these countries are allowed.
+	deny  map[string]bool
+
+	mu     sync.Mutex
+	counts map[string]*geoCounts
+}
+
+func parseCountries(list string) map[string]bool {
+	if list == "" {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		m[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return m
+}
+
+func newGeoPolicy(db *mmdbReader, allow, deny string) *geoPolicy {
+	return &geoPolicy{
+		db:     db,
+		allow:  parseCountries(allow),
+		deny:   parseCountries(deny),
+		counts: make(map[string]*geoCounts),
+	}
+}
+
+// Returns the ISO 3166 code of the country ip is in, or "-".
+func (g *geoPolicy) country(ip net.IP) string {
+	if ip == nil {
+		return "-"
+	}
+	v, err := g.db.lookup(ip)
+	if err != nil {
+		log.Printf("GeoIP lookup of %v: %v", ip, err)
+		return "-"
+	}
+	rec, _ := v.(map[string]interface{})
+	// Anycast and satellite addresses only have a registered country.
+	for _, field := range []string{"country", "registered_country"} {
+		c, _ := rec[field].(map[string]interface{})
+		if code, ok := c["iso_code"].(string); ok {
+			return code
+		}
+	}
+	return "-"
+}
+
+func (g *geoPolicy) allowed(country string) bool {
+	if g.deny[country] {
+		return false
+	}
+	return g.allow == nil || g.allow[country] || country == "-"
+}
+
+func (g *geoPolicy) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		r.country = g.country(r.remoteIP())
+		ok := g.allowed(r.country)
+		g.mu.Lock()
+		c := g.counts[r.country]
+		if c == nil {
+			c = &geoCounts{}
+			g.counts[r.country] = c
+		}
+		if ok {
+			c.Allowed++
+		} else {
+			c.Denied++
+		}
+		g.mu.Unlock()
+		if !ok {
+			return writeStatus(w, 403, "forbidden\n")
+		}
+		return next(w, r)
+	}
+}
+
+func (g *geoPolicy) handler(w responseWriter, r *request) error {
+	g.mu.Lock()
+	snapshot := make(map[string]geoCounts, len(g.counts))
+	for country, c := range g.counts {
+		snapshot[country] = *c
+	}
+	g.mu.Unlock()
+	return writeJSON(w, 200, snapshot)
+}
@@ -0,0 +1,987 @@
+package main
+
+// Minimal GraphQL adapter. A schema is a set of Go resolvers for the root
+// query and mutation fields, served over GET and POST.
+//
+// The executor supports the parts of the language needed to call such a
+// schema: operations with variables, aliases, arguments, nested selections,
+// named and inline fragments, and @include/@skip. There is no type system,
+// so documents aren't validated ahead of execution and introspection isn't
+// available; a field is resolved by looking it up on whatever Go value its
+// parent produced.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Arguments use the same Go types encoding/json produces: float64, string,
+// bool, nil, []interface{} and map[string]interface{}.
+type gqlArgs map[string]interface{}
+
+type gqlResolver func(args gqlArgs) (interface{}, error)
+
+// Resolved values may be scalars, maps with string keys, structs (fields
+// match by json tag or by name), slices of those, or gqlResolvers, which are
+// called with the arguments of the field that selects them.
+type gqlSchema struct {
+	query    map[string]gqlResolver
+	mutation map[string]gqlResolver
+}
+
+// Lexer
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlNumber
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+}
+
+func isGqlNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isGqlDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func gqlLex(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{gqlPunct, "..."})
+			i += 3
+		case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+			toks = append(toks, gqlToken{gqlPunct, string(c)})
+			i++
+		case isGqlNameStart(c):
+			j := i + 1
+			for j < len(src) && (isGqlNameStart(src[j]) || isGqlDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, gqlToken{gqlName, src[i:j]})
+			i = j
+		case c == '-' || isGqlDigit(c):
+			j := i + 1
+			for j < len(src) {
+				d := src[j]
+				if isGqlDigit(d) || d == '.' || d == 'e' || d == 'E' ||
+					(d == '+' || d == '-') && (src[j-1] == 'e' || src[j-1] == 'E') {
+					j++
+					continue
+				}
+				break
+			}
+			toks = append(toks, gqlToken{gqlNumber, src[i:j]})
+			i = j
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, errors.New("unterminated block string")
+			}
+			block := strings.Replace(src[i+3:i+3+end], `\"""`, `"""`, -1)
+			toks = append(toks, gqlToken{gqlString, strings.TrimSpace(block)})
+			i += end + 6
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, errors.New("unterminated string")
+			}
+			// GraphQL string escapes are the same as JSON's.
+			var s string
+			if err := json.Unmarshal([]byte(src[i:j+1]), &s); err != nil {
+				return nil, fmt.Errorf("invalid string %s", src[i:j+1])
+			}
+			toks = append(toks, gqlToken{gqlString, s})
+			i = j + 1
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return append(toks, gqlToken{kind: gqlEOF}), nil
+}
+
+// Syntax tree
+
+// A value is a variable reference, a literal, a list, or an input object.
+type gqlValue struct {
+	variable string
+	literal  interface{}
+	list     []gqlValue
+	object   []gqlArg
+	isList   bool
+	isObject bool
+}
+
+type gqlArg struct {
+	name  string
+	value gqlValue
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+}
+
+// A selection is a field, a fragment spread (spread is set), or an inline
+// fragment (inline is set).
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       []gqlArg
+	directives []gqlDirective
+	sel        []gqlSelection
+	spread     string
+	inline     bool
+}
+
+type gqlVarDef struct {
+	name     string
+	nonNull  bool
+	defValue *gqlValue
+}
+
+type gqlOperation struct {
+	kind string // query, mutation or subscription
+	name string
+	vars []gqlVarDef
+	sel  []gqlSelection
+}
+
+type gqlDocument struct {
+	ops       []*gqlOperation
+	fragments map[string][]gqlSelection
+}
+
+// Parser
+
+// How deeply selection sets, list and object values and list types may
+// nest. Parsing recurses, and past this a document is more likely an attempt
+// to run the stack out than a query.
+const gqlMaxDepth = 128
+
+type gqlParser struct {
+	toks  []gqlToken
+	pos   int
+	depth int
+}
+
+// Goes a level deeper, failing past gqlMaxDepth. The caller calls leave
+// once it's done with the level, failed or not.
+func (p *gqlParser) enter() error {
+	p.depth++
+	if p.depth > gqlMaxDepth {
+		return fmt.Errorf("nested more than %d deep", gqlMaxDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) leave() { p.depth-- }
+
+func (p *gqlParser) peek() gqlToken { return p.toks[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.pos]
+	if t.kind != gqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) peekPunct(s string) bool {
+	t := p.peek()
+	return t.kind == gqlPunct && t.value == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	if t := p.next(); t.kind != gqlPunct || t.value != s {
+		return fmt.Errorf("expected %q, got %q", s, t.value)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != gqlName {
+		return "", fmt.Errorf("expected name, got %q", t.value)
+	}
+	return t.value, nil
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := gqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{fragments: make(map[string][]gqlSelection)}
+	for p.peek().kind != gqlEOF {
+		if p.peekPunct("{") {
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, &gqlOperation{kind: "query", sel: sel})
+			continue
+		}
+		kw, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch kw {
+		case "query", "mutation", "subscription":
+			op, err := p.operation(kw)
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, op)
+		case "fragment":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if on, err := p.name(); err != nil || on != "on" {
+				return nil, fmt.Errorf("expected 'on' in fragment %s", name)
+			}
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = sel
+		default:
+			return nil, fmt.Errorf("unexpected %q", kw)
+		}
+	}
+	if len(doc.ops) == 0 {
+		return nil, errors.New("document contains no operations")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation(kind string) (*gqlOperation, error) {
+	op := &gqlOperation{kind: kind}
+	if p.peek().kind == gqlName {
+		op.name = p.next().value
+	}
+	if p.peekPunct("(") {
+		p.next()
+		for !p.peekPunct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			nonNull, err := p.typeRef()
+			if err != nil {
+				return nil, err
+			}
+			def := gqlVarDef{name: name, nonNull: nonNull}
+			if p.peekPunct("=") {
+				p.next()
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				def.defValue = &v
+			}
+			op.vars = append(op.vars, def)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.sel = sel
+	return op, nil
+}
+
+// Skips a type reference like [Int!]!, reporting whether the outer type is
+// non-null.
+func (p *gqlParser) typeRef() (bool, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return false, err
+	}
+	if p.peekPunct("[") {
+		p.next()
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peekPunct("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []gqlSelection
+	for !p.peekPunct("}") {
+		if p.peek().kind == gqlEOF {
+			return nil, errors.New("unterminated selection set")
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, s)
+	}
+	p.next()
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var s gqlSelection
+	var err error
+	if p.peekPunct("...") {
+		p.next()
+		if t := p.peek(); t.kind == gqlName && t.value != "on" {
+			s.spread = p.next().value
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.peek().kind == gqlName {
+			p.next() // on
+			if _, err := p.name(); err != nil {
+				return s, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return s, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.peekPunct(":") {
+		p.next()
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return s, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.peekPunct("{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() ([]gqlArg, error) {
+	if !p.peekPunct("(") {
+		return nil, nil
+	}
+	p.next()
+	var args []gqlArg
+	for !p.peekPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlArg{name, v})
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var ds []gqlDirective
+	for p.peekPunct("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, gqlDirective{name, args})
+	}
+	return ds, nil
+}
+
+func (p *gqlParser) value() (gqlValue, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return gqlValue{}, err
+	}
+	t := p.next()
+	switch t.kind {
+	case gqlNumber:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return gqlValue{}, fmt.Errorf("invalid number %q", t.value)
+		}
+		return gqlValue{literal: f}, nil
+	case gqlString:
+		return gqlValue{literal: t.value}, nil
+	case gqlName:
+		switch t.value {
+		case "true":
+			return gqlValue{literal: true}, nil
+		case "false":
+			return gqlValue{literal: false}, nil
+		case "null":
+			return gqlValue{}, nil
+		}
+		return gqlValue{literal: t.value}, nil // Enum values become strings.
+	case gqlPunct:
+		switch t.value {
+		case "$":
+			name, err := p.name()
+			return gqlValue{variable: name}, err
+		case "[":
+			v := gqlValue{isList: true}
+			for !p.peekPunct("]") {
+				if p.peek().kind == gqlEOF {
+					return v, errors.New("unterminated list")
+				}
+				item, err := p.value()
+				if err != nil {
+					return v, err
+				}
+				v.list = append(v.list, item)
+			}
+			p.next()
+			return v, nil
+		case "{":
+			v := gqlValue{isObject: true}
+			for !p.peekPunct("}") {
+				name, err := p.name()
+				if err != nil {
+					return v, err
+				}
+				if err := p.expect(":"); err != nil {
+					return v, err
+				}
+				field, err := p.value()
+				if err != nil {
+					return v, err
+				}
+				v.object = append(v.object, gqlArg{name, field})
+			}
+			p.next()
+			return v, nil
+		}
+	}
+	return gqlValue{}, fmt.Errorf("unexpected %q in value", t.value)
+}
+
+// Execution
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   *gqlObject `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// A result object that keeps fields in selection order.
+type gqlObject []gqlField
+
+type gqlField struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (v gqlValue) resolve(vars map[string]interface{}) interface{} {
+	switch {
+	case v.variable != "":
+		return vars[v.variable]
+	case v.isList:
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			list[i] = item.resolve(vars)
+		}
+		return list
+	case v.isObject:
+		obj := make(map[string]interface{}, len(v.object))
+		for _, f := range v.object {
+			obj[f.name] = f.value.resolve(vars)
+		}
+		return obj
+	}
+	return v.literal
+}
+
+type gqlExecutor struct {
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	errors []gqlError
+}
+
+// A field after fragments are flattened and fields sharing a response key
+// are merged.
+type gqlCollected struct {
+	key  string
+	name string
+	args []gqlArg
+	sel  []gqlSelection
+}
+
+// Picks the operation to run from the parsed document.
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.ops) > 1 {
+			return nil, errors.New("operationName is required for documents with several operations")
+		}
+		return doc.ops[0], nil
+	}
+	for _, op := range doc.ops {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+func (s *gqlSchema) execute(doc *gqlDocument, op *gqlOperation, vars map[string]interface{}) gqlResponse {
+	e := &gqlExecutor{doc: doc, vars: make(map[string]interface{})}
+	for _, def := range op.vars {
+		if v, ok := vars[def.name]; ok {
+			e.vars[def.name] = v
+		} else if def.defValue != nil {
+			e.vars[def.name] = def.defValue.resolve(nil)
+		} else if def.nonNull {
+			return gqlResponse{Errors: []gqlError{{Message: "variable $" + def.name + " is required"}}}
+		}
+	}
+
+	roots, typename := s.query, "Query"
+	switch op.kind {
+	case "mutation":
+		roots, typename = s.mutation, "Mutation"
+	case "subscription":
+		return gqlResponse{Errors: []gqlError{{Message: "subscriptions are not supported"}}}
+	}
+
+	// Root fields run one at a time, which is what mutations require anyway.
+	data := gqlObject{}
+	for _, f := range e.collect(op.sel, nil) {
+		path := []interface{}{f.key}
+		if f.name == "__typename" {
+			data = append(data, gqlField{f.key, typename})
+			continue
+		}
+		resolve, ok := roots[f.name]
+		if !ok {
+			e.fail(path, fmt.Errorf("no field %q on %s", f.name, typename))
+			data = append(data, gqlField{f.key, nil})
+			continue
+		}
+		data = append(data, gqlField{f.key, e.call(resolve, f, path)})
+	}
+	return gqlResponse{Data: &data, Errors: e.errors}
+}
+
+func (e *gqlExecutor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: path})
+}
+
+func (e *gqlExecutor) call(resolve gqlResolver, f *gqlCollected, path []interface{}) interface{} {
+	args := make(gqlArgs, len(f.args))
+	for _, a := range f.args {
+		args[a.name] = a.value.resolve(e.vars)
+	}
+	v, err := resolve(args)
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	return e.complete(v, f.sel, path)
+}
+
+// Reports whether @include and @skip allow a selection.
+func (e *gqlExecutor) included(ds []gqlDirective) bool {
+	for _, d := range ds {
+		for _, a := range d.args {
+			if a.name != "if" {
+				continue
+			}
+			cond, _ := a.value.resolve(e.vars).(bool)
+			if d.name == "include" && !cond || d.name == "skip" && cond {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e *gqlExecutor) collect(sels []gqlSelection, visited map[string]bool) []*gqlCollected {
+	var fields []*gqlCollected
+	byKey := make(map[string]*gqlCollected)
+	var walk func([]gqlSelection)
+	walk = func(sels []gqlSelection) {
+		for _, s := range sels {
+			if !e.included(s.directives) {
+				continue
+			}
+			switch {
+			case s.spread != "":
+				if visited[s.spread] {
+					continue
+				}
+				if visited == nil {
+					visited = make(map[string]bool)
+				}
+				visited[s.spread] = true
+				walk(e.doc.fragments[s.spread])
+			case s.inline:
+				walk(s.sel)
+			default:
+				key := s.alias
+				if key == "" {
+					key = s.name
+				}
+				if f, ok := byKey[key]; ok {
+					f.sel = append(f.sel, s.sel...)
+					continue
+				}
+				f := &gqlCollected{key: key, name: s.name, args: s.args, sel: s.sel}
+				byKey[key] = f
+				fields = append(fields, f)
+			}
+		}
+	}
+	walk(sels)
+	return fields
+}
+
+// Applies a selection set to a resolved Go value.
+func (e *gqlExecutor) complete(v interface{}, sel []gqlSelection, path []interface{}) interface{} {
+	if len(sel) == 0 {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = e.complete(rv.Index(i).Interface(), sel, append(path[:len(path):len(path)], i))
+		}
+		return list
+	case reflect.Map, reflect.Struct:
+		obj := gqlObject{}
+		for _, f := range e.collect(sel, nil) {
+			fpath := append(path[:len(path):len(path)], f.key)
+			if f.name == "__typename" {
+				obj = append(obj, gqlField{f.key, gqlTypename(rv)})
+				continue
+			}
+			fv, ok := gqlLookup(rv, f.name)
+			if !ok {
+				e.fail(fpath, fmt.Errorf("no field %q on %s", f.name, gqlTypename(rv)))
+				obj = append(obj, gqlField{f.key, nil})
+				continue
+			}
+			switch resolve := fv.(type) {
+			case gqlResolver:
+				fv = e.call(resolve, f, fpath)
+			case func(gqlArgs) (interface{}, error):
+				fv = e.call(resolve, f, fpath)
+			default:
+				fv = e.complete(fv, f.sel, fpath)
+			}
+			obj = append(obj, gqlField{f.key, fv})
+		}
+		return obj
+	}
+	e.fail(path, errors.New("cannot select fields on a scalar"))
+	return nil
+}
+
+func gqlLookup(rv reflect.Value, name string) (interface{}, bool) {
+	if rv.Kind() == reflect.Map {
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		fv := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !fv.IsValid() {
+			return nil, false
+		}
+		return fv.Interface(), true
+	}
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // Unexported.
+		}
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if tag == name || tag == "" && (sf.Name == name || gqlLowerFirst(sf.Name) == name) {
+			return rv.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+func gqlLowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return string(unicode.ToLower(rune(s[0]))) + s[1:]
+}
+
+// Values may name their GraphQL type with a typename method or, for maps, a
+// "__typename" entry. Otherwise structs use their Go type name.
+func gqlTypename(rv reflect.Value) string {
+	if t, ok := rv.Interface().(interface{ typename() string }); ok {
+		return t.typename()
+	}
+	if rv.Kind() == reflect.Map {
+		if t, ok := gqlLookup(rv, "__typename"); ok {
+			if s, ok := t.(string); ok {
+				return s
+			}
+		}
+		return "Object"
+	}
+	return rv.Type().Name()
+}
+
+// HTTP transport
+
+const graphiqlPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>GraphiQL</title>
+<link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+</head>
+<body style="margin: 0">
+<div id="graphiql" style="height: 100vh"></div>
+<script crossorigin src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+<script crossorigin src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+<script crossorigin src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+<script>
+const fetcher = GraphiQL.createFetcher({url: window.location.pathname});
+ReactDOM.createRoot(document.getElementById('graphiql'))
+  .render(React.createElement(GraphiQL, {fetcher}));
+</script>
+</body>
+</html>
+`
+
+// Serves the schema following the GraphQL over HTTP conventions: queries
+// over GET or POST, mutations only over POST. With graphiql set, a browser
+// GET without a query receives the GraphiQL IDE. Bodies and queries over
+// maxBytes get 413.
+func graphqlHandler(s *gqlSchema, graphiql bool, maxBytes int) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		var req gqlRequest
+		switch r.method {
+		case "GET":
+			q := r.queryParams()
+			if q.Get("query") == "" && graphiql && strings.Contains(r.header.Get("Accept"), "text/html") {
+				return writeHtml(func(*request) string { return graphiqlPage })(w, r)
+			}
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if vars := q.Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					return writeJSON(w, 400, gqlResponse{Errors: []gqlError{{Message: "variables must be a JSON object"}}})
+				}
+			}
+		case "POST":
+			if len(r.body) > maxBytes {
+				return writeStatus(w, 413, fmt.Sprintf("GraphQL request exceeds %d bytes\n", maxBytes))
+			}
+			mediaType, _, _ := mime.ParseMediaType(r.header.Get("Content-Type"))
+			switch mediaType {
+			case "application/json":
+				if err := json.Unmarshal(r.body, &req); err != nil {
+					return writeJSON(w, 400, gqlResponse{Errors: []gqlError{{Message: "malformed JSON body"}}})
+				}
+			case "application/graphql":
+				req.Query = string(r.body)
+			default:
+				return writeStatus(w, 415, "expected application/json or application/graphql\n")
+			}
+		default:
+			return writeStatus(w, 405, "method not allowed\n", "Allow: GET, POST")
+		}
+		if req.Query == "" {
+			return writeJSON(w, 400, gqlResponse{Errors: []gqlError{{Message: "missing query"}}})
+		}
+		if len(req.Query) > maxBytes {
+			return writeStatus(w, 413, fmt.Sprintf("GraphQL request exceeds %d bytes\n", maxBytes))
+		}
+
+		doc, err := parseGraphQL(req.Query)
+		if err != nil {
+			return writeJSON(w, 400, gqlResponse{Errors: []gqlError{{Message: "syntax error: " + err.Error()}}})
+		}
+		op, err := doc.operation(req.OperationName)
+		if err != nil {
+			return writeJSON(w, 400, gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+		}
+		if op.kind != "query" && r.method == "GET" {
+			return writeStatus(w, 405, op.kind+" operations require POST\n", "Allow: POST")
+		}
+		return writeJSON(w, 200, s.execute(doc, op, req.Variables))
+	}
+}
+
+// Demo schema: a message board.
+//
+//	query { messages { id text } message(id: 1) { text } }
+//	mutation { post(text: "hi") { id } }
+
+type gqlMessage struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+func (gqlMessage) typename() string { return "Message" }
+
+func newDemoSchema() *gqlSchema {
+	var mu sync.Mutex
+	var messages []gqlMessage
+	return &gqlSchema{
+		query: map[string]gqlResolver{
+			"messages": func(gqlArgs) (interface{}, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]gqlMessage(nil), messages...), nil
+			},
+			"message": func(args gqlArgs) (interface{}, error) {
+				id, ok := args["id"].(float64)
+				if !ok {
+					return nil, errors.New("id must be a number")
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for _, m := range messages {
+					if float64(m.ID) == id {
+						return m, nil
+					}
+				}
+				return nil, nil
+			},
+		},
+		mutation: map[string]gqlResolver{
+			"post": func(args gqlArgs) (interface{}, error) {
+				text, ok := args["text"].(string)
+				if !ok || text == "" {
+					return nil, errors.New("text must be a non-empty string")
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				m := gqlMessage{ID: len(messages) + 1, Text: text}
+				messages = append(messages, m)
+				return m, nil
+			},
+		},
+	}
+}
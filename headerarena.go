@@ -0,0 +1,127 @@
+package main
+
+// Header storage. Rather than a string allocated per header line, name and
+// value, a connection copies each request's header block into a byte arena
+// it keeps from one request to the next, and the request's header values,
+// and the names that aren't common enough to have a string of their own,
+// are views into it. They're only valid until the response to that request
+// is done: the next request on the connection writes over them. A handler
+// keeping a header value past then, in a cache or a goroutine that
+// outlives the request, has to take its own copy with retain.
+// -header_arena=false goes back to a string per header, for when something
+// is suspected of keeping one.
+
+import (
+	"bytes"
+	"net/textproto"
+	"unsafe"
+)
+
+// An arena bigger than this after a request isn't kept for the next one, so
+// one huge request doesn't pin its size for the life of the connection.
+const maxArenaKeep = 64 << 10
+
+// Names that get a string of their own, so looking one up in a request's
+// header doesn't go through the arena.
+var commonHeaders = make(map[string]string)
+
+func init() {
+	for _, k := range []string{
+		"Accept", "Accept-Charset", "Accept-Encoding", "Accept-Language", "Authorization",
+		"Cache-Control", "Connection", "Content-Digest", "Content-Encoding", "Content-Length",
+		"Content-Md5", "Content-Type", "Cookie", "Date", "Digest", "Expect", "Forwarded", "Host",
+		"Idempotency-Key", "If-Match", "If-Modified-Since", "If-None-Match", "If-Range",
+		"If-Unmodified-Since", "Keep-Alive", "Origin", "Pragma", "Range", "Referer",
+		"Sec-Fetch-Dest", "Sec-Fetch-Mode", "Sec-Fetch-Site", "Signature", "Signature-Input",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade", "User-Agent", "Via", "X-Api-Key",
+		"X-Forwarded-For", "X-Forwarded-Proto", "X-Real-Ip", "X-Request-Id",
+	} {
+		commonHeaders[k] = k
+	}
+}
+
+type headerArena struct {
+	buf []byte // The head of the request being served.
+}
+
+// Empties the arena for the next request's head, over whatever the last
+// one left there.
+func (a *headerArena) reset() []byte {
+	if cap(a.buf) > maxArenaKeep {
+		a.buf = nil
+	}
+	return a.buf[:0]
+}
+
+// Parses the header lines in block, as read by readHead, up to the blank
+// line that ends them. The header's values, and its uncommon names, are
+// views of block. Errors are as for textproto.Reader.ReadMIMEHeader, except
+// that a malformed header fails with a *badRequestError: obsolete line
+// folding included, which is allowed to be refused and is mostly seen from
+// clients up to no good.
+func parseHeader(block []byte) (textproto.MIMEHeader, error) {
+	n := bytes.Count(block, []byte("\n"))
+	h := make(textproto.MIMEHeader, n)
+	// One slice backs the values of every name, as textproto does it; a
+	// name seen again gets a slice of its own on append.
+	values := make([]string, n)
+	for i := 0; ; i++ {
+		eol := bytes.IndexByte(block, '\n')
+		if eol < 0 {
+			return nil, badRequest("malformed header")
+		}
+		line := bytes.TrimRight(block[:eol], "\r")
+		block = block[eol+1:]
+		if len(line) == 0 {
+			return h, nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, badRequest("malformed header")
+		}
+		colon := bytes.IndexByte(line, ':')
+		// Space before the colon is refused along with everything else
+		// that isn't a token.
+		if colon < 0 || !isToken(arenaString(line[:colon])) {
+			return nil, badRequest("malformed header")
+		}
+		key := canonicalKey(line[:colon])
+		values[i] = arenaString(bytes.Trim(line[colon+1:], " \t"))
+		if vs, ok := h[key]; ok {
+			h[key] = append(vs, values[i])
+		} else {
+			h[key] = values[i : i+1 : i+1]
+		}
+	}
+}
+
+// Canonicalizes the header name k in place, as textproto.CanonicalMIMEHeaderKey
+// does a token, and returns it as a string: the common one if there is
+// one, or else a view of k.
+func canonicalKey(k []byte) string {
+	upper := true
+	for i, c := range k {
+		if upper && c >= 'a' && c <= 'z' {
+			k[i] = c - ('a' - 'A')
+		} else if !upper && c >= 'A' && c <= 'Z' {
+			k[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	// The conversion in a map index doesn't allocate.
+	if s, ok := commonHeaders[string(k)]; ok {
+		return s
+	}
+	return arenaString(k)
+}
+
+// A string sharing b's bytes, for as long as nothing writes over them.
+func arenaString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// A copy of s that the next request on the connection won't write over,
+// for keeping a header value past the response to the request it came
+// with.
+func retain(s string) string {
+	return string(append([]byte(nil), s...))
+}
@@ -0,0 +1,587 @@
+package main
+
+// Verification of HTTP Message Signatures (RFC 9421). A client signs chosen
+// parts of the request, listed in Signature-Input, and sends the signature
+// in Signature:
+//
+//	Signature-Input: sig1=("@method" "@path" "content-digest");created=1700000000;keyid="ci"
+//	Signature: sig1=:MEUCIQ...:
+//
+// Keys are looked up by keyid through a sigKeyResolver, so they can come
+// from a file, a database or anywhere else.
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A key a signature can be verified with. key is the HMAC secret as []byte
+// or the public key for the other algorithms.
+type sigKey struct {
+	alg string // hmac-sha256, rsa-pss-sha512, rsa-v1_5-sha256, ecdsa-p256-sha256 or ed25519
+	key interface{}
+}
+
+// Returns the key with the given keyid, or an error if there isn't one.
+type sigKeyResolver func(keyID string) (*sigKey, error)
+
+var errUnknownKey = errors.New("unknown signature keyid")
+
+// Loads keys from a file with one "keyid alg key" line per key. For
+// hmac-sha256 key is the base64 encoded secret, otherwise it's the path of
+// a PEM encoded public key. Blank lines and lines starting with # are
+// skipped.
+func loadSigKeys(file string) (sigKeyResolver, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string]*sigKey)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want keyid, alg and key", file, n)
+		}
+		k, err := parseSigKey(fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		keys[fields[0]] = k
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return func(keyID string) (*sigKey, error) {
+		if k, ok := keys[keyID]; ok {
+			return k, nil
+		}
+		return nil, errUnknownKey
+	}, nil
+}
+
+func parseSigKey(alg, value string) (*sigKey, error) {
+	if alg == "hmac-sha256" {
+		secret, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return &sigKey{alg: alg, key: secret}, nil
+	}
+	b, err := ioutil.ReadFile(value)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New(value + ": no PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	switch alg {
+	case "rsa-pss-sha512", "rsa-v1_5-sha256":
+		_, ok = pub.(*rsa.PublicKey)
+	case "ecdsa-p256-sha256":
+		_, ok = pub.(*ecdsa.PublicKey)
+	case "ed25519":
+		_, ok = pub.(ed25519.PublicKey)
+	default:
+		return nil, errors.New("unsupported algorithm " + alg)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: not a key for %s", value, alg)
+	}
+	return &sigKey{alg: alg, key: pub}, nil
+}
+
+func (k *sigKey) verify(base, sig []byte) bool {
+	switch k.alg {
+	case "hmac-sha256":
+		mac := hmac.New(sha256.New, k.key.([]byte))
+		mac.Write(base)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "rsa-pss-sha512":
+		sum := sha512.Sum512(base)
+		return rsa.VerifyPSS(k.key.(*rsa.PublicKey), crypto.SHA512, sum[:], sig,
+			&rsa.PSSOptions{SaltLength: 64}) == nil
+	case "rsa-v1_5-sha256":
+		sum := sha256.Sum256(base)
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, sum[:], sig) == nil
+	case "ecdsa-p256-sha256":
+		// The signature is r and s as two 32 byte big-endian integers,
+		// not ASN.1.
+		if len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(base)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k.key.(*ecdsa.PublicKey), sum[:], r, s)
+	case "ed25519":
+		return ed25519.Verify(k.key.(ed25519.PublicKey), base, sig)
+	}
+	return false
+}
+
+// Builds the value of a covered component.
+func sigComponent(r *request, c sfItem) (string, error) {
+	name, _ := c.value.(string)
+	u, err := url.ParseRequestURI(r.uri)
+	if err != nil {
+		return "", err
+	}
+	switch name {
+	case "@method":
+		return r.method, nil
+	case "@authority":
+		return strings.ToLower(r.header.Get("Host")), nil
+	case "@scheme":
+		return r.scheme(), nil
+	case "@target-uri":
+		return r.scheme() + "://" + strings.ToLower(r.header.Get("Host")) + r.uri, nil
+	case "@request-target":
+		return r.uri, nil
+	case "@path":
+		return u.EscapedPath(), nil
+	case "@query":
+		return "?" + u.RawQuery, nil
+	case "@query-param":
+		param, _ := c.param("name").(string)
+		values, ok := u.Query()[param]
+		if !ok {
+			return "", fmt.Errorf("no query parameter %q to cover", param)
+		}
+		// Re-encoded as percent escapes, with spaces as %20 rather than +.
+		return strings.Replace(url.QueryEscape(values[0]), "+", "%20", -1), nil
+	}
+	if strings.HasPrefix(name, "@") || len(c.params) > 0 {
+		return "", fmt.Errorf("unsupported component %s", serializeSFItem(c))
+	}
+	values, ok := r.header[textproto.CanonicalMIMEHeaderKey(name)]
+	if !ok {
+		return "", fmt.Errorf("no %s header to cover", name)
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// Builds the signature base the signer signed for the given Signature-Input
+// member.
+func sigBase(r *request, input sfItem) ([]byte, error) {
+	components, ok := input.value.([]sfItem)
+	if !ok {
+		return nil, errors.New("signature input is not an inner list")
+	}
+	var b strings.Builder
+	for _, c := range components {
+		if _, ok := c.value.(string); !ok {
+			return nil, errors.New("component identifiers must be strings")
+		}
+		v, err := sigComponent(r, c)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(serializeSFItem(c) + ": " + v + "\n")
+	}
+	b.WriteString(`"@signature-params": ` + serializeSFItem(input))
+	return []byte(b.String()), nil
+}
+
+// Verifies the signature labeled label, and that it covers every
+// component in required.
+func verifySignature(r *request, label string, input sfItem, sig []byte, resolve sigKeyResolver, required []string, maxAge time.Duration, now time.Time) error {
+	covered := make(map[string]bool)
+	components, _ := input.value.([]sfItem)
+	for _, c := range components {
+		if name, ok := c.value.(string); ok && len(c.params) == 0 {
+			covered[name] = true
+		}
+	}
+	for _, name := range required {
+		if !covered[name] {
+			return fmt.Errorf("signature %s doesn't cover %s", label, name)
+		}
+	}
+	// Allow a minute of clock skew between signer and server.
+	if created, ok := input.param("created").(int64); ok {
+		t := time.Unix(created, 0)
+		if t.After(now.Add(time.Minute)) {
+			return fmt.Errorf("signature %s was created in the future", label)
+		}
+		if maxAge > 0 && now.Sub(t) > maxAge {
+			return fmt.Errorf("signature %s is too old", label)
+		}
+	} else if maxAge > 0 {
+		return fmt.Errorf("signature %s has no created time", label)
+	}
+	if expires, ok := input.param("expires").(int64); ok && now.Unix() >= expires {
+		return fmt.Errorf("signature %s has expired", label)
+	}
+	keyID, _ := input.param("keyid").(string)
+	key, err := resolve(keyID)
+	if err != nil {
+		return err
+	}
+	if alg, ok := input.param("alg").(string); ok && alg != key.alg {
+		return fmt.Errorf("signature %s uses %s but key %q is for %s", label, alg, keyID, key.alg)
+	}
+	base, err := sigBase(r, input)
+	if err != nil {
+		return err
+	}
+	if !key.verify(base, sig) {
+		return fmt.Errorf("signature %s does not match", label)
+	}
+	return nil
+}
+
+// Rejects requests without a valid signature covering every component in
+// required, such as "@method" or "content-digest". The signing keyid
+// becomes the request's principal. Signatures created more
+// than maxAge ago are refused unless maxAge is 0. The request passes if any
+// one of its signatures verifies.
+func requireSignature(resolve sigKeyResolver, required []string, maxAge time.Duration) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			err := checkSignatures(r, resolve, required, maxAge, clock.Now())
+			if err != nil {
+				return writeStatus(w, 401, err.Error()+"\n")
+			}
+			return next(w, r)
+		}
+	}
+}
+
+func checkSignatures(r *request, resolve sigKeyResolver, required []string, maxAge time.Duration, now time.Time) error {
+	inputHeader := strings.Join(r.header["Signature-Input"], ", ")
+	sigHeader := strings.Join(r.header["Signature"], ", ")
+	if inputHeader == "" || sigHeader == "" {
+		return errors.New("request is not signed")
+	}
+	inputs, err := parseSFDictionary(inputHeader)
+	if err != nil {
+		return fmt.Errorf("Signature-Input: %v", err)
+	}
+	sigs, err := parseSFDictionary(sigHeader)
+	if err != nil {
+		return fmt.Errorf("Signature: %v", err)
+	}
+	err = errors.New("no signature matches a Signature-Input")
+	for _, m := range inputs {
+		s, ok := sigs.get(m.key)
+		if !ok {
+			continue
+		}
+		sig, ok := s.value.([]byte)
+		if !ok {
+			return fmt.Errorf("signature %s is not a byte sequence", m.key)
+		}
+		if err = verifySignature(r, m.key, m.item, sig, resolve, required, maxAge, now); err == nil {
+			r.principal, _ = m.item.param("keyid").(string)
+			return nil
+		}
+	}
+	return err
+}
+
+// A minimal parser and serializer for the structured field values (RFC
+// 8941) used by the signature headers. Decimals aren't supported.
+
+type sfToken string
+
+type sfParam struct {
+	key   string
+	value interface{}
+}
+
+// value is a string, sfToken, int64, bool, []byte or, for an inner list,
+// []sfItem.
+type sfItem struct {
+	value  interface{}
+	params []sfParam
+}
+
+func (it sfItem) param(key string) interface{} {
+	for _, p := range it.params {
+		if p.key == key {
+			return p.value
+		}
+	}
+	return nil
+}
+
+type sfMember struct {
+	key  string
+	item sfItem
+}
+
+type sfDictionary []sfMember
+
+func (d sfDictionary) get(key string) (sfItem, bool) {
+	for _, m := range d {
+		if m.key == key {
+			return m.item, true
+		}
+	}
+	return sfItem{}, false
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) peek() byte {
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+func (p *sfParser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *sfParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.i, fmt.Sprintf(format, args...))
+}
+
+func parseSFDictionary(s string) (sfDictionary, error) {
+	p := &sfParser{s: s}
+	var d sfDictionary
+	p.skip(" ")
+	for p.i < len(p.s) {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var it sfItem
+		if p.peek() == '=' {
+			p.i++
+			if it, err = p.itemOrInnerList(); err != nil {
+				return nil, err
+			}
+		} else {
+			it.value = true
+			if it.params, err = p.params(); err != nil {
+				return nil, err
+			}
+		}
+		// A repeated key replaces the earlier value.
+		replaced := false
+		for i := range d {
+			if d[i].key == key {
+				d[i].item, replaced = it, true
+			}
+		}
+		if !replaced {
+			d = append(d, sfMember{key, it})
+		}
+		p.skip(" \t")
+		if p.i == len(p.s) {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, p.errorf("expected ','")
+		}
+		p.i++
+		p.skip(" \t")
+		if p.i == len(p.s) {
+			return nil, p.errorf("trailing ','")
+		}
+	}
+	return d, nil
+}
+
+func (p *sfParser) key() (string, error) {
+	start := p.i
+	if c := p.peek(); !(c >= 'a' && c <= 'z' || c == '*') {
+		return "", p.errorf("expected key")
+	}
+	for c := p.peek(); c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("_-.*", c) >= 0; c = p.peek() {
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *sfParser) itemOrInnerList() (sfItem, error) {
+	if p.peek() != '(' {
+		return p.item()
+	}
+	p.i++
+	var list []sfItem
+	for {
+		p.skip(" ")
+		if p.peek() == ')' {
+			p.i++
+			params, err := p.params()
+			return sfItem{value: list, params: params}, err
+		}
+		it, err := p.item()
+		if err != nil {
+			return sfItem{}, err
+		}
+		list = append(list, it)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return sfItem{}, p.errorf("expected ' ' or ')' in inner list")
+		}
+	}
+}
+
+func (p *sfParser) item() (sfItem, error) {
+	v, err := p.bareItem()
+	if err != nil {
+		return sfItem{}, err
+	}
+	params, err := p.params()
+	return sfItem{value: v, params: params}, err
+}
+
+func (p *sfParser) params() ([]sfParam, error) {
+	var params []sfParam
+	for p.peek() == ';' {
+		p.i++
+		p.skip(" ")
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{} = true
+		if p.peek() == '=' {
+			p.i++
+			if v, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		}
+		params = append(params, sfParam{key, v})
+	}
+	return params, nil
+}
+
+func (p *sfParser) bareItem() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.i
+		p.i++
+		for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+			p.i++
+		}
+		if p.peek() == '.' {
+			return nil, p.errorf("decimals are not supported")
+		}
+		return strconv.ParseInt(p.s[start:p.i], 10, 64)
+	case c == '"':
+		var b strings.Builder
+		for p.i++; p.i < len(p.s); p.i++ {
+			switch c := p.s[p.i]; c {
+			case '\\':
+				p.i++
+				if p.i == len(p.s) || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+					return nil, p.errorf("bad escape in string")
+				}
+				b.WriteByte(p.s[p.i])
+			case '"':
+				p.i++
+				return b.String(), nil
+			default:
+				if c < 0x20 || c > 0x7e {
+					return nil, p.errorf("bad character in string")
+				}
+				b.WriteByte(c)
+			}
+		}
+		return nil, p.errorf("unterminated string")
+	case c == ':':
+		end := strings.IndexByte(p.s[p.i+1:], ':')
+		if end < 0 {
+			return nil, p.errorf("unterminated byte sequence")
+		}
+		b, err := base64.StdEncoding.DecodeString(p.s[p.i+1 : p.i+1+end])
+		if err != nil {
+			return nil, p.errorf("bad byte sequence")
+		}
+		p.i += end + 2
+		return b, nil
+	case c == '?':
+		if p.i+1 < len(p.s) && (p.s[p.i+1] == '0' || p.s[p.i+1] == '1') {
+			p.i += 2
+			return p.s[p.i-1] == '1', nil
+		}
+		return nil, p.errorf("bad boolean")
+	case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '*':
+		start := p.i
+		for p.i < len(p.s) && strings.IndexByte(" ,;()=\"", p.s[p.i]) < 0 {
+			p.i++
+		}
+		return sfToken(p.s[start:p.i]), nil
+	}
+	return nil, p.errorf("expected an item")
+}
+
+func serializeSFBare(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	case sfToken:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		if v {
+			return "?1"
+		}
+		return "?0"
+	case []byte:
+		return ":" + base64.StdEncoding.EncodeToString(v) + ":"
+	case []sfItem:
+		parts := make([]string, len(v))
+		for i, it := range v {
+			parts[i] = serializeSFItem(it)
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	return ""
+}
+
+func serializeSFItem(it sfItem) string {
+	s := serializeSFBare(it.value)
+	for _, p := range it.params {
+		s += ";" + p.key
+		if b, ok := p.value.(bool); !ok || !b {
+			s += "=" + serializeSFBare(p.value)
+		}
+	}
+	return s
+}
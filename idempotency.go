@@ -0,0 +1,122 @@
+package main
+
+// Idempotency-Key handling: the first response to a POST or PATCH carrying
+// an Idempotency-Key header is recorded and replayed verbatim to retries
+// with the same key, so a client retrying after a lost response doesn't
+// repeat the side effects.
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type idempotentEntry struct {
+	key      string
+	bodyHash [sha256.Size]byte
+	response *recordedResponse // nil while the first request is still running
+	expires  time.Time
+}
+
+type idempotencyCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	// Finished entries in the order they expire, which, with every entry
+	// kept for ttl, is the order they finished in. Ones since deleted from
+	// entries are skipped over.
+	expiring []*idempotentEntry
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotentEntry)}
+}
+
+// Forgets every finished response, for when memory runs short. Retries
+// after that run the request again.
+func (c *idempotencyCache) reclaim() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.response != nil {
+			delete(c.entries, k)
+		}
+	}
+	c.expiring = nil
+}
+
+// Drops the entries that have expired by now. c.mu must be held.
+func (c *idempotencyCache) expire(now time.Time) {
+	for len(c.expiring) > 0 && now.After(c.expiring[0].expires) {
+		e := c.expiring[0]
+		if c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+		c.expiring[0] = nil
+		c.expiring = c.expiring[1:]
+	}
+}
+
+// Keys are scoped to the client, and to the method and URI, so the same
+// key can't replay one client's response to another, or a response for a
+// different endpoint. A client is who it authenticated as, or else its IP.
+func idempotencyKey(r *request) string {
+	client := r.principal
+	if client != "" {
+		client = "principal " + client
+	} else if ip := r.remoteIP(); ip != nil {
+		client = "ip " + ip.String()
+	}
+	return client + "\n" + r.method + " " + r.uri + "\n" + r.header.Get("Idempotency-Key")
+}
+
+func (c *idempotencyCache) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if r.method != "POST" && r.method != "PATCH" || r.header.Get("Idempotency-Key") == "" {
+			return next(w, r)
+		}
+		key := idempotencyKey(r)
+		bodyHash := sha256.Sum256(r.body)
+		now := clock.Now()
+
+		c.mu.Lock()
+		c.expire(now)
+		if e, ok := c.entries[key]; ok {
+			c.mu.Unlock()
+			switch {
+			case e.bodyHash != bodyHash:
+				return writeStatus(w, 422, "Idempotency-Key was already used with a different body\n")
+			case e.response == nil:
+				return writeStatus(w, 409, "a request with this Idempotency-Key is in progress\n")
+			}
+			r.cacheStatus = "hit"
+			w.Header().Set("Idempotent-Replayed", "true")
+			return e.response.writeTo(w)
+		}
+		e := &idempotentEntry{key: key, bodyHash: bodyHash}
+		c.entries[key] = e
+		c.mu.Unlock()
+		r.cacheStatus = "miss"
+		// Let the client retry a request that failed outright, or
+		// panicked.
+		defer func() {
+			c.mu.Lock()
+			if e.response == nil && c.entries[key] == e {
+				delete(c.entries, key)
+			}
+			c.mu.Unlock()
+		}()
+
+		rec, err := recordResponse(next, r)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		e.response = rec
+		e.expires = clock.Now().Add(c.ttl)
+		c.expiring = append(c.expiring, e)
+		c.mu.Unlock()
+		return rec.writeTo(w)
+	}
+}
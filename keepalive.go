@@ -0,0 +1,140 @@
+package main
+
+// Persistent connections. HTTP/1.1 clients keep the connection open unless
+// they send Connection: close, and HTTP/1.0 clients only when they send
+// Connection: keep-alive. Handlers write their responses without worrying
+// about either; connWriter adds the Connection header to the response head
+// before it's written and decides whether another request may follow.
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reports whether the comma separated header value v contains token.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func wantsKeepAlive(r *request) bool {
+	conn := strings.Join(r.header["Connection"], ",")
+	if r.proto == "HTTP/1.1" {
+		return !hasToken(conn, "close")
+	}
+	return hasToken(conn, "keep-alive")
+}
+
+// Implemented by writers that decide how a response is framed on the
+// connection. frameHead is given the head before it's serialized, adds the
+// framing and connection headers to it and returns the version for the
+// status line; writeHead then sends the serialized head.
+type headFramer interface {
+	frameHead(status int, header textproto.MIMEHeader) string
+	writeHead(head []byte) error
+}
+
+// Writes a response to the connection, setting its Connection and
+// Keep-Alive headers.
+type connWriter struct {
+	conn io.Writer
+	req  *request
+	idle time.Duration
+
+	// Whether the connection can serve another request. Starts as the
+	// client's preference and is cleared if the response can't be
+	// delimited without closing.
+	keepAlive bool
+
+	headDone bool
+	bodyLen  int64 // Body length the head promised, -1 if unknown.
+	written  int64
+	chunked  bool // Framing the body as chunks since its length is unknown.
+	finished bool
+}
+
+func newConnWriter(conn io.Writer, r *request, idle time.Duration) *connWriter {
+	return &connWriter{conn: conn, req: r, idle: idle, keepAlive: idle > 0 && wantsKeepAlive(r), bodyLen: -1}
+}
+
+// Writes body bytes, after the head.
+func (c *connWriter) Write(b []byte) (int, error) {
+	if c.req.method == "HEAD" {
+		return len(b), nil // A handler that wrote a body anyway.
+	}
+	if c.chunked {
+		return writeChunk(c.conn, b)
+	}
+	n, err := c.conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// Sets the connection headers of a response with status and header, and
+// answers an HTTP/1.1 client in kind, so it doesn't fall back to one
+// request per connection.
+func (c *connWriter) frameHead(status int, header textproto.MIMEHeader) string {
+	// A handler may still ask to close the connection.
+	if hasToken(strings.Join(header["Connection"], ","), "close") {
+		c.keepAlive = false
+	}
+	delete(header, "Connection")
+	delete(header, "Keep-Alive")
+	if v := header.Get("Content-Length"); v != "" {
+		c.bodyLen, _ = strconv.ParseInt(v, 10, 64)
+	}
+	// With a Transfer-Encoding the handler frames the body itself.
+	framed := len(header["Transfer-Encoding"]) > 0
+	if c.req.method == "HEAD" || !bodyAllowed(status) {
+		c.bodyLen = 0
+	}
+	if c.bodyLen < 0 && !framed && c.keepAlive && c.req.proto == "HTTP/1.1" {
+		c.chunked = true
+		header.Set("Transfer-Encoding", "chunked")
+	} else if c.bodyLen < 0 {
+		// Without a length the end of the body is the end of the connection.
+		c.keepAlive = false
+	}
+	if c.keepAlive {
+		header.Set("Connection", "keep-alive")
+		header.Set("Keep-Alive", fmt.Sprintf("timeout=%d", int(c.idle/time.Second)))
+	} else {
+		header.Set("Connection", "close")
+	}
+	if c.req.proto == "HTTP/1.1" {
+		return "HTTP/1.1"
+	}
+	return "HTTP/1.0"
+}
+
+func (c *connWriter) writeHead(head []byte) error {
+	c.headDone = true
+	_, err := c.conn.Write(head)
+	return err
+}
+
+// Ends the response once the handler has returned.
+func (c *connWriter) finish() error {
+	if c.chunked && !c.finished {
+		c.finished = true
+		return writeLastChunk(c.conn)
+	}
+	return nil
+}
+
+// Reports whether the response was written completely and the connection
+// can be read for another request.
+func (c *connWriter) reusable() bool {
+	if c.chunked {
+		return c.keepAlive && c.finished
+	}
+	return c.keepAlive && c.headDone && c.written == c.bodyLen
+}
@@ -0,0 +1,167 @@
+package main
+
+// Demo key-value REST service mounted at /kv/.
+//
+//	GET    /kv/        lists live keys
+//	GET    /kv/{key}   returns the entry
+//	PUT    /kv/{key}   stores {"value": <any JSON>, "ttl": "30s"}
+//	DELETE /kv/{key}   removes the entry
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kvEntry struct {
+	value   json.RawMessage
+	expires time.Time // Zero means the entry never expires.
+}
+
+func (e kvEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// Expired entries are hidden from reads immediately and deleted by sweep.
+type kvStore struct {
+	mu      sync.RWMutex
+	entries map[string]kvEntry
+}
+
+func newKVStore() *kvStore {
+	return &kvStore{entries: make(map[string]kvEntry)}
+}
+
+func (s *kvStore) get(key string) (kvEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[key]
+	if !ok || e.expired(clock.Now()) {
+		return kvEntry{}, false
+	}
+	return e, true
+}
+
+func (s *kvStore) put(key string, e kvEntry) {
+	s.mu.Lock()
+	s.entries[key] = e
+	s.mu.Unlock()
+}
+
+// Reports whether a live entry was deleted.
+func (s *kvStore) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	delete(s.entries, key)
+	return ok && !e.expired(clock.Now())
+}
+
+func (s *kvStore) keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := clock.Now()
+	keys := make([]string, 0, len(s.entries))
+	for k, e := range s.entries {
+		if !e.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Deletes expired entries. Run as a scheduled task.
+func (s *kvStore) sweep() error {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, k)
+		}
+	}
+	return nil
+}
+
+type kvResponse struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+type kvPutRequest struct {
+	Value json.RawMessage `json:"value" doc:"Any JSON value"`
+	TTL   string          `json:"ttl,omitempty" doc:"Lifetime like 30s, forever if empty"`
+}
+
+// OpenAPI documentation for the routes served by kvHandler.
+func kvDocs(prefix string) routeOption {
+	key := []apiParam{{name: "key", in: "path"}}
+	entry := prefix + "{key}"
+	return withDoc(
+		apiOperation{method: "GET", path: prefix, summary: "List live keys",
+			response: map[string][]string{}},
+		apiOperation{method: "GET", path: entry, summary: "Get an entry",
+			params: key, response: kvResponse{}},
+		apiOperation{method: "PUT", path: entry, summary: "Store an entry",
+			params: key, requestBody: kvPutRequest{}, response: map[string]string{}},
+		apiOperation{method: "DELETE", path: entry, summary: "Delete an entry",
+			params: key, response: map[string]string{}},
+	)
+}
+
+func kvHandler(prefix string, s *kvStore) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		key := strings.TrimPrefix(r.uri, prefix)
+		if i := strings.IndexByte(key, '?'); i >= 0 {
+			key = key[:i]
+		}
+		if key == "" {
+			if r.method != "GET" {
+				return writeStatus(w, 405, "method not allowed\n", "Allow: GET")
+			}
+			return writeJSON(w, 200, map[string][]string{"keys": s.keys()})
+		}
+
+		switch r.method {
+		case "GET":
+			e, ok := s.get(key)
+			if !ok {
+				return writeJSON(w, 404, map[string]string{"error": "no such key"})
+			}
+			resp := kvResponse{Key: key, Value: e.value}
+			if !e.expires.IsZero() {
+				resp.ExpiresAt = &e.expires
+			}
+			return writeJSON(w, 200, resp)
+
+		case "PUT":
+			var put kvPutRequest
+			if err := json.Unmarshal(r.body, &put); err != nil || put.Value == nil {
+				return writeJSON(w, 400, map[string]string{"error": `body must be {"value": ..., "ttl": "30s"}`})
+			}
+			e := kvEntry{value: put.Value}
+			if put.TTL != "" {
+				ttl, err := time.ParseDuration(put.TTL)
+				if err != nil || ttl <= 0 {
+					return writeJSON(w, 400, map[string]string{"error": "invalid ttl: " + put.TTL})
+				}
+				e.expires = clock.Now().Add(ttl)
+			}
+			s.put(key, e)
+			return writeJSON(w, 200, map[string]string{"key": key})
+
+		case "DELETE":
+			if !s.delete(key) {
+				return writeJSON(w, 404, map[string]string{"error": "no such key"})
+			}
+			return writeJSON(w, 200, map[string]string{"key": key})
+
+		default:
+			return writeStatus(w, 405, "method not allowed\n", "Allow: GET, PUT, DELETE")
+		}
+	}
+}
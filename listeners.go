@@ -0,0 +1,406 @@
+package main
+
+// Listener reloads. With -listen_config, the address and TLS settings are
+// read from a file, and again whenever the process receives SIGHUP. A new
+// address gets a new socket and server, serving the same handlers, before
+// the old server drains its connections and closes; new TLS material is
+// swapped in for the next handshake without touching the socket.
+//
+// With -workers, each address gets that many sockets bound with
+// SO_REUSEPORT and a server for each, accept loop and all, and the kernel
+// spreads new connections across them.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The settings a reload can change.
+type listenConfig struct {
+	ip       net.IP
+	port     int
+	v6Only   bool
+	https    bool
+	certFile string
+	keyFile  string
+	// Comma separated names to make a self-signed certificate for, in
+	// place of certFile and keyFile.
+	selfSigned string
+	// Where -issue_cert's certificates are, served when none of the
+	// above are set.
+	certDir string
+	// Whether to ask HTTPS clients for a certificate.
+	clientCerts bool
+	// The TLS policy: a preset, and the version, and comma separated cipher
+	// suites, curves and ALPN protocols, replacing its own.
+	policy, minVersion, ciphers, curves, alpn string
+	// Listens on vsock instead of TCP when vsockPort isn't 0.
+	vsockCID  uint32
+	vsockPort uint32
+	// Listens on a Unix socket at unixPath instead when it's set, @ first
+	// for the abstract namespace, or else on the inherited fd if it's 0 or
+	// more.
+	unixPath string
+	fd       int
+}
+
+func (c listenConfig) String() string {
+	scheme := "http"
+	if c.https {
+		scheme = "https"
+	}
+	switch {
+	case c.fd >= 0:
+		return scheme + "://fd:" + strconv.Itoa(c.fd)
+	case c.unixPath != "":
+		return scheme + "://unix:" + c.unixPath
+	case c.vsockPort != 0:
+		return scheme + "://vsock:" + (&vsockAddr{cid: c.vsockCID, port: c.vsockPort}).String()
+	}
+	return scheme + "://" + net.JoinHostPort(c.ip.String(), strconv.Itoa(c.port))
+}
+
+// Where the certificate for https comes from, for logging.
+func (c listenConfig) certSource() string {
+	if c.selfSigned != "" {
+		return "self-signed for " + c.selfSigned
+	}
+	if c.certFile == "" && c.keyFile == "" {
+		return c.certDir
+	}
+	return c.certFile
+}
+
+func (c listenConfig) sameSocket(o listenConfig) bool {
+	if c.fd >= 0 || o.fd >= 0 || c.unixPath != "" || o.unixPath != "" {
+		return c.fd == o.fd && c.unixPath == o.unixPath
+	}
+	if c.vsockPort != 0 || o.vsockPort != 0 {
+		return c.vsockCID == o.vsockCID && c.vsockPort == o.vsockPort
+	}
+	return c.ip.Equal(o.ip) && c.port == o.port && c.v6Only == o.v6Only
+}
+
+// Reads lines like "port 8443" from file, for any of ip_addr, port,
+// ipv6_only, https, tls_cert, tls_key, tls_self_signed, cert_dir,
+// tls_client_certs, tls_policy, tls_min_version, tls_ciphers, tls_curves,
+// tls_alpn, vsock_cid, vsock_port and unix_socket, over the settings in
+// base.
+func parseListenConfig(file string, base listenConfig) (listenConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return base, err
+	}
+	defer f.Close()
+	c := base
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return base, fmt.Errorf("%s line %d: want 'setting value', got %q", file, n, line)
+		}
+		v := fields[1]
+		// Naming an address switches to its kind of socket.
+		switch fields[0] {
+		case "ip_addr", "port":
+			c.fd, c.unixPath, c.vsockPort = -1, "", 0
+		case "unix_socket":
+			c.fd, c.vsockPort = -1, 0
+		case "vsock_port":
+			c.fd, c.unixPath = -1, ""
+		}
+		switch fields[0] {
+		case "ip_addr":
+			if c.ip = net.ParseIP(v); c.ip == nil {
+				err = fmt.Errorf("invalid IP address %q", v)
+			}
+		case "port":
+			c.port, err = strconv.Atoi(v)
+		case "ipv6_only":
+			c.v6Only, err = strconv.ParseBool(v)
+		case "https":
+			c.https, err = strconv.ParseBool(v)
+		case "tls_cert":
+			c.certFile = v
+		case "tls_key":
+			c.keyFile = v
+		case "tls_self_signed":
+			c.selfSigned = v
+		case "cert_dir":
+			c.certDir = v
+		case "tls_client_certs":
+			c.clientCerts, err = strconv.ParseBool(v)
+		case "tls_policy":
+			c.policy = v
+		case "tls_min_version":
+			c.minVersion = v
+		case "tls_ciphers":
+			c.ciphers = v
+		case "tls_curves":
+			c.curves = v
+		case "tls_alpn":
+			c.alpn = v
+		case "unix_socket":
+			c.unixPath = v
+		case "vsock_cid", "vsock_port":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			if fields[0] == "vsock_cid" {
+				c.vsockCID = uint32(n)
+			} else {
+				c.vsockPort = uint32(n)
+			}
+		default:
+			err = fmt.Errorf("unknown setting %q", fields[0])
+		}
+		if err != nil {
+			return base, fmt.Errorf("%s line %d: %v", file, n, err)
+		}
+	}
+	return c, s.Err()
+}
+
+// Runs a server for the current listener settings, replacing it when they
+// change.
+type listeners struct {
+	// Makes a server for a bound socket, serving the same handlers each
+	// time.
+	newServer func(socket *netSocket) (*server, error)
+	file      string        // -listen_config, if any.
+	drain     time.Duration // How long a replaced server has to drain.
+	tasks     *scheduler    // Attached to the first current server.
+	certs     *certStore
+	workers   int // Servers for each TCP address, 1 or more.
+
+	mu      sync.Mutex
+	cfg     listenConfig
+	current []*server        // A server for each worker.
+	old     map[*server]bool // Replaced servers still draining.
+	closing bool
+	failed  chan error // Gets an error from any server's Serve.
+}
+
+// Binds a socket for cfg and starts serving on it.
+func (l *listeners) start(cfg listenConfig) error {
+	if cfg.https {
+		if err := l.certs.load(cfg); err != nil {
+			return err
+		}
+	}
+	srvs, err := l.listen(cfg)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.cfg, l.current = cfg, srvs
+	l.old = make(map[*server]bool)
+	l.failed = make(chan error, 1)
+	l.mu.Unlock()
+	srvs[0].tasks = l.tasks
+	for _, srv := range srvs {
+		go l.serve(srv)
+	}
+	return nil
+}
+
+// Makes a server for each worker, closing them all if one fails.
+func (l *listeners) listen(cfg listenConfig) ([]*server, error) {
+	if l.workers <= 1 {
+		srv, err := l.listenOne(cfg, false)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("addr: %s", cfg)
+		return []*server{srv}, nil
+	}
+	if cfg.fd >= 0 || cfg.unixPath != "" || cfg.vsockPort != 0 {
+		return nil, fmt.Errorf("-workers needs a TCP address, not %s", cfg)
+	}
+	var srvs []*server
+	for i := 0; i < l.workers; i++ {
+		srv, err := l.listenOne(cfg, true)
+		if err != nil {
+			for _, srv := range srvs {
+				srv.listener.Close()
+			}
+			return nil, err
+		}
+		// The rest bind whatever port the system picked for the first.
+		if cfg.port == 0 {
+			if addr, ok := srv.listener.LocalAddr().(*net.TCPAddr); ok {
+				cfg.port = addr.Port
+			}
+		}
+		srvs = append(srvs, srv)
+	}
+	log.Printf("addr: %s, %d workers", cfg, l.workers)
+	return srvs, nil
+}
+
+func (l *listeners) listenOne(cfg listenConfig, reusePort bool) (*server, error) {
+	var socket *netSocket
+	var err error
+	switch {
+	case cfg.fd >= 0:
+		socket, err = inheritSocket(cfg.fd)
+	case cfg.unixPath != "":
+		socket, err = newUnixSocket(cfg.unixPath)
+	case cfg.vsockPort != 0:
+		socket, err = newVsockSocket(cfg.vsockCID, cfg.vsockPort)
+	default:
+		socket, err = newNetSocket(cfg.ip, cfg.port, cfg.v6Only, reusePort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	srv, err := l.newServer(socket)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	if socket.vsock && srv.loop != nil {
+		socket.Close()
+		return nil, fmt.Errorf("vsock doesn't work with -event_loop")
+	}
+	if cfg.https {
+		if srv.loop != nil {
+			socket.Close()
+			return nil, fmt.Errorf("https doesn't work with -event_loop")
+		}
+		srv.tlsConfig = newTLSConfig(l.certs)
+	}
+	return srv, nil
+}
+
+func (l *listeners) serve(srv *server) {
+	if err := srv.Serve(); err != errServerClosed {
+		select {
+		case l.failed <- err:
+		default:
+		}
+	}
+}
+
+// Rereads the settings file whenever the process receives SIGHUP. Settings
+// that fail to parse, or an address that can't be bound, leave the current
+// listener serving.
+func (l *listeners) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := l.reload(); err != nil {
+			log.Printf("Keeping previous listener: %v", err)
+		}
+	}
+}
+
+func (l *listeners) reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return nil
+	}
+	cfg, err := parseListenConfig(l.file, l.cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.https {
+		// Rewritten files count as a change as much as new names do.
+		if err := l.certs.load(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.sameSocket(l.cfg) {
+		if cfg.https != l.cfg.https {
+			return fmt.Errorf("switching https on %s needs a restart", l.cfg)
+		}
+		if cfg.https {
+			log.Printf("Reloaded TLS certificate from %s", cfg.certSource())
+		}
+		l.cfg = cfg
+		return nil
+	}
+	srvs, err := l.listen(cfg)
+	if err != nil {
+		return err
+	}
+	old := l.current
+	srvs[0].tasks, old[0].tasks = old[0].tasks, nil
+	l.cfg, l.current = cfg, srvs
+	for _, srv := range srvs {
+		go l.serve(srv)
+	}
+	for _, srv := range old {
+		l.old[srv] = true
+		go l.drainOld(srv)
+	}
+	return nil
+}
+
+func (l *listeners) drainOld(srv *server) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.drain)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Print("draining old listener: ", err)
+	}
+	l.mu.Lock()
+	delete(l.old, srv)
+	l.mu.Unlock()
+	log.Print("Old listener closed")
+}
+
+// Counts the open connections of the current server and any draining.
+func (l *listeners) connCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, srv := range l.current {
+		n += srv.connCount()
+	}
+	for srv := range l.old {
+		n += srv.connCount()
+	}
+	return n
+}
+
+func (l *listeners) isClosing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closing
+}
+
+// Shuts down every server, the same way server.Shutdown does one.
+func (l *listeners) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.closing = true
+	servers := append([]*server(nil), l.current...)
+	for srv := range l.old {
+		servers = append(servers, srv)
+	}
+	l.mu.Unlock()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *server) { errs <- srv.Shutdown(ctx) }(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package main
+
+// A local certificate authority for trusted HTTPS in development, in the
+// style of mkcert. The first use creates a CA in the certificate directory;
+// later uses reuse it to issue leaf certificates for the requested names.
+// Nothing is installed: add ca.pem to the trust store by hand once, and
+// every certificate issued from it is trusted.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+)
+
+type localCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Writes the certificate and key as PEM files. Keys are only readable by
+// the owner.
+func writeCertFiles(certFile, keyFile string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
+
+func readPEM(file, blockType string) ([]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != blockType {
+		return nil, errors.New(file + ": no " + blockType + " PEM block")
+	}
+	return block.Bytes, nil
+}
+
+// Loads the CA from dir, creating dir and the CA if it doesn't exist yet.
+func loadOrCreateCA(dir string) (*localCA, error) {
+	certFile, keyFile := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+	if _, err := os.Stat(certFile); err == nil {
+		certDER, err := readPEM(certFile, "CERTIFICATE")
+		if err != nil {
+			return nil, err
+		}
+		keyDER, err := readPEM(keyFile, "PRIVATE KEY")
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKCS8PrivateKey(keyDER)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New(keyFile + ": key can't sign")
+		}
+		return &localCA{cert: cert, key: signer}, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"scratch-http-server development CA"}, CommonName: "scratch-http-server CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCertFiles(certFile, keyFile, der, key); err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &localCA{cert: cert, key: key}, nil
+}
+
+// A template for a server certificate for names, which may be host names,
+// wildcards or IP addresses.
+func leafTemplate(names []string) (*x509.Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names to issue a certificate for")
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"scratch-http-server development certificate"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// Browsers reject leaf certificates valid for longer than 825 days.
+		NotAfter:    time.Now().AddDate(2, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	return tmpl, nil
+}
+
+// Issues a certificate for names into dir as <first name>.pem and
+// <first name>-key.pem, and returns the certificate's path.
+func (ca *localCA) issue(dir string, names []string) (string, error) {
+	tmpl, err := leafTemplate(names)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return "", err
+	}
+	base := strings.Replace(names[0], "*", "_wildcard", -1)
+	certFile := filepath.Join(dir, base+".pem")
+	if err := writeCertFiles(certFile, filepath.Join(dir, base+"-key.pem"), der, key); err != nil {
+		return "", err
+	}
+	return certFile, nil
+}
+
+// Loads every certificate issue wrote into dir.
+func loadIssued(dir string) ([]*tls.Certificate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var certs []*tls.Certificate
+	for _, keyFile := range files {
+		if filepath.Base(keyFile) == caKeyFile {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(strings.TrimSuffix(keyFile, "-key.pem")+".pem", keyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, &cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates in " + dir + ", issue one with -issue_cert or set -tls_cert and -tls_key")
+	}
+	return certs, nil
+}
+
+// Makes a certificate for names signed with its own key, kept only in
+// memory: nothing trusts it, but HTTPS works with no files to set up.
+func selfSignedCert(names []string) (*tls.Certificate, error) {
+	tmpl, err := leafTemplate(names)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
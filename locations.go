@@ -0,0 +1,194 @@
+package main
+
+// File server locations loaded from a file, for deployments that would
+// otherwise need nginx in front just to map a few prefixes onto
+// directories.
+//
+// Each line of the file has the form:
+//
+//	prefix directive args...
+//
+// Blank lines and lines starting with # are ignored, and lines sharing a
+// prefix make up one location. The directives are:
+//
+//	root dir                    serve the location's paths from dir
+//	alias dir                   the same, less the prefix
+//	try_files file... last      serve the first file that exists, else last
+//	dotfiles on|off             whether to serve names starting with a dot
+//	symlinks none|beneath|any   which symlinks to follow
+//
+// With root the whole request path is looked up under dir, so /app/a.css
+// in a location /app/ with root /srv is /srv/app/a.css. With alias the
+// prefix is replaced by dir, making it /srv/a.css, so one tree can be
+// served under several prefixes, or a prefix mapped onto any directory,
+// without its path having to match. Each try_files entry is a path in
+// which $uri stands for the request path; one ending in a slash only
+// matches a directory. The last entry is a fallback that is served in the
+// request's place whether or not it exists, or =code to answer with that
+// status, as with "try_files $uri $uri/ /index.html" for a single-page app
+// or "try_files $uri =404". Locations without dotfiles or symlinks get the
+// policy of -static_dir.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type location struct {
+	prefix   string
+	root     string
+	alias    bool // The prefix is stripped before looking in root.
+	tryFiles []string
+	policy   filePolicy
+}
+
+func parseLocations(rd io.Reader, policy filePolicy) ([]*location, error) {
+	var locs []*location
+	byPrefix := map[string]*location{}
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want 'prefix directive args...', got %q", n, line)
+		}
+		prefix, args := fields[0], fields[2:]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("line %d: prefix %q doesn't start with /", n, prefix)
+		}
+		l := byPrefix[prefix]
+		if l == nil {
+			l = &location{prefix: prefix, policy: policy}
+			byPrefix[prefix] = l
+			locs = append(locs, l)
+		}
+		switch fields[1] {
+		case "root", "alias":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("line %d: want '%s dir'", n, fields[1])
+			}
+			if l.root != "" {
+				return nil, fmt.Errorf("line %d: location %s already has a root or alias", n, prefix)
+			}
+			l.root, l.alias = args[0], fields[1] == "alias"
+		case "try_files":
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: want at least one file and a fallback", n)
+			}
+			last := args[len(args)-1]
+			if strings.HasPrefix(last, "=") {
+				if code, err := strconv.Atoi(last[1:]); err != nil || statusText[code] == "" {
+					return nil, fmt.Errorf("line %d: unsupported status %q", n, last)
+				}
+			}
+			l.tryFiles = args
+		case "dotfiles":
+			if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+				return nil, fmt.Errorf("line %d: want 'dotfiles on' or 'dotfiles off'", n)
+			}
+			l.policy.dotfiles = args[0] == "on"
+		case "symlinks":
+			if len(args) != 1 || !symlinkPolicies[args[0]] {
+				return nil, fmt.Errorf("line %d: want 'symlinks none', 'symlinks beneath' or 'symlinks any'", n)
+			}
+			l.policy.symlinks = args[0]
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n, fields[1])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for _, l := range locs {
+		if l.root == "" {
+			return nil, fmt.Errorf("location %s has no root or alias", l.prefix)
+		}
+	}
+	return locs, nil
+}
+
+func loadLocations(file string, policy filePolicy) ([]*location, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	locs, err := parseLocations(f, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return locs, nil
+}
+
+func (l *location) handler() handlerFunc {
+	files := fileServer(l.root, l.policy)
+	if l.alias {
+		files = stripPrefix(l.prefix)(files)
+	}
+	if len(l.tryFiles) == 0 {
+		return files
+	}
+	return func(w responseWriter, r *request) error {
+		last := len(l.tryFiles) - 1
+		for _, f := range l.tryFiles[:last] {
+			if p := strings.Replace(f, "$uri", r.path, -1); l.exists(p) {
+				return serveAs(files, w, r, p)
+			}
+		}
+		fallback := l.tryFiles[last]
+		if strings.HasPrefix(fallback, "=") {
+			code, _ := strconv.Atoi(fallback[1:])
+			if code == 404 {
+				return notFound(w, r)
+			}
+			return writeStatus(w, code, statusText[code]+"\n")
+		}
+		return serveAs(files, w, r, strings.Replace(fallback, "$uri", r.path, -1))
+	}
+}
+
+// Reports whether p names something fileServer would serve: a directory if
+// p ends in a slash and a regular file otherwise.
+func (l *location) exists(p string) bool {
+	if l.alias {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, l.prefix), "/")
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	if l.policy.hides(p) {
+		return false
+	}
+	f, err := l.policy.open(l.root, path.Clean("/"+p))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(p, "/") {
+		return fi.IsDir()
+	}
+	return fi.Mode().IsRegular()
+}
+
+// Runs files as if r had asked for p, keeping its query.
+func serveAs(files handlerFunc, w responseWriter, r *request, p string) error {
+	uri := r.uri
+	r.setURI((&url.URL{Path: p, RawQuery: r.rawQuery}).RequestURI())
+	defer r.setURI(uri)
+	return files(w, r)
+}
@@ -0,0 +1,306 @@
+package main
+
+// Resized images. GET /media/{path}?w=200&h=100 serves the image at path,
+// scaled down to fit within the requested box while keeping its aspect
+// ratio. An image that already fits is served as it is. Generated variants
+// are cached on disk, keyed by the source's modification time and the
+// parameters, which also form the ETag, with the least recently used
+// dropped once the cache is over its size.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest width or height a variant may be requested at.
+const maxMediaDimension = 4096
+
+// Most pixels a source image may have to be resized, checked before it's
+// decoded: a small file can claim to be huge, and decoding allocates for
+// every pixel it claims.
+const maxMediaSourcePixels = 50 << 20
+
+type mediaHandler struct {
+	prefix string
+	root   string
+	cache  *mediaCache
+}
+
+// Variants on disk, kept to max bytes by removing the least recently used.
+type mediaCache struct {
+	dir string
+	max int64
+
+	mu   sync.Mutex
+	size int64 // Bytes in dir, -1 until counted.
+}
+
+func newMediaCache(dir string, max int64) *mediaCache {
+	return &mediaCache{dir: dir, max: max, size: -1}
+}
+
+// Returns the variant named name, marking it used.
+func (c *mediaCache) get(name string) ([]byte, bool) {
+	file := filepath.Join(c.dir, name)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return b, true
+}
+
+func (c *mediaCache) put(name string, b []byte) {
+	// Write then rename so a concurrent reader never sees a partial file.
+	// Each writer has a file of its own, so two making the same variant at
+	// once don't write over each other; the last rename wins.
+	f, err := ioutil.TempFile(c.dir, name+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size >= 0 {
+		c.size += int64(len(b))
+	}
+	if c.size < 0 || c.size > c.max {
+		c.prune()
+	}
+}
+
+// Counts what's in the directory, removing the least recently used variants
+// while it's over max. c.mu must be held.
+func (c *mediaCache) prune() {
+	fis, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	c.size = 0
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			c.size += fi.Size()
+		}
+	}
+	for _, fi := range fis {
+		if c.size <= c.max {
+			break
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+		if os.Remove(filepath.Join(c.dir, fi.Name())) == nil {
+			c.size -= fi.Size()
+		}
+	}
+}
+
+// Parses a dimension parameter, 0 if absent.
+func parseDimension(q url.Values, name string) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > maxMediaDimension {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, maxMediaDimension)
+	}
+	return n, nil
+}
+
+// Fits a srcW by srcH image inside w by h, where 0 means unconstrained.
+// Images are never scaled up.
+func fitWithin(srcW, srcH, w, h int) (int, int) {
+	scale := 1.0
+	if w > 0 && float64(w)/float64(srcW) < scale {
+		scale = float64(w) / float64(srcW)
+	}
+	if h > 0 && float64(h)/float64(srcH) < scale {
+		scale = float64(h) / float64(srcH)
+	}
+	dw, dh := int(float64(srcW)*scale+0.5), int(float64(srcH)*scale+0.5)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return dw, dh
+}
+
+// Scales src to w by h by averaging the source pixels each destination pixel
+// covers, which avoids the aliasing of nearest-neighbor sampling when
+// shrinking.
+func resizeImage(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+func (m mediaHandler) serve(w responseWriter, r *request) error {
+	if r.method != "GET" && r.method != "HEAD" {
+		return writeStatus(w, 405, "method not allowed\n", "Allow: GET, HEAD")
+	}
+	q := r.queryParams()
+	width, err := parseDimension(q, "w")
+	if err != nil {
+		return writeStatus(w, 400, err.Error()+"\n")
+	}
+	height, err := parseDimension(q, "h")
+	if err != nil {
+		return writeStatus(w, 400, err.Error()+"\n")
+	}
+
+	rel := strings.TrimPrefix(r.path, m.prefix)
+	f, err := openBeneath(m.root, rel, false)
+	if err != nil {
+		return notFound(w, r)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return notFound(w, r)
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%d\n%d\n%d",
+		rel, fi.ModTime().UnixNano(), fi.Size(), width, height)))
+	key := hex.EncodeToString(sum[:])[:24]
+	etag := `"` + key + `"`
+	if notModified(w, r, etag, fi.ModTime()) {
+		return nil
+	}
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return writeStatus(w, 415, "not a supported image: "+err.Error()+"\n")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dw, dh := fitWithin(cfg.Width, cfg.Height, width, height)
+	if dw == cfg.Width && dh == cfg.Height {
+		// Nothing to resize, so the original goes out untouched, GIF
+		// animation and all.
+		h := w.Header()
+		h.Set("Content-Type", "image/"+format)
+		h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		h.Set("ETag", etag)
+		h.Set("Last-Modified", fi.ModTime().UTC().Format(httpDate))
+		h.Set("Cache-Control", "public, max-age=86400")
+		if r.method == "HEAD" {
+			return nil
+		}
+		_, err = w.sendFile(f, fi.Size())
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxMediaSourcePixels {
+		return writeStatus(w, 415, fmt.Sprintf("image is %dx%d, too large to resize\n", cfg.Width, cfg.Height))
+	}
+
+	body, contentType, hit, err := m.variant(f, key, dw, dh)
+	if err != nil {
+		return writeStatus(w, 415, "not a supported image: "+err.Error()+"\n")
+	}
+	r.cacheStatus = "miss"
+	if hit {
+		r.cacheStatus = "hit"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", fi.ModTime().UTC().Format(httpDate))
+	h.Set("Cache-Control", "public, max-age=86400")
+	if r.method == "HEAD" {
+		return nil
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// Returns the encoded variant for key, resized to width by height,
+// generating and caching it if needed, and whether it came from the cache.
+// JPEG sources stay JPEG; everything else is encoded as PNG.
+func (m mediaHandler) variant(src io.Reader, key string, width, height int) ([]byte, string, bool, error) {
+	for _, v := range []struct{ ext, contentType string }{
+		{".jpg", "image/jpeg"}, {".png", "image/png"},
+	} {
+		if b, ok := m.cache.get(key + v.ext); ok {
+			return b, v.contentType, true, nil
+		}
+	}
+	img, format, err := image.Decode(src)
+	if err != nil {
+		return nil, "", false, err
+	}
+	img = resizeImage(img, width, height)
+
+	var buf bytes.Buffer
+	ext, contentType := ".png", "image/png"
+	if format == "jpeg" {
+		ext, contentType = ".jpg", "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	m.cache.put(key+ext, buf.Bytes())
+	return buf.Bytes(), contentType, false, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+// The memory watchdog. With -memory_limit_mb it checks the process's
+// resident memory every second against the limit, well before the kernel's
+// OOM killer would step in. Past 80% it collects garbage, returns what it
+// can to the system and has the caches drop what they hold; past 90% it
+// refuses all but critical requests with 503, closing their connections,
+// until usage is back under 80%; past 95% it writes a heap profile, once
+// per time over, so there's something to look at afterwards.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memWatchdog struct {
+	limit      int64 // Bytes.
+	priorities *prioritizer
+	// Called to have caches drop what they can.
+	reclaimers []func()
+	// Where heap profiles go.
+	profileDir string
+
+	mu        sync.Mutex
+	rejecting bool
+	profiled  bool
+}
+
+func newMemWatchdog(limit int64, priorities *prioritizer, reclaimers []func(), profileDir string) *memWatchdog {
+	return &memWatchdog{limit: limit, priorities: priorities, reclaimers: reclaimers, profileDir: profileDir}
+}
+
+// Checks once a second, for as long as the process runs.
+func (m *memWatchdog) run() {
+	for {
+		<-clock.NewTimer(time.Second).Chan()
+		m.check()
+	}
+}
+
+func (m *memWatchdog) check() {
+	used := memoryInUse()
+	// Whether used is at least pct percent of the limit.
+	over := func(used int64, pct int64) bool { return used*100 >= m.limit*pct }
+	if over(used, 80) {
+		for _, reclaim := range m.reclaimers {
+			reclaim()
+		}
+		// Collects first, so what the caches let go of is returned too.
+		debug.FreeOSMemory()
+		after := memoryInUse()
+		log.Printf("memory watchdog: %s in use of %s, %s after reclaiming", formatBytes(used), formatBytes(m.limit), formatBytes(after))
+		used = after
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !m.rejecting && over(used, 90):
+		m.rejecting = true
+		log.Printf("memory watchdog: refusing requests below critical, %s in use", formatBytes(used))
+	case m.rejecting && !over(used, 80):
+		m.rejecting = false
+		log.Printf("memory watchdog: accepting requests again, %s in use", formatBytes(used))
+	}
+	switch {
+	case !m.profiled && over(used, 95):
+		m.profiled = true
+		if file, err := m.writeProfile(); err != nil {
+			log.Print("memory watchdog: writing heap profile: ", err)
+		} else {
+			log.Printf("memory watchdog: %s in use, heap profile written to %s", formatBytes(used), file)
+		}
+	case m.profiled && !over(used, 90):
+		m.profiled = false
+	}
+}
+
+func (m *memWatchdog) writeProfile() (string, error) {
+	name := fmt.Sprintf("heap-%d-%s.pprof", os.Getpid(), clock.Now().UTC().Format("20060102T150405"))
+	file := filepath.Join(m.profileDir, name)
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	return file, f.Close()
+}
+
+func (m *memWatchdog) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		m.mu.Lock()
+		rejecting := m.rejecting
+		m.mu.Unlock()
+		if rejecting && m.priorities.classify(r) < priorityCritical {
+			// Closing gives back the connection's buffers too.
+			return writeStatus(w, 503, "server low on memory\n", "Retry-After: 5", "Connection: close")
+		}
+		return next(w, r)
+	}
+}
+
+// The process's resident memory in bytes, from /proc where there is one,
+// or else what the Go runtime holds from the system.
+func memoryInUse() int64 {
+	if b, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 1 {
+			if pages, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.Sys - ms.HeapReleased)
+}
+
+// Like 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,97 @@
+package main
+
+// Middleware wraps a handler to add behavior before or after it runs.
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+)
+
+// Wraps next, calling it to continue the chain.
+type middleware func(next handlerFunc) handlerFunc
+
+// Attaches middleware to a single route. The first middleware listed runs
+// first, and repeated withMiddleware options append in the order given.
+func withMiddleware(mws ...middleware) routeOption {
+	return func(rt *route) {
+		rt.middleware = append(rt.middleware, mws...)
+	}
+}
+
+// Wraps h so that mws run in order, mws[0] outermost.
+func chain(h handlerFunc, mws []middleware) handlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Reports whether the request carries the basic auth credentials
+// "user:password".
+func checkBasicAuth(r *request, userPass string) bool {
+	const prefix = "Basic "
+	auth := r.header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	got, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, []byte(userPass)) == 1
+}
+
+// Requires basic auth credentials "user:password", answering 401 otherwise.
+// The user becomes the request's principal.
+func basicAuth(realm, userPass string) middleware {
+	user := strings.SplitN(userPass, ":", 2)[0]
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			if !checkBasicAuth(r, userPass) {
+				return writeStatus(w, 401, "authentication required\n",
+					`WWW-Authenticate: Basic realm="`+realm+`"`)
+			}
+			r.principal = user
+			return next(w, r)
+		}
+	}
+}
+
+// Hop-by-hop headers from RFC 7230 section 6.1 that apply to a single
+// connection and must not be forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Removes hop-by-hop headers, including any named by the Connection header.
+func stripHopByHop(h textproto.MIMEHeader) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// Strips hop-by-hop headers from requests as they're received, so handlers
+// that forward requests only see end-to-end headers.
+func normalizeHopByHop(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		stripHopByHop(r.header)
+		return next(w, r)
+	}
+}
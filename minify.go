@@ -0,0 +1,314 @@
+package main
+
+// Minification of HTML, CSS and JavaScript responses. It only strips
+// comments and whitespace, so it stays safe for any input: HTML keeps the
+// contents of <pre>, <textarea>, <script> and <style> as they are,
+// CSS keeps strings, and JavaScript keeps strings, regular expressions
+// and line breaks, which automatic semicolon insertion may rely on.
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Minifies response bodies no smaller than minBytes whose type it knows.
+// They're buffered to do so, so it's only worth filtering routes that
+// serve pages and their assets.
+func minifyFilter(minBytes int) outputFilter {
+	return func(r *request, header textproto.MIMEHeader, w io.Writer) io.WriteCloser {
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		minify := minifiers[mediaType]
+		// A range of the body can't be minified on its own.
+		if minify == nil || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+			return nil
+		}
+		return &minifyWriter{header: header, w: w, minify: minify, minBytes: minBytes}
+	}
+}
+
+type minifyWriter struct {
+	header   textproto.MIMEHeader
+	w        io.Writer
+	minify   func([]byte) []byte
+	minBytes int
+	buf      bytes.Buffer
+}
+
+func (m *minifyWriter) Write(p []byte) (int, error) {
+	return m.buf.Write(p)
+}
+
+// Minifies the body if it's big enough and sends it. Nothing has been
+// written to w yet, so the headers can still change.
+func (m *minifyWriter) Close() error {
+	body := m.buf.Bytes()
+	if len(body) >= m.minBytes {
+		body = m.minify(body)
+		bodyRewritten(m.header)
+	}
+	m.header.Set("Content-Length", strconv.Itoa(len(body)))
+	_, err := m.w.Write(body)
+	return err
+}
+
+var minifiers = map[string]func([]byte) []byte{
+	"text/html":              minifyHTML,
+	"text/css":               minifyCSS,
+	"text/javascript":        minifyJS,
+	"application/javascript": minifyJS,
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// Elements whose contents are left alone.
+var htmlRawElements = []string{"pre", "textarea", "script", "style"}
+
+// Drops comments, other than conditional ones, and collapses each run of
+// whitespace between tags and text to a single space, or a newline if it
+// had one.
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+	lower := bytes.ToLower(src)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("<!--")) && !bytes.HasPrefix(src[i:], []byte("<!--[if")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				return append(out.Bytes(), src[i:]...)
+			}
+			i += 4 + end + 3
+		case c == '<':
+			end := len(src)
+			if name := htmlRawElement(lower[i:]); name != "" {
+				if j := bytes.Index(lower[i:], []byte("</"+name)); j >= 0 {
+					end = i + j
+				}
+			} else {
+				end = skipTag(src, i)
+			}
+			out.Write(src[i:end])
+			i = end
+		case isSpace(c):
+			j, newline := i, false
+			for j < len(src) && isSpace(src[j]) {
+				newline = newline || src[j] == '\n'
+				j++
+			}
+			if newline {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(' ')
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// Returns the name of the raw element the tag at the start of the
+// lowercased b opens, or "".
+func htmlRawElement(b []byte) string {
+	for _, name := range htmlRawElements {
+		if len(b) > len(name)+1 && bytes.HasPrefix(b[1:], []byte(name)) {
+			if c := b[1+len(name)]; c == '>' || c == '/' || isSpace(c) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the offset just past the tag starting at src[i], so attribute
+// values are copied as they are.
+func skipTag(src []byte, i int) int {
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '"', '\'':
+			k := bytes.IndexByte(src[j+1:], src[j])
+			if k < 0 {
+				return len(src)
+			}
+			j += 1 + k
+		case '>':
+			return j + 1
+		}
+	}
+	return len(src)
+}
+
+// Drops comments and whitespace that doesn't separate anything.
+func minifyCSS(src []byte) []byte {
+	var out bytes.Buffer
+	// Spaces after these, or before them but for ':', which would turn
+	// "a :hover" into "a:hover", never matter. Arithmetic operators need
+	// theirs inside calc().
+	const tight = "{};:,>~"
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'':
+			j := skipString(src, i)
+			out.Write(src[i:j])
+			i = j
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return out.Bytes()
+			}
+			i += 2 + end + 2
+		case isSpace(c):
+			for i < len(src) && isSpace(src[i]) {
+				i++
+			}
+			prev := byte(';')
+			if out.Len() > 0 {
+				prev = out.Bytes()[out.Len()-1]
+			}
+			// Descendant selectors and values like "1px solid" need it.
+			if i < len(src) && strings.IndexByte(tight, prev) < 0 && (src[i] == ':' || strings.IndexByte(tight, src[i]) < 0) {
+				out.WriteByte(' ')
+			}
+		case c == '}' && out.Len() > 0 && out.Bytes()[out.Len()-1] == ';':
+			out.Truncate(out.Len() - 1)
+			out.WriteByte(c)
+			i++
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// Returns the offset just past the string literal starting at src[i].
+func skipString(src []byte, i int) int {
+	quote := src[i]
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1
+		case '\n':
+			if quote != '`' {
+				return j // Unterminated, leave the rest to the browser.
+			}
+		}
+	}
+	return len(src)
+}
+
+// Drops comments, indentation, trailing whitespace and blank lines. Line
+// breaks stay since removing one can change what the code means.
+func minifyJS(src []byte) []byte {
+	var out bytes.Buffer
+	// Whether a '/' here would start a regular expression rather than
+	// divide, judged by the last significant byte written.
+	regexAllowed := func() bool {
+		b := bytes.TrimRight(out.Bytes(), " \t\n")
+		if len(b) == 0 {
+			return true
+		}
+		last := b[len(b)-1]
+		if strings.IndexByte("(,=:[!&|?{};+-*%<>~^", last) >= 0 {
+			return true
+		}
+		for _, kw := range []string{"return", "typeof", "case", "do", "else", "in", "of", "void", "yield"} {
+			if bytes.HasSuffix(b, []byte(kw)) && (len(b) == len(kw) || !isIdentByte(b[len(b)-len(kw)-1])) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			j := skipString(src, i)
+			out.Write(src[i:j])
+			i = j
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return out.Bytes()
+			}
+			// A comment may be all that separates two tokens.
+			if bytes.IndexByte(src[i:i+2+end], '\n') >= 0 {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(' ')
+			}
+			i += 2 + end + 2
+		case c == '/' && regexAllowed():
+			j := skipRegexp(src, i)
+			out.Write(src[i:j])
+			i = j
+		case isSpace(c):
+			j, newline := i, false
+			for j < len(src) && isSpace(src[j]) {
+				newline = newline || src[j] == '\n'
+				j++
+			}
+			b := out.Bytes()
+			switch {
+			case out.Len() == 0 || b[out.Len()-1] == '\n':
+			case newline:
+				// The break replaces any space before it.
+				out.Truncate(len(bytes.TrimRight(b, " \t")))
+				out.WriteByte('\n')
+			case b[out.Len()-1] != ' ':
+				out.WriteByte(' ')
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return bytes.TrimSpace(out.Bytes())
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// Returns the offset just past the regular expression literal, flags
+// included, starting at src[i].
+func skipRegexp(src []byte, i int) int {
+	inClass := false
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '\n':
+			return j
+		case '/':
+			if !inClass {
+				j++
+				for j < len(src) && isIdentByte(src[j]) {
+					j++
+				}
+				return j
+			}
+		}
+	}
+	return len(src)
+}
@@ -0,0 +1,280 @@
+package main
+
+// A reader for MaxMind DB files, the format GeoLite2 and GeoIP2 databases
+// come in. The file is a binary search tree over the bits of an address,
+// whose leaves point into a data section of self-describing values, and
+// ends with a metadata map describing the tree.
+// See https://maxmind.github.io/MaxMind-DB/.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errBadMMDB = errors.New("malformed MaxMind DB")
+
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // The data section, which pointers are relative to.
+	nodeCount  uint
+	recordSize uint // Bits per record, two records per node.
+	ipVersion  uint
+	ipv4Start  uint // Node IPv4 addresses start from in an IPv6 tree.
+}
+
+func openMMDB(file string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return r, nil
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("no MaxMind DB metadata")
+	}
+	meta := buf[i+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbDecoder{section: meta}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errBadMMDB
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errBadMMDB
+	}
+	r.data = buf[treeSize+16 : i]
+	if r.ipVersion == 6 {
+		// IPv4 addresses live at ::a.b.c.d, 96 zero bits down the tree.
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	switch v := v.(type) {
+	case uint64:
+		return uint(v)
+	}
+	return 0
+}
+
+// Returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Looks up the record for ip, returning nil if the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errBadMMDB
+	}
+	v, _, err := (&mmdbDecoder{section: r.data}).decode(node - r.nodeCount - 16)
+	return v, err
+}
+
+// Decodes values from a data section, or the metadata, into maps, slices,
+// strings, []byte, bool, uint64, int64 and float64.
+type mmdbDecoder struct {
+	section []byte
+}
+
+const (
+	mmdbPointer = 1 + iota
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// Decodes the value at off, returning it and the offset after it.
+func (d *mmdbDecoder) decode(off uint) (interface{}, uint, error) {
+	b := d.section
+	if off >= uint(len(b)) {
+		return nil, 0, errBadMMDB
+	}
+	ctrl := b[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Pointers never point at pointers, which could otherwise loop.
+		if ptr < uint(len(b)) && uint(b[ptr]>>5) == mmdbPointer {
+			return nil, 0, errBadMMDB
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		if off >= uint(len(b)) {
+			return nil, 0, errBadMMDB
+		}
+		typ = 7 + uint(b[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(b)) {
+			return nil, 0, errBadMMDB
+		}
+		ext := uint(0)
+		for _, c := range b[off : off+n] {
+			ext = ext<<8 | uint(c)
+		}
+		off += n
+		size = [...]uint{29, 285, 65821}[n-1] + ext
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errBadMMDB
+			}
+			if m[key], off, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(b)) {
+		return nil, 0, errBadMMDB
+	}
+	v := b[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(v), off, nil
+	case mmdbBytes:
+		return append([]byte(nil), v...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errBadMMDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errBadMMDB
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		// Anything wider than 64 bits keeps its low 64.
+		n := uint64(0)
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case mmdbInt32:
+		n := uint32(0)
+		for _, c := range v {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB type %d", typ)
+}
+
+// Reads a pointer whose control byte was ctrl, returning the offset it
+// points to and the offset after it.
+func (d *mmdbDecoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if off+n > uint(len(d.section)) {
+		return 0, 0, errBadMMDB
+	}
+	p := uint(0)
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, c := range d.section[off : off+n] {
+		p = p<<8 | uint(c)
+	}
+	p += [...]uint{0, 2048, 526336, 0}[n-1]
+	return p, off + n, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+// OCSP stapling. With -tls_ocsp, the server asks each certificate's OCSP
+// responder whether it's still good, and staples the answer to its
+// handshakes, so clients needn't ask the responder themselves: a lookup
+// that costs them a round trip to a third party and tells it which site
+// they're visiting. Responses are refreshed hourly, well within the days
+// responders make them good for.
+//
+// The request and response are the DER structures of RFC 6960, built and
+// picked apart with encoding/asn1. A response is only stapled if it says
+// the certificate is good and is current; its signature is left to the
+// clients, which check it anyway.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/textproto"
+	"time"
+)
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasicResp = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Version     int `asn1:"explicit,tag:0,default:0,optional"`
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []ocspSingleResponse
+		Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// Identifies leaf to its issuer's responder, by SHA-1 hashes of the
+// issuer's name and public key, and leaf's serial number.
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   leaf.SerialNumber,
+	}, nil
+}
+
+// Checks that der is a current response saying the certificate id names
+// is good.
+func checkOCSPResponse(der []byte, id ocspCertID, now time.Time) error {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return err
+	}
+	if resp.Status != 0 {
+		return fmt.Errorf("responder answered with status %d", resp.Status)
+	}
+	if !resp.ResponseBytes.ResponseType.Equal(oidOCSPBasicResp) {
+		return fmt.Errorf("unknown response type %v", resp.ResponseBytes.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return err
+	}
+	for _, single := range basic.TBSResponseData.Responses {
+		c := single.CertID
+		if !bytes.Equal(c.IssuerNameHash, id.IssuerNameHash) || !bytes.Equal(c.IssuerKeyHash, id.IssuerKeyHash) ||
+			c.SerialNumber == nil || c.SerialNumber.Cmp(id.SerialNumber) != 0 {
+			continue
+		}
+		switch {
+		case !bool(single.Good):
+			return errors.New("certificate isn't good")
+		case now.Before(single.ThisUpdate):
+			return errors.New("response is from the future")
+		case !single.NextUpdate.IsZero() && !now.Before(single.NextUpdate):
+			return errors.New("response has expired")
+		}
+		return nil
+	}
+	return errors.New("response is about another certificate")
+}
+
+// The ID of cert's leaf and the responder to ask about it, "" if there's
+// none to ask, as with a self-signed certificate.
+func ocspTarget(cert *tls.Certificate) (id ocspCertID, responder string, err error) {
+	if len(cert.Certificate) < 2 {
+		return id, "", nil // Can't name the issuer without its certificate.
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || len(leaf.OCSPServer) == 0 {
+		return id, "", err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return id, "", err
+	}
+	id, err = newOCSPCertID(leaf, issuer)
+	return id, leaf.OCSPServer[0], err
+}
+
+// Asks cert's responder about it. Returns nil without an error if there's
+// no responder to ask.
+func fetchOCSP(cert *tls.Certificate) ([]byte, error) {
+	id, responder, err := ocspTarget(cert)
+	if err != nil || responder == "" {
+		return nil, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ Cert ocspCertID }{id})
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader{"Content-Type": {"application/ocsp-request"}}
+	resp, err := fetch("POST", responder, header, body, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != 200 {
+		return nil, fmt.Errorf("%s answered %d", responder, resp.status)
+	}
+	if err := checkOCSPResponse(resp.body, id, time.Now()); err != nil {
+		return nil, fmt.Errorf("%s: %v", responder, err)
+	}
+	return resp.body, nil
+}
+
+// Staples fresh OCSP responses to the certificates. A certificate whose
+// responder can't be reached keeps its staple until that expires.
+func (c *certStore) staple() error {
+	c.mu.RLock()
+	certs := c.certs
+	c.mu.RUnlock()
+	stapled := append([]*tls.Certificate(nil), certs...)
+	var firstErr error
+	for i, cert := range certs {
+		staple, err := fetchOCSP(cert)
+		switch {
+		case err != nil:
+			log.Printf("OCSP staple: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if cert.OCSPStaple == nil {
+				continue
+			}
+			id, _, _ := ocspTarget(cert)
+			if checkOCSPResponse(cert.OCSPStaple, id, time.Now()) == nil {
+				continue
+			}
+		case staple == nil:
+			continue
+		}
+		copied := *cert
+		copied.OCSPStaple = staple
+		stapled[i] = &copied
+	}
+	c.mu.Lock()
+	// Unless a reload replaced them meanwhile.
+	if sameCerts(c.certs, certs) {
+		c.certs = stapled
+	}
+	c.mu.Unlock()
+	return firstErr
+}
+
+func sameCerts(a, b []*tls.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
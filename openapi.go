@@ -0,0 +1,203 @@
+package main
+
+// OpenAPI 3 document generated from the documentation attached to routes on
+// a serveMux with withDoc.
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Documents one method on a route. Request and response schemas are derived
+// from the Go types of the example values: struct fields are named by their
+// json tag, fields without omitempty are required, and a doc tag supplies
+// the description.
+type apiOperation struct {
+	method      string // GET, PUT, etc.
+	path        string // OpenAPI path like /kv/{key}, defaults to the pattern
+	summary     string
+	params      []apiParam
+	requestBody interface{}
+	response    interface{}
+}
+
+type apiParam struct {
+	name        string
+	in          string // path, query or header
+	description string
+	required    bool
+}
+
+// Attaches OpenAPI documentation to a route.
+func withDoc(ops ...apiOperation) routeOption {
+	return func(rt *route) {
+		rt.docs = append(rt.docs, ops...)
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// Returns the JSON schema for values of type t.
+func apiSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": apiSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": apiSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			schema := apiSchema(f.Type)
+			if doc := f.Tag.Get("doc"); doc != "" {
+				schema["description"] = doc
+			}
+			props[name] = schema
+			omitempty := false
+			for _, opt := range tag[1:] {
+				omitempty = omitempty || opt == "omitempty"
+			}
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+func apiContent(example interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": apiSchema(reflect.TypeOf(example)),
+		},
+	}
+}
+
+// Builds the OpenAPI document for every documented route on the mux.
+func (m *serveMux) openAPI(title string) map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, rt := range m.sortedRoutes() {
+		for _, op := range rt.docs {
+			path := op.path
+			if path == "" {
+				path = openAPIPath(rt.pattern)
+			}
+			item, _ := paths[path].(map[string]interface{})
+			if item == nil {
+				item = make(map[string]interface{})
+				paths[path] = item
+			}
+
+			doc := map[string]interface{}{}
+			if op.summary != "" {
+				doc["summary"] = op.summary
+			}
+			var params []interface{}
+			for _, prm := range op.params {
+				param := map[string]interface{}{
+					"name": prm.name,
+					"in":   prm.in,
+					// Path parameters are required by definition.
+					"required": prm.required || prm.in == "path",
+					"schema":   map[string]interface{}{"type": "string"},
+				}
+				if prm.description != "" {
+					param["description"] = prm.description
+				}
+				params = append(params, param)
+			}
+			if params != nil {
+				doc["parameters"] = params
+			}
+			if op.requestBody != nil {
+				doc["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content":  apiContent(op.requestBody),
+				}
+			}
+			resp := map[string]interface{}{"description": "OK"}
+			if op.response != nil {
+				resp["content"] = apiContent(op.response)
+			}
+			doc["responses"] = map[string]interface{}{"200": resp}
+			item[strings.ToLower(op.method)] = doc
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": title, "version": "1.0.0"},
+		"paths":   paths,
+	}
+}
+
+// Serves the mux's OpenAPI document. The document is built per request so
+// routes registered later still show up.
+func openAPIHandler(m *serveMux, title string) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		return writeJSON(w, 200, m.openAPI(title))
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>API docs</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+func swaggerUIHandler(w responseWriter, r *request) error {
+	return writeHtml(func(*request) string { return swaggerUIPage })(w, r)
+}
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+// openat2(2)'s number in the table most architectures share since 5.6.
+const sysOpenat2 = 437
@@ -0,0 +1,6 @@
+//go:build linux && (mips64 || mips64le)
+
+package main
+
+// mips n64 numbers its system calls from 5000.
+const sysOpenat2 = 5437
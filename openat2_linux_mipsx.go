@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle)
+
+package main
+
+// mips o32 numbers its system calls from 4000.
+const sysOpenat2 = 4437
@@ -0,0 +1,75 @@
+package main
+
+// Patterns with parameters. A segment starting with ':' matches any one
+// path segment, and a last segment starting with '*' matches the rest of
+// the path, so /users/:id/posts matches /users/42/posts and /files/*path
+// matches /files/a/b.txt. The values land in request.params by name.
+// Unlike plain patterns, which match any path they prefix, a pattern with
+// parameters has to match the whole path.
+
+import (
+	"net/url"
+	"strings"
+)
+
+func isParamPattern(pattern string) bool {
+	return strings.Contains(pattern, "/:") || strings.Contains(pattern, "/*")
+}
+
+// Matches the raw, still escaped, path against pattern. The score counts
+// the literal segments, so /users/me beats /users/:id where both match.
+func matchParams(pattern, rawPath string) (map[string]string, int, bool) {
+	want := strings.Split(pattern, "/")
+	got := strings.Split(rawPath, "/")
+	params := make(map[string]string)
+	score := 0
+	for i, seg := range want {
+		if strings.HasPrefix(seg, "*") && i == len(want)-1 {
+			if i > len(got) {
+				return nil, 0, false
+			}
+			rest, err := url.PathUnescape(strings.Join(got[i:], "/"))
+			if err != nil {
+				return nil, 0, false
+			}
+			params[seg[1:]] = rest
+			return params, score, true
+		}
+		if i >= len(got) {
+			return nil, 0, false
+		}
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			// Escaped slashes stay inside the segment they were sent in.
+			v, err := url.PathUnescape(got[i])
+			if err != nil || v == "" {
+				return nil, 0, false
+			}
+			params[seg[1:]] = v
+		case seg == got[i]:
+			score++
+		default:
+			return nil, 0, false
+		}
+	}
+	if len(got) != len(want) {
+		return nil, 0, false
+	}
+	return params, score, true
+}
+
+// The value of the path parameter name, or "".
+func (r *request) param(name string) string {
+	return r.params[name]
+}
+
+// Writes a pattern's parameters the way OpenAPI does, /users/{id}.
+func openAPIPath(pattern string) string {
+	segs := strings.Split(pattern, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") && i == len(segs)-1 {
+			segs[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,71 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+type kqueuePoller struct {
+	kq     int
+	events []syscall.Kevent_t
+}
+
+func newPoller() (poller, error) {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(kq)
+	return &kqueuePoller{kq: kq}, nil
+}
+
+func (p *kqueuePoller) change(fd, filter, flags int) error {
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, filter, flags)
+	_, err := syscall.Kevent(p.kq, []syscall.Kevent_t{ev}, nil, nil)
+	return err
+}
+
+func (p *kqueuePoller) add(fd int) error {
+	return p.change(fd, syscall.EVFILT_READ, syscall.EV_ADD)
+}
+
+func (p *kqueuePoller) setWrite(fd int, write bool) error {
+	if write {
+		return p.change(fd, syscall.EVFILT_WRITE, syscall.EV_ADD)
+	}
+	return p.change(fd, syscall.EVFILT_WRITE, syscall.EV_DELETE)
+}
+
+func (p *kqueuePoller) remove(fd int) error {
+	// Closing the descriptor drops its filters, this just does it sooner.
+	p.change(fd, syscall.EVFILT_WRITE, syscall.EV_DELETE)
+	return p.change(fd, syscall.EVFILT_READ, syscall.EV_DELETE)
+}
+
+func (p *kqueuePoller) wait(events []pollEvent, timeout time.Duration) (int, error) {
+	if len(p.events) < len(events) {
+		p.events = make([]syscall.Kevent_t, len(events))
+	}
+	ts := syscall.NsecToTimespec(timeout.Nanoseconds())
+	n, err := syscall.Kevent(p.kq, nil, p.events[:len(events)], &ts)
+	if err != nil {
+		return 0, err
+	}
+	// kqueue reports each filter separately, so a descriptor can show up
+	// twice; the loop handles that like two events.
+	for i, ev := range p.events[:n] {
+		events[i] = pollEvent{
+			fd:       int(ev.Ident),
+			readable: ev.Filter == syscall.EVFILT_READ,
+			writable: ev.Filter == syscall.EVFILT_WRITE,
+		}
+	}
+	return n, nil
+}
+
+func (p *kqueuePoller) close() error {
+	return syscall.Close(p.kq)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+type epollPoller struct {
+	epfd   int
+	events []syscall.EpollEvent
+}
+
+func newPoller() (poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollPoller{epfd: epfd}, nil
+}
+
+func (p *epollPoller) ctl(op, fd int, write bool) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	if write {
+		ev.Events |= syscall.EPOLLOUT
+	}
+	return syscall.EpollCtl(p.epfd, op, fd, &ev)
+}
+
+func (p *epollPoller) add(fd int) error {
+	return p.ctl(syscall.EPOLL_CTL_ADD, fd, false)
+}
+
+func (p *epollPoller) setWrite(fd int, write bool) error {
+	return p.ctl(syscall.EPOLL_CTL_MOD, fd, write)
+}
+
+func (p *epollPoller) remove(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *epollPoller) wait(events []pollEvent, timeout time.Duration) (int, error) {
+	if len(p.events) < len(events) {
+		p.events = make([]syscall.EpollEvent, len(events))
+	}
+	n, err := syscall.EpollWait(p.epfd, p.events[:len(events)], int(timeout/time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	for i, ev := range p.events[:n] {
+		// Errors and hangups are reported as readable so the read that
+		// follows sees them.
+		events[i] = pollEvent{
+			fd:       int(ev.Fd),
+			readable: ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0,
+			writable: ev.Events&syscall.EPOLLOUT != 0,
+		}
+	}
+	return n, nil
+}
+
+func (p *epollPoller) close() error {
+	return syscall.Close(p.epfd)
+}
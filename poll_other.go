@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package main
+
+import "errors"
+
+func newPoller() (poller, error) {
+	return nil, errors.New("no epoll or kqueue on this platform")
+}
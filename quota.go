@@ -0,0 +1,110 @@
+package main
+
+// Usage accounting and quotas per authenticated principal, the user from
+// basic auth or the keyid of a message signature. Requests and bytes are
+// counted per UTC day and month, and a principal over its daily or monthly
+// request quota gets 429 until the period rolls over. Requests nobody
+// authenticated aren't counted.
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+type usage struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type periodUsage struct {
+	Period string `json:"period"` // 2006-01-02 for days, 2006-01 for months.
+	usage
+}
+
+func (p *periodUsage) roll(period string) {
+	if p.Period != period {
+		*p = periodUsage{Period: period}
+	}
+}
+
+type principalUsage struct {
+	Day   periodUsage `json:"day"`
+	Month periodUsage `json:"month"`
+}
+
+type quotaTracker struct {
+	daily   int64 // Requests allowed per day, 0 for no limit.
+	monthly int64 // Requests allowed per month, 0 for no limit.
+
+	mu    sync.Mutex
+	usage map[string]*principalUsage
+}
+
+func newQuotaTracker(daily, monthly int64) *quotaTracker {
+	return &quotaTracker{daily: daily, monthly: monthly, usage: make(map[string]*principalUsage)}
+}
+
+// Counts a request against principal, unless it's over quota, in which
+// case it returns how long until the quota resets.
+func (q *quotaTracker) admit(principal string, now time.Time) (bool, time.Duration) {
+	now = now.UTC()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[principal]
+	if u == nil {
+		u = &principalUsage{}
+		q.usage[principal] = u
+	}
+	u.Day.roll(now.Format("2006-01-02"))
+	u.Month.roll(now.Format("2006-01"))
+	if q.monthly > 0 && u.Month.Requests >= q.monthly {
+		return false, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	if q.daily > 0 && u.Day.Requests >= q.daily {
+		return false, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	u.Day.Requests++
+	u.Month.Requests++
+	return true, 0
+}
+
+func (q *quotaTracker) addBytes(principal string, in, out int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.usage[principal]; u != nil {
+		u.Day.BytesIn += in
+		u.Day.BytesOut += out
+		u.Month.BytesIn += in
+		u.Month.BytesOut += out
+	}
+}
+
+// Enforces quotas on requests an earlier middleware authenticated.
+func (q *quotaTracker) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if r.principal == "" {
+			return next(w, r)
+		}
+		ok, retry := q.admit(r.principal, clock.Now())
+		if !ok {
+			secs := int64((retry + time.Second - 1) / time.Second)
+			return writeStatus(w, 429, "quota exceeded\n", "Retry-After: "+strconv.FormatInt(secs, 10))
+		}
+		before := w.state.written
+		err := next(w, r)
+		q.addBytes(r.principal, int64(len(r.body)), w.state.written-before)
+		return err
+	}
+}
+
+func (q *quotaTracker) handler(w responseWriter, r *request) error {
+	q.mu.Lock()
+	snapshot := make(map[string]principalUsage, len(q.usage))
+	for p, u := range q.usage {
+		snapshot[p] = *u
+	}
+	q.mu.Unlock()
+	return writeJSON(w, 200, snapshot)
+}
@@ -0,0 +1,132 @@
+package main
+
+// Range requests. Handlers that can seek, like fileServer and the
+// downloads, answer Range themselves; serveRanges cuts the requested bytes
+// out of what any other handler writes. A single range per request is
+// served. Anything else, including ranges outside the body, gets the whole
+// body with 200.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Reports whether a request's If-Range, if it has one, names the response
+// with the given validators, so a range of it may be sent. Only a strong
+// ETag or the exact Last-Modified date matches.
+func ifRangeMatches(r *request, etag, lastModified string) bool {
+	v := r.header.Get("If-Range")
+	switch {
+	case v == "":
+		return true
+	case strings.HasPrefix(v, `"`):
+		return v == etag
+	default:
+		return lastModified != "" && v == lastModified
+	}
+}
+
+// Serves single byte ranges of GET responses with 200 that the handler
+// didn't answer with a range itself.
+func serveRanges(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		// Middleware further in may hide the range from the handler.
+		if spec := r.header.Get("Range"); r.method == "GET" && spec != "" {
+			addFilters(w, r, stageRange, []outputFilter{func(r *request, h textproto.MIMEHeader, dst io.Writer) io.WriteCloser {
+				return newRangeWriter(w.state, r, spec, h, dst)
+			}})
+		}
+		return next(w, r)
+	}
+}
+
+// Returns a writer passing on the range of the body r asks for, or nil if
+// the whole body should go.
+func newRangeWriter(s *responseState, r *request, spec string, h textproto.MIMEHeader, dst io.Writer) io.WriteCloser {
+	if s.status != 0 && s.status != 200 || h.Get("Content-Range") != "" ||
+		!ifRangeMatches(r, h.Get("ETag"), h.Get("Last-Modified")) {
+		return nil
+	}
+	return &rangeWriter{state: s, header: h, spec: spec, dst: dst, end: -1}
+}
+
+// Passes on body bytes [start, end). With a Content-Length by the first
+// write, once filters ahead of it have settled the length, the range is
+// cut as the body goes by; without one the body is buffered until Close.
+type rangeWriter struct {
+	state   *responseState
+	header  textproto.MIMEHeader
+	spec    string
+	dst     io.Writer
+	started bool
+	whole   bool  // Sending the whole body after all.
+	end     int64 // -1 until the range is known.
+	start   int64
+	pos     int64
+	buf     bytes.Buffer
+}
+
+// Sets the range out of a body of size bytes, making the response a 206.
+// Reports false if the whole body should go instead.
+func (rw *rangeWriter) setRange(size int64) bool {
+	start, end, ok, satisfiable := parseByteRange(rw.spec, size)
+	if !ok || !satisfiable {
+		return false
+	}
+	rw.start, rw.end = start, end
+	rw.state.status = 206
+	rw.header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	rw.header.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	return true
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	if !rw.started {
+		rw.started = true
+		if size, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64); err == nil {
+			rw.whole = !rw.setRange(size)
+		}
+	}
+	if rw.whole {
+		return rw.dst.Write(p)
+	}
+	if rw.end < 0 {
+		return rw.buf.Write(p)
+	}
+	n := len(p)
+	// Clip p to the part of it inside the range.
+	lo, hi := rw.start-rw.pos, rw.end-rw.pos
+	rw.pos += int64(n)
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > int64(n) {
+		hi = int64(n)
+	}
+	if lo < hi {
+		if _, err := rw.dst.Write(p[lo:hi]); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (rw *rangeWriter) Close() error {
+	if rw.whole || rw.end >= 0 {
+		return nil
+	}
+	// The body had no length, so its range could only be cut once it was
+	// all written.
+	body := rw.buf.Bytes()
+	if rw.setRange(int64(len(body))) {
+		body = body[rw.start:rw.end]
+	} else {
+		rw.header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	_, err := rw.dst.Write(body)
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+// Rate and connection limits for clients at large. -rate_limit gives each
+// client IP a token bucket, refilled at that many requests a second up to
+// -rate_burst, and answers requests that find it empty with 429. IPv6
+// clients are counted by their /64, which is what one usually gets.
+// -max_conns caps the connections open at once across every listener and
+// worker; connections accepted past it are closed straight away, before
+// any of their bytes are read.
+
+import (
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last topped up.
+}
+
+type ipLimiter struct {
+	priorities *prioritizer
+	rate       float64 // Tokens added a second.
+	burst      float64 // Most a bucket holds.
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newIPLimiter(priorities *prioritizer, rate float64, burst int) *ipLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &ipLimiter{priorities: priorities, rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// The bucket an IP is counted in.
+func rateLimitKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// Takes a token for key, unless its bucket is empty, in which case it
+// returns how long until there's one.
+func (l *ipLimiter) admit(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Forgets the buckets that have filled up again, which are no different
+// from having none. Run as a scheduled task.
+func (l *ipLimiter) sweep() error {
+	now := clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	return nil
+}
+
+// Limits requests by client IP. Requests without one, like those over a
+// Unix socket, and critical ones aren't limited.
+func (l *ipLimiter) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		ip := r.remoteIP()
+		if ip == nil || l.priorities.classify(r) == priorityCritical {
+			return next(w, r)
+		}
+		ok, retry := l.admit(rateLimitKey(ip), clock.Now())
+		if !ok {
+			secs := int64((retry + time.Second - 1) / time.Second)
+			return writeStatus(w, 429, "rate limit exceeded\n", "Retry-After: "+strconv.FormatInt(secs, 10))
+		}
+		return next(w, r)
+	}
+}
+
+// Counts the connections open across servers, against a cap. A nil
+// connLimit has no cap.
+type connLimit struct {
+	max int
+
+	mu       sync.Mutex
+	open     int
+	refusing bool // Whether the last connection was refused, to log once.
+}
+
+func newConnLimit(max int) *connLimit {
+	return &connLimit{max: max}
+}
+
+// Counts a new connection, unless it would go over the cap, in which case
+// the caller closes it.
+func (c *connLimit) acquire() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open >= c.max {
+		if !c.refusing {
+			c.refusing = true
+			log.Printf("refusing connections, %d open", c.open)
+		}
+		return false
+	}
+	if c.refusing {
+		c.refusing = false
+		log.Printf("accepting connections again")
+	}
+	c.open++
+	return true
+}
+
+func (c *connLimit) release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+}
@@ -0,0 +1,113 @@
+package main
+
+// Warm-up and readiness. Startup work that the first requests would
+// otherwise stall on, like fingerprinting assets and checking the
+// directories files are served from, runs once the listener is up. Until
+// it's done /readyz answers 503, so a load balancer holds traffic back,
+// and requests that arrive anyway wait for it or are refused. Critical
+// routes, /readyz among them, are served throughout.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+type warmupStep struct {
+	name string
+	run  func() error
+}
+
+// Steps run in the order they're registered, before the server is ready.
+var warmupSteps []warmupStep
+
+// Registers a function to run during warm-up. An error stops the server.
+func onWarmup(name string, run func() error) {
+	warmupSteps = append(warmupSteps, warmupStep{name, run})
+}
+
+// Checks that dir, which files are served from, is a directory.
+func statRoot(dir string) func() error {
+	return func() error {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		return nil
+	}
+}
+
+type readiness struct {
+	priorities *prioritizer
+	warm       chan struct{} // Closed once warm-up is done.
+	// How long requests arriving during warm-up wait for it.
+	maxWait time.Duration
+	// Reports whether the server is shutting down. Set once it exists.
+	closing func() bool
+}
+
+func newReadiness(priorities *prioritizer, maxWait time.Duration) *readiness {
+	return &readiness{priorities: priorities, warm: make(chan struct{}), maxWait: maxWait}
+}
+
+// Runs the warm-up steps, then lets requests through.
+func (rd *readiness) warmUp() {
+	start := time.Now()
+	for _, step := range warmupSteps {
+		t := time.Now()
+		if err := step.run(); err != nil {
+			log.Fatalf("warm-up %s: %v", step.name, err)
+		}
+		log.Printf("warm-up %s took %v", step.name, time.Since(t))
+	}
+	close(rd.warm)
+	log.Printf("Ready after %v", time.Since(start))
+}
+
+func (rd *readiness) isWarm() bool {
+	select {
+	case <-rd.warm:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reports 200 once warm-up is done, and 503 before then and while the
+// server shuts down.
+func (rd *readiness) handler(w responseWriter, r *request) error {
+	switch {
+	case !rd.isWarm():
+		return writeStatus(w, 503, "warming up\n", "Retry-After: 1")
+	case rd.closing != nil && rd.closing():
+		return writeStatus(w, 503, "shutting down\n")
+	}
+	return writeStatus(w, 200, "ready\n")
+}
+
+// Holds requests that arrive during warm-up until it's done, refusing
+// them with 503 if that takes longer than maxWait.
+func (rd *readiness) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if rd.isWarm() || rd.priorities.classify(r) == priorityCritical {
+			return next(w, r)
+		}
+		if rd.maxWait > 0 {
+			start := clock.Now()
+			t := clock.NewTimer(rd.maxWait)
+			defer t.Stop()
+			select {
+			case <-rd.warm:
+				r.recordPhase("warmup", clock.Now().Sub(start))
+				return next(w, r)
+			case <-t.Chan():
+			case <-r.context().Done():
+			}
+		}
+		return writeStatus(w, 503, "warming up\n", "Retry-After: 1")
+	}
+}
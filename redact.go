@@ -0,0 +1,126 @@
+package main
+
+// Redaction of named fields from JSON responses, for routes that pass along
+// what other services return and shouldn't hand their tokens or users'
+// addresses on to browsers.
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// What redacted values are replaced with.
+const redacted = "[REDACTED]"
+
+// Redacts fields with the given names, matched case-insensitively at any
+// depth, from JSON responses to paths under one of the prefixes.
+func redactJSON(prefixes, fields []string) middleware {
+	names := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		names[strings.ToLower(f)] = true
+	}
+	filter := func(r *request, header textproto.MIMEHeader, w io.Writer) io.WriteCloser {
+		if !isJSONType(header.Get("Content-Type")) {
+			return nil
+		}
+		if header.Get("Content-Encoding") != "" {
+			log.Printf("not redacting encoded response to %s", r.path)
+			return nil
+		}
+		return &redactWriter{names: names, header: header, w: w}
+	}
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			if !hasAnyPrefix(r.path, prefixes) {
+				return next(w, r)
+			}
+			// A range a handler cut itself would be of the unredacted body.
+			// Ranges of the redacted one are still served.
+			if spec := r.header.Get("Range"); spec != "" {
+				r.header.Del("Range")
+				defer r.header.Set("Range", spec)
+			}
+			addFilters(w, r, stageTransform, []outputFilter{filter})
+			return next(w, r)
+		}
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the media type is application/json or a +json one.
+func isJSONType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+type redactWriter struct {
+	names  map[string]bool
+	header textproto.MIMEHeader
+	w      io.Writer
+	buf    bytes.Buffer
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	return rw.buf.Write(p)
+}
+
+// Sends the body with the fields redacted. A body that isn't JSON after
+// all is sent as it is.
+func (rw *redactWriter) Close() error {
+	body := rw.buf.Bytes()
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		log.Print("redacting JSON response: ", err)
+	} else if rw.redact(v) {
+		var out bytes.Buffer
+		e := json.NewEncoder(&out)
+		e.SetEscapeHTML(false)
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+		body = out.Bytes()
+		bodyRewritten(rw.header)
+	}
+	rw.header.Set("Content-Length", strconv.Itoa(len(body)))
+	_, err := rw.w.Write(body)
+	return err
+}
+
+// Redacts the named fields in v, reporting whether there were any.
+func (rw *redactWriter) redact(v interface{}) bool {
+	found := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if rw.names[strings.ToLower(k)] {
+				v[k] = redacted
+				found = true
+			} else if rw.redact(field) {
+				found = true
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if rw.redact(elem) {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,162 @@
+package main
+
+// Redirect map loaded from a file so bulk URL migrations don't need code.
+//
+// Each line of the file has the form:
+//
+//	source target [status]
+//
+// Blank lines and lines starting with # are ignored. A source starting with
+// ~ is a regular expression matched against the request URI, and the target
+// may refer to capture groups as $1, ${name}, etc. Any other source must
+// match the request's path exactly, and the query, if any, is carried over
+// to the target. The status defaults to 301.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type redirectRule struct {
+	source string
+	re     *regexp.Regexp // nil for exact matches
+	target string
+	code   int
+}
+
+// Status codes a redirect rule may use.
+var redirectCodes = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+// The rules are swapped wholesale on reload, so lookups only need a read
+// lock.
+type redirectMap struct {
+	mu    sync.RWMutex
+	file  string
+	rules []redirectRule
+}
+
+var redirects redirectMap
+
+func parseRedirects(rd io.Reader) ([]redirectRule, error) {
+	var rules []redirectRule
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want 'source target [status]', got %q", n, line)
+		}
+		rule := redirectRule{source: fields[0], target: fields[1], code: 301}
+		if len(fields) == 3 {
+			code, err := strconv.Atoi(fields[2])
+			if err != nil || !redirectCodes[code] {
+				return nil, fmt.Errorf("line %d: unsupported redirect status %q", n, fields[2])
+			}
+			rule.code = code
+		}
+		if strings.HasPrefix(rule.source, "~") {
+			re, err := regexp.Compile(rule.source[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			rule.re = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// Replaces the rules with the contents of file.
+func (m *redirectMap) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := parseRedirects(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	m.mu.Lock()
+	m.file, m.rules = file, rules
+	m.mu.Unlock()
+	log.Printf("Loaded %d redirects from %s", len(rules), file)
+	return nil
+}
+
+// Reloads the redirect file whenever the process receives SIGHUP. A file
+// that fails to parse leaves the previous rules in place.
+func (m *redirectMap) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		m.mu.RLock()
+		file := m.file
+		m.mu.RUnlock()
+		if err := m.load(file); err != nil {
+			log.Printf("Keeping previous redirects: %v", err)
+		}
+	}
+}
+
+// Finds the first rule matching r in file order.
+func (m *redirectMap) find(r *request) (target string, code int, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, rule := range m.rules {
+		if rule.re == nil {
+			if rule.source == r.path {
+				return withQuery(rule.target, r.rawQuery), rule.code, true
+			}
+			continue
+		}
+		if match := rule.re.FindStringSubmatchIndex(r.uri); match != nil {
+			return string(rule.re.ExpandString(nil, rule.target, r.uri, match)), rule.code, true
+		}
+	}
+	return "", 0, false
+}
+
+// Adds rawQuery to target, after any query target has of its own.
+func withQuery(target, rawQuery string) string {
+	switch {
+	case rawQuery == "":
+		return target
+	case strings.Contains(target, "?"):
+		return target + "&" + rawQuery
+	}
+	return target + "?" + rawQuery
+}
+
+// Writes a redirect if a rule matches the request. Reports whether a
+// response was written.
+func (m *redirectMap) redirect(w responseWriter, r *request) (bool, error) {
+	target, code, ok := m.find(r)
+	if !ok {
+		return false, nil
+	}
+	log.Printf("Redirecting %s to %s with %d", r.uri, target, code)
+	return true, redirect(w, r, target, code)
+}
+
+// Redirects the client to target, which may be relative to the request
+// URI, with one of the redirect status codes. 307 and 308 keep the method
+// and body; 301 and 302 may turn a POST into a GET.
+func redirect(w responseWriter, r *request, target string, code int) error {
+	if !redirectCodes[code] {
+		return fmt.Errorf("%d isn't a redirect status", code)
+	}
+	return writeStatus(w, code, "", "Location: "+target)
+}
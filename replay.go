@@ -0,0 +1,317 @@
+package main
+
+// Replaying traffic. -replay reads requests back out of a JSON access log
+// or a HAR recording and sends them to -replay_target with the client,
+// spaced the way they first arrived, or sped up or slowed down by
+// -replay_speed, to reproduce a load. Access log lines have no headers or
+// bodies, so those requests go out without them.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type replayRequest struct {
+	at     time.Time // When it was first sent.
+	method string
+	uri    string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// The parts of a HAR file replay uses.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// Headers the client sets itself, or that don't carry over to another
+// connection.
+var replaySkipHeaders = map[string]bool{
+	"Host": true, "Content-Length": true, "Connection": true,
+	"Keep-Alive": true, "Transfer-Encoding": true,
+}
+
+// Reads the requests in file, a HAR recording or a JSON access log, in the
+// order they were sent.
+func readReplayFile(file string) ([]replayRequest, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []replayRequest
+	var har harFile
+	if json.Unmarshal(b, &har) == nil && len(har.Log.Entries) > 0 {
+		reqs, err = harRequests(&har)
+	} else {
+		reqs, err = accessLogRequests(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("%s has no requests in it", file)
+	}
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].at.Before(reqs[j].at) })
+	return reqs, nil
+}
+
+func harRequests(har *harFile) ([]replayRequest, error) {
+	var reqs []replayRequest
+	for _, e := range har.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, err
+		}
+		header := make(textproto.MIMEHeader)
+		for _, h := range e.Request.Headers {
+			// HTTP/2 recordings have pseudo-headers like :authority.
+			name := textproto.CanonicalMIMEHeaderKey(h.Name)
+			if strings.HasPrefix(name, ":") || replaySkipHeaders[name] {
+				continue
+			}
+			header.Add(name, h.Value)
+		}
+		req := replayRequest{at: e.StartedDateTime, method: e.Request.Method, uri: u.RequestURI(), header: header}
+		if e.Request.PostData != nil {
+			req.body = []byte(e.Request.PostData.Text)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// Reads -access_log_format=json lines. Each is logged once the response
+// is done, so it started the latency earlier.
+func accessLogRequests(r io.Reader) ([]replayRequest, error) {
+	var reqs []replayRequest
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e accessLogEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d isn't a JSON access log entry: %v", n, err)
+		}
+		done, err := time.Parse(time.RFC3339Nano, e.Time)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		uri := (&url.URL{Path: e.Path}).EscapedPath()
+		if e.Query != "" {
+			uri += "?" + e.Query
+		}
+		reqs = append(reqs, replayRequest{
+			at:     done.Add(-time.Duration(e.LatencyMS * float64(time.Millisecond))),
+			method: e.Method,
+			uri:    uri,
+		})
+	}
+	return reqs, s.Err()
+}
+
+// Sends the requests to target on the original schedule divided by speed,
+// or as fast as they're answered if speed is 0, with at most concurrency
+// of them outstanding. Connections are kept for reuse.
+type replayer struct {
+	target      *url.URL
+	speed       float64
+	concurrency int
+	timeout     time.Duration
+
+	mu       sync.Mutex
+	idle     []*clientConn
+	statuses map[int]int
+	errors   map[string]int
+	elapsed  []time.Duration
+	late     int // Requests that went out late, waiting for a free slot.
+}
+
+func newReplayer(target string, speed float64, concurrency int, timeout time.Duration) (*replayer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("-replay_target must be an http or https URL, not %q", target)
+	}
+	if speed < 0 {
+		return nil, errors.New("-replay_speed can't be negative")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &replayer{
+		target: u, speed: speed, concurrency: concurrency, timeout: timeout,
+		statuses: make(map[int]int), errors: make(map[string]int),
+	}, nil
+}
+
+func (rp *replayer) run(reqs []replayRequest) time.Duration {
+	slots := make(chan struct{}, rp.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, req := range reqs {
+		if rp.speed > 0 {
+			offset := time.Duration(float64(req.at.Sub(reqs[0].at)) / rp.speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			if rp.speed > 0 {
+				rp.mu.Lock()
+				rp.late++
+				rp.mu.Unlock()
+			}
+			slots <- struct{}{}
+		}
+		wg.Add(1)
+		go func(req replayRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// A response that trips up the client costs that request, not
+			// the run.
+			defer func() {
+				if e := recover(); e != nil {
+					rp.record(0, 0, fmt.Errorf("panic: %v", e))
+				}
+			}()
+			rp.send(req)
+		}(req)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func (rp *replayer) send(req replayRequest) {
+	c, err := rp.conn()
+	if err != nil {
+		rp.record(0, 0, err)
+		return
+	}
+	start := time.Now()
+	resp, err := c.do(req.method, req.uri, req.header, req.body)
+	elapsed := time.Since(start)
+	if err != nil {
+		c.Close()
+		rp.record(0, 0, err)
+		return
+	}
+	rp.mu.Lock()
+	if c.closed {
+		c.Close()
+	} else {
+		rp.idle = append(rp.idle, c)
+	}
+	rp.mu.Unlock()
+	rp.record(resp.status, elapsed, nil)
+}
+
+// An idle connection to the target, or else a new one.
+func (rp *replayer) conn() (*clientConn, error) {
+	rp.mu.Lock()
+	if n := len(rp.idle); n > 0 {
+		c := rp.idle[n-1]
+		rp.idle = rp.idle[:n-1]
+		rp.mu.Unlock()
+		return c, nil
+	}
+	rp.mu.Unlock()
+	return dialURL(rp.target, rp.timeout)
+}
+
+func (rp *replayer) record(status int, elapsed time.Duration, err error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err != nil {
+		rp.errors[err.Error()]++
+		return
+	}
+	rp.statuses[status]++
+	rp.elapsed = append(rp.elapsed, elapsed)
+}
+
+// Writes the responses by status, any errors, and the latencies.
+func (rp *replayer) report(w io.Writer, total time.Duration) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, c := range rp.idle {
+		c.Close()
+	}
+	rp.idle = nil
+	sent := len(rp.elapsed)
+	for _, n := range rp.errors {
+		sent += n
+	}
+	fmt.Fprintf(w, "Replayed %d requests against %s in %v\n", sent, rp.target.Host, total.Round(time.Millisecond))
+	if rp.late > 0 {
+		fmt.Fprintf(w, "%d went out late, waiting on -replay_concurrency\n", rp.late)
+	}
+	codes := make([]int, 0, len(rp.statuses))
+	for code := range rp.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d: %d\n", code, rp.statuses[code])
+	}
+	msgs := make([]string, 0, len(rp.errors))
+	for msg := range rp.errors {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		fmt.Fprintf(w, "  error %s: %d\n", msg, rp.errors[msg])
+	}
+	if len(rp.elapsed) == 0 {
+		return
+	}
+	sort.Slice(rp.elapsed, func(i, j int) bool { return rp.elapsed[i] < rp.elapsed[j] })
+	pct := func(p float64) time.Duration {
+		return rp.elapsed[int(p*float64(len(rp.elapsed)-1))]
+	}
+	fmt.Fprintf(w, "Latency p50 %v, p90 %v, p99 %v, max %v\n", pct(0.5), pct(0.9), pct(0.99), rp.elapsed[len(rp.elapsed)-1])
+}
+
+// Replays file against target and prints how it went.
+func replay(file, target string, speed float64, concurrency int) error {
+	reqs, err := readReplayFile(file)
+	if err != nil {
+		return err
+	}
+	rp, err := newReplayer(target, speed, concurrency, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	rp.report(os.Stdout, rp.run(reqs))
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// Lets other sockets bind the same address, for -workers. DragonFly
+// balances new connections across them; the others may favor one.
+func setReusePort(fd sysfd) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+}
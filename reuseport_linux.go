@@ -0,0 +1,18 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Lets other sockets bind the same address, for -workers. The kernel
+// balances new connections across them. The syscall package leaves
+// SO_REUSEPORT out on some architectures; it's 15 on all but MIPS.
+func setReusePort(fd sysfd) error {
+	opt := 0xf
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		opt = 0x200
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, 1)
+}
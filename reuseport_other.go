@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package main
+
+import "errors"
+
+func setReusePort(fd sysfd) error {
+	return errors.New("-workers isn't supported on this system")
+}
@@ -0,0 +1,162 @@
+package main
+
+// Crawler control: /robots.txt from a file, request rates per class of
+// crawler, and X-Robots-Tag headers on chosen path prefixes.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func robotsHandler(file string) (handlerFunc, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return func(w responseWriter, r *request) error {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, err := w.Write(body)
+		return err
+	}, nil
+}
+
+// User agent substrings for each class of crawler, matched
+// case-insensitively. Anything else calling itself a bot, crawler or
+// spider is "other".
+var crawlerClasses = map[string][]string{
+	"search": {"googlebot", "bingbot", "duckduckbot", "yandexbot", "baiduspider", "applebot"},
+	"ai":     {"gptbot", "ccbot", "claudebot", "anthropic-ai", "google-extended", "perplexitybot", "bytespider"},
+	"seo":    {"ahrefsbot", "semrushbot", "mj12bot", "dotbot"},
+}
+
+// Returns the crawler class of a user agent, or "" for one that doesn't
+// look like a crawler.
+func crawlerClass(agent string) string {
+	agent = strings.ToLower(agent)
+	for class, names := range crawlerClasses {
+		for _, name := range names {
+			if strings.Contains(agent, name) {
+				return class
+			}
+		}
+	}
+	for _, word := range []string{"bot", "crawler", "spider"} {
+		if strings.Contains(agent, word) {
+			return "other"
+		}
+	}
+	return ""
+}
+
+// Limits the requests each crawler class makes per minute, across every
+// crawler in the class.
+type crawlerLimiter struct {
+	perMinute map[string]int // Classes without an entry aren't limited.
+
+	mu      sync.Mutex
+	windows map[string]*keyWindow
+}
+
+// Parses rates like "search=60,ai=0,other=10". A rate of 0 refuses the
+// class outright.
+func parseCrawlerRates(spec string) (*crawlerLimiter, error) {
+	l := &crawlerLimiter{perMinute: make(map[string]int), windows: make(map[string]*keyWindow)}
+	for _, item := range strings.Split(spec, ",") {
+		i := strings.IndexByte(item, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("crawler rate %q isn't class=rate", item)
+		}
+		class := strings.TrimSpace(item[:i])
+		if _, ok := crawlerClasses[class]; !ok && class != "other" {
+			return nil, fmt.Errorf("unknown crawler class %q", class)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("crawler rate %q isn't class=rate", item)
+		}
+		l.perMinute[class] = n
+	}
+	return l, nil
+}
+
+// Counts a request from class, unless that puts it over its rate, in
+// which case it returns how long until the window resets.
+func (l *crawlerLimiter) admit(class string, now time.Time) (bool, time.Duration) {
+	limit, ok := l.perMinute[class]
+	if !ok {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	win := l.windows[class]
+	if win == nil || now.Sub(win.start) >= time.Minute {
+		win = &keyWindow{start: now}
+		l.windows[class] = win
+	}
+	if win.count >= limit {
+		return false, win.start.Add(time.Minute).Sub(now)
+	}
+	win.count++
+	return true, 0
+}
+
+func (l *crawlerLimiter) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		class := crawlerClass(r.header.Get("User-Agent"))
+		// Crawlers may always read the rules.
+		if class == "" || r.path == "/robots.txt" {
+			return next(w, r)
+		}
+		if limit, ok := l.perMinute[class]; ok && limit == 0 {
+			return writeStatus(w, 403, "crawling not allowed\n")
+		}
+		ok, retry := l.admit(class, clock.Now())
+		if !ok {
+			secs := int64((retry + time.Second - 1) / time.Second)
+			return writeStatus(w, 429, "crawl rate exceeded\n", "Retry-After: "+strconv.FormatInt(secs, 10))
+		}
+		return next(w, r)
+	}
+}
+
+type robotsTagRule struct {
+	prefix string
+	value  string
+}
+
+// Parses rules like "/private/=noindex;/drafts/=noindex, nofollow". They're
+// separated by semicolons since tag values may contain commas.
+func parseRobotsTags(spec string) ([]robotsTagRule, error) {
+	var rules []robotsTagRule
+	for _, item := range strings.Split(spec, ";") {
+		i := strings.IndexByte(item, '=')
+		if i < 0 || !strings.HasPrefix(item, "/") {
+			return nil, fmt.Errorf("X-Robots-Tag rule %q isn't /prefix=value", item)
+		}
+		rules = append(rules, robotsTagRule{prefix: item[:i], value: strings.TrimSpace(item[i+1:])})
+	}
+	// The longest prefix wins, like routes.
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// Adds X-Robots-Tag to responses for paths under a rule's prefix.
+func robotsTags(rules []robotsTagRule) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			for _, rule := range rules {
+				if strings.HasPrefix(r.path, rule.prefix) {
+					w.Header().Set("X-Robots-Tag", rule.value)
+					break
+				}
+			}
+			return next(w, r)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+// Introspection of the route table registered on a serveMux.
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type routeInfo struct {
+	Pattern    string   `json:"pattern"`
+	Methods    []string `json:"methods,omitempty"`
+	Middleware []string `json:"middleware,omitempty"`
+	Handler    string   `json:"handler"`
+	Priority   string   `json:"priority"`
+}
+
+// Names a function by the symbol the compiler gave it, like
+// main.kvHandler.func1 for a closure returned by kvHandler.
+func funcName(f interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	return fn.Name()
+}
+
+func (rt *route) info() routeInfo {
+	info := routeInfo{Pattern: rt.pattern, Handler: funcName(rt.handler), Priority: rt.priority.String()}
+	for _, mw := range rt.middleware {
+		info.Middleware = append(info.Middleware, funcName(mw))
+	}
+	seen := make(map[string]bool)
+	if rt.method != "" {
+		seen[rt.method] = true
+		info.Methods = append(info.Methods, rt.method)
+	}
+	for _, op := range rt.docs {
+		if !seen[op.method] {
+			seen[op.method] = true
+			info.Methods = append(info.Methods, op.method)
+		}
+	}
+	sort.Strings(info.Methods)
+	return info
+}
+
+// The routes sorted by pattern, then method.
+func (m *serveMux) sortedRoutes() []*route {
+	routes := make([]*route, 0, len(m.routes))
+	for _, rt := range m.routes {
+		routes = append(routes, rt)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].pattern != routes[j].pattern {
+			return routes[i].pattern < routes[j].pattern
+		}
+		return routes[i].method < routes[j].method
+	})
+	return routes
+}
+
+// Lists the routes sorted by pattern.
+func (m *serveMux) routeTable() []routeInfo {
+	table := make([]routeInfo, 0, len(m.routes))
+	for _, rt := range m.sortedRoutes() {
+		table = append(table, rt.info())
+	}
+	return table
+}
+
+// Writes the route table as aligned columns. Methods are only known for
+// routes registered for a method and documented ones; * means the handler
+// sees every method.
+func (m *serveMux) printRoutes(out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATTERN\tMETHODS\tPRIORITY\tMIDDLEWARE\tHANDLER")
+	for _, info := range m.routeTable() {
+		methods, middleware := "*", "-"
+		if len(info.Methods) > 0 {
+			methods = strings.Join(info.Methods, ",")
+		}
+		if len(info.Middleware) > 0 {
+			middleware = strings.Join(info.Middleware, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Pattern, methods, info.Priority, middleware, info.Handler)
+	}
+	return tw.Flush()
+}
+
+func routesHandler(m *serveMux) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		return writeJSON(w, 200, m.routeTable())
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+// Background tasks. A scheduler attached to the server runs registered
+// functions on an interval or a cron schedule while it serves, for work
+// like evicting expired entries. Each task runs in its own goroutine, one
+// run at a time; a task that panics is logged and runs again at its next
+// time. /debug/tasks reports how every task has been doing.
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When a task runs next, after a given time.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+type every time.Duration
+
+func (e every) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// Parses "@every 5m", "@hourly", "@daily" or a five-field cron spec like
+// "*/15 2-4 * * 1-5", read in local time.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("schedule %q needs a positive duration", spec)
+		}
+		return every(d), nil
+	case spec == "@hourly":
+		spec = "0 * * * *"
+	case spec == "@daily":
+		spec = "0 0 * * *"
+	}
+	return parseCron(spec)
+}
+
+// A cron spec, with a bit set for each value each field matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// With both day fields restricted, a day matching either will do.
+	domStar, dowStar bool
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q doesn't have five fields", spec)
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		var err error
+		if bits[i], err = parseCronField(f, cronFieldRanges[i][0], cronFieldRanges[i][1]); err != nil {
+			return nil, fmt.Errorf("cron spec %q: %v", spec, err)
+		}
+	}
+	// Sunday is 0 or 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSpec{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// Parses a comma-separated list of *, n, a-b, each optionally with a /step.
+func parseCronField(f string, lo, hi int) (uint64, error) {
+	if lo == 0 && hi == 6 {
+		hi = 7
+	}
+	var bits uint64
+	for _, item := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+			item, step = item[:i], n
+		}
+		first, last := lo, hi
+		if item != "*" {
+			var err error
+			parts := strings.SplitN(item, "-", 2)
+			if first, err = strconv.Atoi(parts[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", item)
+			}
+			last = first
+			if len(parts) == 2 {
+				if last, err = strconv.Atoi(parts[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", item)
+				}
+			} else if step > 1 {
+				last = hi
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("%q is outside %d-%d", item, lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Steps forward from the minute after after, skipping whole months, days
+// and hours that can't match, for up to five years. A spec that never
+// matches, like Feb 30, gives the zero time.
+func (c *cronSpec) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+type task struct {
+	name  string
+	spec  string
+	sched schedule
+	run   func() error
+
+	mu    sync.Mutex
+	stats taskStats
+}
+
+type taskStats struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Runs         int64     `json:"runs"`
+	Failures     int64     `json:"failures"`
+	Panics       int64     `json:"panics"`
+	LastRun      time.Time `json:"last_run"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	tasks   []*task
+	started bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{stop: make(chan struct{})}
+}
+
+// Registers run to be called on the schedule spec describes, starting
+// once the server does.
+func (s *scheduler) add(name, spec string, run func() error) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	t := &task{name: name, spec: spec, sched: sched, run: run}
+	t.stats = taskStats{Name: name, Schedule: spec}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, t)
+	if s.started {
+		s.wg.Add(1)
+		go s.loop(t)
+	}
+	return nil
+}
+
+// Starts running the tasks, unless they already are.
+func (s *scheduler) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, t := range s.tasks {
+		s.wg.Add(1)
+		go s.loop(t)
+	}
+}
+
+// Stops scheduling tasks, then waits for any that are running to finish
+// or for done to close, whichever comes first.
+func (s *scheduler) shutdown(done <-chan struct{}) {
+	close(s.stop)
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-done:
+	}
+}
+
+func (s *scheduler) loop(t *task) {
+	defer s.wg.Done()
+	for {
+		next := t.sched.next(clock.Now())
+		if next.IsZero() {
+			log.Printf("task %s: schedule %q never comes round", t.name, t.spec)
+			return
+		}
+		t.mu.Lock()
+		t.stats.NextRun = next
+		t.mu.Unlock()
+		timer := clock.NewTimer(next.Sub(clock.Now()))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.Chan():
+		}
+		s.runTask(t)
+	}
+}
+
+// Runs t once, recovering from a panic so the task, and the server, carry
+// on.
+func (s *scheduler) runTask(t *task) {
+	start := clock.Now()
+	var err error
+	panicked := false
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				panicked = true
+				err = fmt.Errorf("panic: %v", e)
+				log.Printf("panic in task %s: %v\n%s", t.name, e, debug.Stack())
+			}
+		}()
+		err = t.run()
+	}()
+	if err != nil && !panicked {
+		log.Printf("task %s: %v", t.name, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := &t.stats
+	st.Runs++
+	st.LastRun = start
+	st.LastDuration = clock.Now().Sub(start).String()
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	}
+	if panicked {
+		st.Panics++
+	}
+}
+
+func (s *scheduler) handler(w responseWriter, r *request) error {
+	s.mu.Lock()
+	tasks := s.tasks
+	s.mu.Unlock()
+	stats := make([]taskStats, len(tasks))
+	for i, t := range tasks {
+		t.mu.Lock()
+		stats[i] = t.stats
+		t.mu.Unlock()
+	}
+	return writeJSON(w, 200, stats)
+}
@@ -0,0 +1,478 @@
+package main
+
+// The self test. -self_test serves a small mux of its own over socketpairs
+// inside the process and runs requests at it with the client, so the real
+// parser, mux, response writer and keep-alive handling are exercised end
+// to end without binding a port that could be taken or firewalled. The
+// chaos checks in chaos.go follow, then the event loop's, which do bind a
+// loopback port, since the loop only serves the connections it accepts. It prints a line per check and exits
+// non-zero if any failed, or if any file descriptors were left open.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A check, given a fresh connection to the server.
+type selfTestCase struct {
+	name string
+	run  func(c *clientConn) error
+}
+
+const selfTestMaxBody = 1 << 10
+
+// Written by /stream a piece at a time, too long together to be held back
+// for a Content-Length, so they go out chunked.
+var selfTestStream = []string{
+	strings.Repeat("a", maxPendingBody/2+1),
+	strings.Repeat("b", maxPendingBody/2+1),
+	strings.Repeat("c", maxPendingBody/2+1),
+}
+
+// Sent to /once, the same key each time.
+const selfTestOnce = "POST /once HTTP/1.1\r\nHost: selftest\r\nIdempotency-Key: k\r\nContent-Length: 1\r\n\r\nx"
+
+var selfTestCases = []selfTestCase{
+	{"get", func(c *clientConn) error {
+		return expectResponse(c, "GET", "/hello", nil, 200, "hello\n")
+	}},
+	{"keep-alive", func(c *clientConn) error {
+		for i := 0; i < 3; i++ {
+			if err := expectResponse(c, "GET", "/hello", nil, 200, "hello\n"); err != nil {
+				return fmt.Errorf("request %d: %v", i+1, err)
+			}
+		}
+		if c.closed {
+			return errors.New("connection closed after keep-alive requests")
+		}
+		return nil
+	}},
+	{"head", func(c *clientConn) error {
+		resp, err := c.do("HEAD", "/hello", nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.status != 200 || resp.header.Get("Content-Length") != "6" || len(resp.body) != 0 {
+			return fmt.Errorf("got %d, Content-Length %q and %d bytes of body", resp.status, resp.header.Get("Content-Length"), len(resp.body))
+		}
+		return expectResponse(c, "GET", "/hello", nil, 200, "hello\n")
+	}},
+	{"post body", func(c *clientConn) error {
+		return expectResponse(c, "POST", "/echo", []byte("ping"), 200, "ping")
+	}},
+	{"route params", func(c *clientConn) error {
+		return expectResponse(c, "GET", "/users/42", nil, 200, "user 42\n")
+	}},
+	{"chunked response", func(c *clientConn) error {
+		resp, err := c.do("GET", "/stream", nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.header.Get("Content-Length") != "" {
+			return errors.New("streamed response has a Content-Length")
+		}
+		return expectBody(resp, 200, strings.Join(selfTestStream, ""))
+	}},
+	{"chunked request", func(c *clientConn) error {
+		return expectRaw(c, "POST /echo HTTP/1.1\r\nHost: selftest\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"3\r\npin\r\n1\r\ng\r\n0\r\n\r\n", 200, "ping", false)
+	}},
+	{"chunk size line too long", func(c *clientConn) error {
+		// Refused once it's well past the limit, with no line ending yet.
+		return expectRaw(c, "POST /echo HTTP/1.1\r\nHost: selftest\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			strings.Repeat("0", 2*maxChunkLine), 400, "", true)
+	}},
+	{"chunk size overflow", func(c *clientConn) error {
+		return expectRaw(c, "POST /echo HTTP/1.1\r\nHost: selftest\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"1\r\np\r\n7fffffffffffffff\r\n", 413, "", true)
+	}},
+	{"trailer", func(c *clientConn) error {
+		// Only announced fields are added, and never ones like Host.
+		const req = "GET /header/%s HTTP/1.1\r\nHost: selftest\r\nTransfer-Encoding: chunked\r\nTrailer: X-Note, Host\r\n\r\n" +
+			"1\r\np\r\n0\r\nX-Note: t\r\nHost: evil\r\nX-Other: o\r\n\r\n"
+		for name, want := range map[string]string{"x-note": "t\n", "host": "selftest\n", "x-other": "\n"} {
+			if err := expectRaw(c, fmt.Sprintf(req, name), 200, want, false); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return nil
+	}},
+	{"hop-by-hop", func(c *clientConn) error {
+		// Gone from the request, along with what Connection names, while
+		// the connection itself stays open.
+		const req = "GET /header/%s HTTP/1.1\r\nHost: selftest\r\nConnection: X-Hop\r\nX-Hop: h\r\nTe: trailers\r\n\r\n"
+		for _, name := range []string{"x-hop", "te", "connection"} {
+			if err := expectRaw(c, fmt.Sprintf(req, name), 200, "\n", false); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return nil
+	}},
+	{"not found", func(c *clientConn) error {
+		return expectResponse(c, "GET", "/nope", nil, 404, "")
+	}},
+	{"method not allowed", func(c *clientConn) error {
+		return expectResponse(c, "DELETE", "/hello", nil, 405, "method not allowed\n")
+	}},
+	{"pipelined", func(c *clientConn) error {
+		req := "GET /users/1 HTTP/1.1\r\nHost: selftest\r\n\r\nGET /users/2 HTTP/1.1\r\nHost: selftest\r\n\r\n"
+		if _, err := io.WriteString(c.conn, req); err != nil {
+			return err
+		}
+		for _, want := range []string{"user 1\n", "user 2\n"} {
+			resp, err := readResponse(c.r, "GET")
+			if err != nil {
+				return err
+			}
+			if err := expectBody(resp, 200, want); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"connection close", func(c *clientConn) error {
+		return expectRaw(c, "GET /hello HTTP/1.1\r\nHost: selftest\r\nConnection: close\r\n\r\n", 200, "hello\n", true)
+	}},
+	{"HTTP/1.0", func(c *clientConn) error {
+		return expectRaw(c, "GET /hello HTTP/1.0\r\n\r\n", 200, "hello\n", true)
+	}},
+	{"body too large", func(c *clientConn) error {
+		return expectRaw(c, fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: selftest\r\nContent-Length: %d\r\n\r\n%s",
+			selfTestMaxBody+1, strings.Repeat("x", selfTestMaxBody+1)), 413, "", true)
+	}},
+	{"malformed request line", func(c *clientConn) error {
+		return expectRaw(c, "GET /\r\n\r\n", 400, "malformed request line\n", true)
+	}},
+	{"invalid method", func(c *clientConn) error {
+		return expectRaw(c, "G(E)T / HTTP/1.1\r\nHost: selftest\r\n\r\n", 400, "invalid method\n", true)
+	}},
+	{"HTTP/2.0", func(c *clientConn) error {
+		return expectRaw(c, "GET / HTTP/2.0\r\nHost: selftest\r\n\r\n", 505, "HTTP version not supported\n", true)
+	}},
+	{"malformed header", func(c *clientConn) error {
+		return expectRaw(c, "GET /hello HTTP/1.1\r\nHost selftest\r\n\r\n", 400, "malformed header\n", true)
+	}},
+	{"obsolete line folding", func(c *clientConn) error {
+		return expectRaw(c, "GET /hello HTTP/1.1\r\nHost: selftest\r\nX-Folded: a\r\n b\r\n\r\n", 400, "malformed header\n", true)
+	}},
+	{"header too large", func(c *clientConn) error {
+		// The server closes with the end of the header unread, which can
+		// come as a reset rather than the end of the stream.
+		return expectRaw(c, "GET /hello HTTP/1.1\r\nHost: selftest\r\nX-Big: "+strings.Repeat("x", maxHeaderBytes)+"\r\n\r\n",
+			431, "request header too large\n", false)
+	}},
+	{"headers across requests", func(c *clientConn) error {
+		// Each response has the last request's User-Agent too, as retained
+		// before this one's headers were read over it.
+		last := ""
+		for _, agent := range []string{"a first, longer agent", "second", "third"} {
+			header := textproto.MIMEHeader{"user-AGENT": {agent}, "X-Odd-Name": {"padded\t"}}
+			resp, err := c.do("GET", "/agent", header, nil)
+			if err != nil {
+				return err
+			}
+			if err := expectBody(resp, 200, agent+"|padded|"+last+"\n"); err != nil {
+				return err
+			}
+			last = agent
+		}
+		return nil
+	}},
+	{"panic", func(c *clientConn) error {
+		return expectRaw(c, "GET /panic HTTP/1.1\r\nHost: selftest\r\n\r\n", 500, "internal server error\n", true)
+	}},
+	// A key whose first request panicked is free for a retry, which runs
+	// the handler again and is what later retries get.
+	{"idempotent panic", func(c *clientConn) error {
+		return expectRaw(c, selfTestOnce, 500, "internal server error\n", true)
+	}},
+	{"idempotent retry after panic", func(c *clientConn) error {
+		for i := 0; i < 2; i++ {
+			if err := expectRaw(c, selfTestOnce, 200, "run 2\n", false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+func selfTestMux() *serveMux {
+	m := newServeMux()
+	m.handleGet("/hello", func(w responseWriter, r *request) error {
+		return writeStatus(w, 200, "hello\n")
+	})
+	m.handlePost("/echo", func(w responseWriter, r *request) error {
+		_, err := w.Write(r.body)
+		return err
+	})
+	m.handleGet("/users/:id", func(w responseWriter, r *request) error {
+		return writeStatus(w, 200, "user "+r.param("id")+"\n")
+	})
+	m.handleGet("/stream", func(w responseWriter, r *request) error {
+		for _, piece := range selfTestStream {
+			if _, err := io.WriteString(w, piece); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// Echoes the User-Agent, along with the last one it saw.
+	var lastAgent string
+	m.handleGet("/agent", func(w responseWriter, r *request) error {
+		agent := r.header.Get("User-Agent")
+		body := agent + "|" + r.header.Get("X-Odd-Name") + "|" + lastAgent + "\n"
+		lastAgent = retain(agent)
+		return writeStatus(w, 200, body)
+	})
+	m.handleGet("/header/:name", func(w responseWriter, r *request) error {
+		return writeStatus(w, 200, strings.Join(r.header[textproto.CanonicalMIMEHeaderKey(r.param("name"))], ",")+"\n")
+	})
+	m.handleGet("/panic", func(w responseWriter, r *request) error {
+		panic("self test")
+	})
+	// Panics the first time, and counts its runs after that.
+	runs := 0
+	m.handlePost("/once", func(w responseWriter, r *request) error {
+		if runs++; runs == 1 {
+			panic("self test")
+		}
+		return writeStatus(w, 200, fmt.Sprintf("run %d\n", runs))
+	}, withMiddleware(newIdempotencyCache(time.Minute).middleware))
+	return m
+}
+
+func selfTestConfig() connConfig {
+	return connConfig{
+		idleTimeout:   5 * time.Second,
+		maxBodyBytes:  selfTestMaxBody,
+		headerTimeout: 5 * time.Second,
+		readTimeout:   5 * time.Second,
+		writeTimeout:  5 * time.Second,
+		headerArena:   true,
+	}
+}
+
+// Runs every check, the chaos checks included, and reports whether they
+// all passed.
+func selfTest(out io.Writer) bool {
+	s, err := newServer(nil, normalizeHopByHop(selfTestMux().dispatch), selfTestConfig(), true, false)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL starting the server: %v\n", err)
+		return false
+	}
+	// The server's logging is kept out of the results, and only looked
+	// at for panics that got past serving a request.
+	var logged bytes.Buffer
+	logOut := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(logOut)
+	// Leaks are pinned on the sockets that were left open.
+	if fdTrack == nil {
+		fdTrack = newFDTracker()
+		defer func() { fdTrack = nil }()
+	}
+	start := clock.Now()
+	openFDs()
+	fds := openFDs()
+	total, failed := 0, 0
+	for _, tc := range selfTestCases {
+		total++
+		c, err := s.selfTestConn()
+		if err == nil {
+			err = tc.run(c)
+			c.Close()
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", tc.name, err)
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", tc.name)
+		}
+	}
+	// Every connection's been closed by the client, so the server should
+	// be done with them all.
+	total++
+	if !waitServed(s, 5*time.Second) {
+		failed++
+		fmt.Fprintln(out, "FAIL connections still being served after their clients closed them")
+	}
+	n, f := chaosChecks(out)
+	total, failed = total+n, failed+f
+	n, f = eventLoopChecks(out)
+	total, failed = total+n, failed+f
+	total++
+	if bytes.Contains(logged.Bytes(), []byte("panic serving connection")) {
+		failed++
+		fmt.Fprintln(out, "FAIL the server panicked outside a handler:")
+		for _, line := range strings.SplitAfter(logged.String(), "\n") {
+			if strings.Contains(line, "panic serving connection") {
+				fmt.Fprint(out, "    ", line)
+			}
+		}
+	}
+	total++
+	leaked := fdTrack.openedSince(start)
+	n = len(leaked)
+	if after := openFDs(); fds >= 0 && after-fds > n {
+		n = after - fds
+	}
+	if n > 0 {
+		failed++
+		fmt.Fprintf(out, "FAIL %d file descriptors leaked\n", n)
+		for _, rec := range leaked {
+			fmt.Fprintf(out, "    %v\n", rec)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d checks passed\n", total-failed, total)
+	return failed == 0
+}
+
+// Checks for the event loop, which finds where a request's head ends on
+// its own before parsing it.
+var loopSelfTestCases = []selfTestCase{
+	{"event loop request", func(c *clientConn) error {
+		return expectResponse(c, "GET", "/hello", nil, 200, "hello\n")
+	}},
+	{"event loop LF-only request", func(c *clientConn) error {
+		return expectRaw(c, "GET /hello HTTP/1.1\nHost: selftest\n\n", 200, "hello\n", false)
+	}},
+	{"event loop LF-only request with a body", func(c *clientConn) error {
+		return expectRaw(c, "POST /echo HTTP/1.1\nHost: selftest\nContent-Length: 3\n\nabc", 200, "abc", false)
+	}},
+}
+
+// Runs loopSelfTestCases against an event loop on a loopback port, writing
+// a line for each to out. Windows, with no event loop, skips them.
+func eventLoopChecks(out io.Writer) (total, failed int) {
+	if runtime.GOOS == "windows" {
+		return 0, 0
+	}
+	total++
+	ln, err := newNetSocket(net.IPv4(127, 0, 0, 1), 0, false, false)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL starting the event loop: %v\n", err)
+		return total, 1
+	}
+	s, err := newServer(ln, selfTestMux().dispatch, selfTestConfig(), true, true)
+	if err != nil {
+		ln.Close()
+		fmt.Fprintf(out, "FAIL starting the event loop: %v\n", err)
+		return total, 1
+	}
+	go s.Serve()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(ln.LocalAddr().(*net.TCPAddr).Port))
+	for _, tc := range loopSelfTestCases {
+		total++
+		c, err := dialClient(addr, "selftest", nil, 5*time.Second)
+		if err == nil {
+			err = tc.run(c)
+			c.Close()
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", tc.name, err)
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", tc.name)
+		}
+	}
+	// Shutting down closes the listener and every connection.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		failed++
+		fmt.Fprintf(out, "FAIL shutting down the event loop: %v\n", err)
+	}
+	return total, failed
+}
+
+// Waits up to timeout for s to finish serving its connections, reporting
+// whether it did.
+func waitServed(s *server, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// How many file descriptors the process has open, or -1 if there's no
+// telling.
+func openFDs() int {
+	fis, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fis)
+}
+
+// Serves one end of a socketpair, and connects the client to the other.
+func (s *server) selfTestConn() (*clientConn, error) {
+	cs, ss, err := newSocketPair()
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.serveConn(ss)
+	c := &clientConn{socket: cs, conn: cs, host: "selftest", timeout: 5 * time.Second}
+	c.r = bufio.NewReader(cs)
+	return c, nil
+}
+
+func expectResponse(c *clientConn, method, uri string, body []byte, status int, want string) error {
+	resp, err := c.do(method, uri, nil, body)
+	if err != nil {
+		return err
+	}
+	return expectBody(resp, status, want)
+}
+
+// Writes req as it is and reads the response, which must be followed by
+// the server closing the connection if closes is set.
+func expectRaw(c *clientConn, req string, status int, want string, closes bool) error {
+	c.socket.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := io.WriteString(c.conn, req); err != nil {
+		return err
+	}
+	resp, err := readResponse(c.r, strings.SplitN(req, " ", 2)[0])
+	if err != nil {
+		return err
+	}
+	if err := expectBody(resp, status, want); err != nil {
+		return err
+	}
+	if !closes {
+		return nil
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("connection left open, reading got %v", err)
+	}
+	return nil
+}
+
+func expectBody(resp *clientResponse, status int, want string) error {
+	if resp.status != status {
+		return fmt.Errorf("got status %d, want %d", resp.status, status)
+	}
+	if want != "" && !bytes.Equal(resp.body, []byte(want)) {
+		return fmt.Errorf("got body %q, want %q", resp.body, want)
+	}
+	return nil
+}
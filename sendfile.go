@@ -0,0 +1,52 @@
+package main
+
+// Zero-copy file bodies. fileServer hands the file to sendFile rather than
+// copying it through the writer, and where nothing stands between it and
+// the socket, no filters, TLS or capture, the kernel sends the file
+// straight from the page cache with sendfile(2). Otherwise it's copied as
+// usual. The bytes count as written and sent either way.
+
+import (
+	"io"
+	"os"
+)
+
+// Implemented by writers that can send a file's bytes without them passing
+// through a buffer. sendFile sends n bytes from f's current offset.
+type fileSender interface {
+	sendFile(f *os.File, n int64) (int64, error)
+}
+
+// Sends n bytes of f as the body, which must already have its
+// Content-Length set.
+func (w responseWriter) sendFile(f *os.File, n int64) (int64, error) {
+	s := w.state
+	if s.filters != nil && s.filtered == nil {
+		w.startFilters()
+	}
+	fs, ok := w.conn.(fileSender)
+	if !ok || len(s.filterChain) > 0 || s.head || s.recording || s.header.Get("Content-Length") == "" {
+		return io.CopyN(w, f, n)
+	}
+	if !s.wroteHeader {
+		if err := w.writeHead(); err != nil {
+			return 0, err
+		}
+	}
+	sent, err := fs.sendFile(f, n)
+	s.written += sent
+	s.sent += sent
+	return sent, err
+}
+
+// Passes the file on to the connection once the head is out, if the body
+// isn't being chunked.
+func (c *connWriter) sendFile(f *os.File, n int64) (int64, error) {
+	fs, ok := c.conn.(fileSender)
+	if !ok || !c.headDone || c.chunked || c.req.method == "HEAD" {
+		return io.CopyN(c, f, n)
+	}
+	sent, err := fs.sendFile(f, n)
+	c.written += sent
+	return sent, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Sends n bytes from f's offset with sendfile(2), which moves the offset
+// along. A write deadline is kept the way Write keeps it.
+func (ns *netSocket) sendFile(f *os.File, n int64) (int64, error) {
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var sent int64
+	for sent < n {
+		if !ns.writeDeadline.IsZero() {
+			if err := ns.setTimeout(soSndTimeo, ns.writeDeadline); err != nil {
+				return sent, err
+			}
+		}
+		chunk := n - sent
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		var m int
+		var serr error
+		if err := sc.Read(func(fd uintptr) bool {
+			m, serr = syscall.Sendfile(ns.fd, int(fd), nil, int(chunk))
+			return true
+		}); err != nil {
+			return sent, err
+		}
+		if serr == syscall.EINTR {
+			continue
+		}
+		if serr != nil {
+			return sent, os.NewSyscallError("sendfile", serr)
+		}
+		if m == 0 {
+			// The file is shorter than it was when its length was sent.
+			return sent, io.ErrUnexpectedEOF
+		}
+		sent += int64(m)
+	}
+	return sent, nil
+}
@@ -1,265 +1,2060 @@
 package main
 
-// Simple, single-threaded server using system calls instead of the net library.
+// Simple server using system calls instead of the net library. Each
+// connection is served on its own goroutine unless -concurrent=false, or
+// all of them from one epoll or kqueue loop with -event_loop. It runs on
+// Linux, the BSDs, macOS and, without -event_loop, Windows.
 //
 // Omitted features from the go net package:
 //
-// - TLS
 // - Most error checking
-// - Only supports bodies that close, no persistent or chunked connections
-// - Redirects
-// - Deadlines and cancellation
-// - Non-blocking sockets
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-// netSocket is a file descriptor for a system socket.
+// netSocket is a file descriptor for a system socket. The system calls on
+// it are in socket_unix.go and socket_windows.go.
 type netSocket struct {
 	// System file descriptor.
-	fd int
+	fd sysfd
+	// A vsock socket, which the syscall package can't accept on.
+	vsock bool
+	// The peer's address, when accept had to work it out itself.
+	remote net.Addr
+	// When reads and writes time out, zero for never.
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
 func (ns netSocket) Read(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	n, err := syscall.Read(ns.fd, p)
+	if !ns.readDeadline.IsZero() {
+		if err := ns.setTimeout(soRcvTimeo, ns.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err := sysRead(ns.fd, p)
 	if err != nil {
 		n = 0
 	}
+	if n == 0 && err == nil {
+		// The peer closed its write side.
+		err = io.EOF
+	}
 	return n, err
 }
 
+// Writes all of p, unless the write deadline passes first.
 func (ns netSocket) Write(p []byte) (int, error) {
-	n, err := syscall.Write(ns.fd, p)
-	if err != nil {
-		n = 0
+	written := 0
+	for written < len(p) {
+		if !ns.writeDeadline.IsZero() {
+			if err := ns.setTimeout(soSndTimeo, ns.writeDeadline); err != nil {
+				return written, err
+			}
+		}
+		n, err := sysWrite(ns.fd, p[written:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
 	}
-	return n, err
+	return written, nil
 }
 
 // Creates a new netSocket for the next pending connection request.
 func (ns *netSocket) Accept() (*netSocket, error) {
-	// syscall.ForkLock doc states lock not needed for blocking accept.
-	nfd, _, err := syscall.Accept(ns.fd)
-	if err == nil {
-		syscall.CloseOnExec(nfd)
+	if ns.vsock {
+		return acceptVsock(ns.fd)
 	}
+	nfd, err := sysAccept(ns.fd)
 	if err != nil {
 		return nil, err
 	}
-	return &netSocket{nfd}, nil
+	fdTrack.add(nfd, "connection")
+	return &netSocket{fd: nfd}, nil
 }
 
 func (ns *netSocket) Close() error {
-	return syscall.Close(ns.fd)
+	fdTrack.remove(ns.fd)
+	return sysClose(ns.fd)
+}
+
+// The rest of net.Conn, so crypto/tls can run over a netSocket.
+
+func (ns *netSocket) LocalAddr() net.Addr {
+	sa, err := syscall.Getsockname(ns.fd)
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa)
+}
+
+func (ns *netSocket) RemoteAddr() net.Addr {
+	if ns.remote != nil {
+		return ns.remote
+	}
+	sa, err := syscall.Getpeername(ns.fd)
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa)
+}
+
+func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		// A link-local address only means something with its interface.
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	}
+	return nil
+}
+
+// The client's IP address, nil if it didn't connect over TCP.
+func (r *request) remoteIP() net.IP {
+	if tcp, ok := r.remoteAddr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// Deadlines are kept with socket timeouts, which limit a single read or
+// write, so each call first sets its timeout to whatever time is left. A
+// client trickling in a byte at a time still runs out. A zero t waits
+// forever. Calls that time out fail with errSocketTimeout.
+func (ns *netSocket) SetDeadline(t time.Time) error {
+	if err := ns.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return ns.SetWriteDeadline(t)
 }
 
-// Creates a new socket file descriptor, binds it and listens on it.
-func newNetSocket(ip net.IP, port int) (*netSocket, error) {
+func (ns *netSocket) SetReadDeadline(t time.Time) error {
+	ns.readDeadline = t
+	return ns.setTimeout(soRcvTimeo, t)
+}
+
+func (ns *netSocket) SetWriteDeadline(t time.Time) error {
+	ns.writeDeadline = t
+	return ns.setTimeout(soSndTimeo, t)
+}
+
+func (ns netSocket) setTimeout(opt int, t time.Time) error {
+	var d time.Duration
+	if !t.IsZero() {
+		if d = time.Until(t); d <= 0 {
+			d = time.Microsecond // Zero would mean no timeout.
+		}
+	}
+	return os.NewSyscallError("setsockopt", setSockTimeout(ns.fd, opt, d))
+}
+
+// Creates a new socket file descriptor, binds it and listens on it. An
+// IPv6 address gets an IPv6 socket, which also accepts IPv4 connections
+// unless v6Only is set; binding :: with it unset serves both families.
+// With reusePort, other sockets made the same way can bind the address
+// too, and the kernel shares connections out between them.
+func newNetSocket(ip net.IP, port int, v6Only, reusePort bool) (*netSocket, error) {
+	// AF_INET = Address Family for IPv4, AF_INET6 for IPv6
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else if ip6 := ip.To16(); ip6 != nil {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip6)
+		sa = sa6
+	} else {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+
 	// ForkLock docs state that socket syscall requires the lock.
 	syscall.ForkLock.Lock()
-	// AF_INET = Address Family for IPv4
 	// SOCK_STREAM = virtual circuit service
 	// 0: the protocol for SOCK_STREAM, there's only 1.
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
 	if err != nil {
 		return nil, os.NewSyscallError("socket", err)
 	}
-	syscall.ForkLock.Unlock()
 
-	// Allow reuse of recently-used addresses.
-	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		syscall.Close(fd)
+	if err = setReuseAddr(fd); err != nil {
+		sysClose(fd)
 		return nil, os.NewSyscallError("setsockopt", err)
 	}
-
-	sa := &syscall.SockaddrInet4{Port: port}
-	copy(sa.Addr[:], ip)
+	if reusePort {
+		if err = setReusePort(fd); err != nil {
+			sysClose(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if family == syscall.AF_INET6 {
+		// Systems disagree on the default, so always set it.
+		v6 := 0
+		if v6Only {
+			v6 = 1
+		}
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6); err != nil {
+			sysClose(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
 
 	// Bind the socket to a port
 	if err = syscall.Bind(fd, sa); err != nil {
+		sysClose(fd)
 		return nil, os.NewSyscallError("bind", err)
 	}
 
 	// Listen for incoming connections.
 	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		sysClose(fd)
 		return nil, os.NewSyscallError("listen", err)
 	}
 
+	fdTrack.add(fd, "listener")
 	return &netSocket{fd: fd}, nil
 }
 
-// Facade in front of netSocket for nicer types and to log writes.
+// Facade in front of netSocket for nicer types and to log writes. Handlers
+// set the status with WriteHeader and headers with Header, and the head is
+// serialized ahead of the first body bytes.
 type responseWriter struct {
-	ns *netSocket
+	// The connection the response is written to.
+	conn io.Writer
+	// Shared by copies of the writer, since handlers take it by value.
+	state *responseState
+}
+
+type responseState struct {
+	status      int // 0 until WriteHeader, and then 200 if it's never called.
+	header      textproto.MIMEHeader
+	wroteHeader bool
+	// Body bytes held back while the whole body might still be small enough
+	// to send with a Content-Length the handler didn't set.
+	pending []byte
+	// Set on writers from recordResponse, which keep the head in state
+	// instead of serializing it.
+	recording bool
+	// Body bytes written by the handler.
+	written int64
+	// Body bytes sent, after any filters.
+	sent int64
+	// Set for responses to HEAD, whose bodies are only counted, so the
+	// Content-Length is what GET would get.
+	head     bool
+	headBody int64
+	// Output filters for the body, set up by the first write to go through
+	// filtered. The chain holds those that applied, outermost last.
+	filters       []stagedFilter
+	filterRequest *request
+	filtered      io.Writer
+	filterChain   []io.WriteCloser
+	// Called with the header just before the head is serialized, for
+	// headers that report on the response so far. With holdHead, bodies
+	// whose Content-Length is small enough to hold back are, so their head
+	// goes out once the handler is done.
+	onHead   func(header textproto.MIMEHeader)
+	holdHead bool
+}
+
+// Bodies up to this size get a Content-Length even if the handler didn't
+// set one. Longer ones are sent as they're written.
+const maxPendingBody = 4 << 10
+
+func newResponseWriter(conn io.Writer) responseWriter {
+	return responseWriter{conn: conn, state: &responseState{header: make(textproto.MIMEHeader)}}
+}
+
+// The response headers. Changes after the first Write have no effect.
+func (w responseWriter) Header() textproto.MIMEHeader {
+	return w.state.header
+}
+
+// Sets the response status. Only the first call counts.
+func (w responseWriter) WriteHeader(code int) {
+	if w.state.status != 0 {
+		log.Printf("superfluous WriteHeader(%d) after %d", code, w.state.status)
+		return
+	}
+	w.state.status = code
 }
 
 func (w responseWriter) Write(b []byte) (int, error) {
-	log.Print("writing: " + string(b))
-	return (*w.ns).Write(b)
+	s := w.state
+	s.written += int64(len(b))
+	if s.filters != nil {
+		if s.filtered == nil {
+			w.startFilters()
+		}
+		return s.filtered.Write(b)
+	}
+	return w.writeBody(b)
+}
+
+// Writes body bytes that have been through any filters.
+func (w responseWriter) writeBody(b []byte) (int, error) {
+	s := w.state
+	if s.head && !s.recording {
+		if !s.wroteHeader {
+			s.headBody += int64(len(b))
+		}
+		return len(b), nil
+	}
+	s.sent += int64(len(b))
+	if !s.wroteHeader {
+		if s.mayHold(len(b)) {
+			s.pending = append(s.pending, b...)
+			return len(b), nil
+		}
+		if err := w.writeHead(); err != nil {
+			return 0, err
+		}
+	}
+	return w.conn.Write(b)
+}
+
+// Whether n more body bytes can be held back rather than sending the head:
+// while the body might still fit in pending, unless its Content-Length
+// says it won't or, without holdHead, says how long it is at all.
+func (s *responseState) mayHold(n int) bool {
+	if s.recording || len(s.pending)+n > maxPendingBody {
+		return false
+	}
+	cl := s.header.Get("Content-Length")
+	if cl == "" {
+		return true
+	}
+	size, err := strconv.ParseInt(cl, 10, 64)
+	return s.holdHead && err == nil && size <= maxPendingBody
+}
+
+// Serializes the status line and headers along with any pending body.
+func (w responseWriter) writeHead() error {
+	s := w.state
+	s.wroteHeader = true
+	if s.status == 0 {
+		s.status = 200
+	}
+	if s.recording {
+		return nil
+	}
+	if s.onHead != nil {
+		s.onHead(s.header)
+	}
+	if s.header.Get("Date") == "" {
+		s.header.Set("Date", clock.Now().UTC().Format(httpDate))
+	}
+	proto := "HTTP/1.1"
+	framer, ok := w.conn.(headFramer)
+	if ok {
+		proto = framer.frameHead(s.status, s.header)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s\r\n", proto, s.status, statusText[s.status])
+	keys := make([]string, 0, len(s.header))
+	for k := range s.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range s.header[k] {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	b.WriteString("\r\n")
+	pending := s.pending
+	s.pending = nil
+	if !ok {
+		b.Write(pending)
+		_, err := w.conn.Write(b.Bytes())
+		return err
+	}
+	if err := framer.writeHead(b.Bytes()); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := w.conn.Write(pending)
+	return err
+}
+
+// Sends the head, if the handler didn't write a body big enough to send
+// it already, once the handler has returned.
+func (w responseWriter) finish() error {
+	s := w.state
+	if err := w.closeFilters(); err != nil {
+		return err
+	}
+	if s.wroteHeader {
+		return nil
+	}
+	if s.header.Get("Content-Length") == "" && bodyAllowed(s.status) {
+		s.header.Set("Content-Length", strconv.FormatInt(int64(len(s.pending))+s.headBody, 10))
+	}
+	return w.writeHead()
+}
+
+// Forgets a response that hasn't been sent yet, so another can replace it.
+func (w responseWriter) reset() {
+	*w.state = responseState{header: make(textproto.MIMEHeader), recording: w.state.recording, head: w.state.head, onHead: w.state.onHead, holdHead: w.state.holdHead}
+}
+
+// Reports whether a response with the status may have a body.
+func bodyAllowed(code int) bool {
+	return !(code >= 100 && code < 200 || code == 204 || code == 304)
+}
+
+// A response captured in memory by recordResponse.
+type recordedResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Runs h with a writer that captures the response instead of sending it,
+// for middleware that edit or store responses.
+func recordResponse(h handlerFunc, r *request) (*recordedResponse, error) {
+	var body bytes.Buffer
+	w := newResponseWriter(&body)
+	w.state.recording = true
+	if err := h(w, r); err != nil {
+		return nil, err
+	}
+	w.finish()
+	return &recordedResponse{status: w.state.status, header: w.state.header, body: body.Bytes()}, nil
+}
+
+// Sends the recorded response to w. Headers already set on w are kept
+// unless the recording has its own value for them.
+func (rec *recordedResponse) writeTo(w responseWriter) error {
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.status)
+	_, err := w.Write(rec.body)
+	return err
 }
 
 // Type adapter to allow use of ordinary functions as handlers.
 type handlerFunc func(responseWriter, *request) error
 
-type serveMux map[string]handlerFunc
+type serveMux struct {
+	routes     map[routeKey]*route
+	hooks      []dispatchHook
+	middleware []middleware // Wraps whatever dispatch picks, after route middleware.
+	// Which way to redirect a path that only matches a route with a
+	// trailing slash added or removed: slashAdd, slashStrip, or slashBoth.
+	// "" matches paths as they are.
+	slashes string
+}
+
+const (
+	slashAdd   = "add"
+	slashStrip = "strip"
+	slashBoth  = "both"
+)
+
+// Routes are registered per pattern and method, with "" for any method.
+type routeKey struct {
+	method  string
+	pattern string
+}
+
+// A registered pattern along with everything registered with it.
+type route struct {
+	pattern    string
+	method     string // "" if the route takes every method.
+	handler    handlerFunc
+	middleware []middleware
+	docs       []apiOperation
+	priority   priority
+	serve      handlerFunc // handler wrapped in its middleware
+	// The largest body the route's requests may have in place of the
+	// server's limit, if hasMaxBody is set. 0 for no limit.
+	maxBody    int64
+	hasMaxBody bool
+}
+
+// Configures a route when it's registered with serveMux.handle.
+type routeOption func(*route)
+
+var muxes = newServeMux()
 
-var muxes = make(serveMux)
+func newServeMux() *serveMux {
+	return &serveMux{routes: make(map[routeKey]*route)}
+}
+
+// Registers handler for requests with any method whose path starts with
+// pattern.
+func (m *serveMux) handle(pattern string, handler handlerFunc, opts ...routeOption) {
+	m.handleMethod("", pattern, handler, opts...)
+}
+
+// Registers handler for requests with method whose path starts with
+// pattern. A GET route also serves HEAD unless HEAD has its own.
+func (m *serveMux) handleMethod(method, pattern string, handler handlerFunc, opts ...routeOption) {
+	rt := &route{pattern: pattern, method: method, handler: handler, priority: priorityNormal}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	rt.serve = chain(handler, rt.middleware)
+	m.routes[routeKey{method, pattern}] = rt
+}
+
+// Limits the route's request bodies to max bytes, 0 for no limit, instead
+// of the server's -max_body_bytes. It's applied as the body arrives, once
+// the head has been read.
+func withMaxBody(max int64) routeOption {
+	return func(rt *route) {
+		rt.maxBody, rt.hasMaxBody = max, true
+	}
+}
+
+// The body limit of the route req would go to, and whether it has one of
+// its own. Only req's method and URI need be set.
+func (m *serveMux) bodyLimit(req *request) (int64, bool) {
+	rt, _, err := m.findRoute(&request{method: req.method, uri: req.uri})
+	if err != nil || !rt.hasMaxBody {
+		return 0, false
+	}
+	return rt.maxBody, true
+}
+
+func (m *serveMux) handleGet(pattern string, handler handlerFunc, opts ...routeOption) {
+	m.handleMethod("GET", pattern, handler, opts...)
+}
 
-func (m serveMux) handle(pattern string, handler handlerFunc) {
-	m[pattern] = handler
+func (m *serveMux) handlePost(pattern string, handler handlerFunc, opts ...routeOption) {
+	m.handleMethod("POST", pattern, handler, opts...)
 }
 
-// Finds the a handler that matches the request path.
-// Picks the longest handler in case of a tie.
-func (m serveMux) findHandler(r *request) (handlerFunc, error) {
-	var h handlerFunc = nil
-	var l = 0
-	for k, v := range m {
-		if strings.HasPrefix(r.uri, k) {
-			log.Printf("Found handler %s that matched uri: %s", k, r.uri)
-			if len(k) > l {
-				l = len(k)
-				h = v
+// Adds middleware that wraps every handler dispatch runs, including the
+// ones answering 404 and 405. The first middleware added runs first, before
+// any the route has of its own.
+func (m *serveMux) use(mws ...middleware) {
+	m.middleware = append(m.middleware, mws...)
+}
+
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// Finds the a route that matches the request path.
+// Picks the longest route in case of a tie, and then the route for the
+// request's method, or failing that one for every method. If the path
+// matches but no route takes the method, it fails with
+// errMethodNotAllowed and the methods that would have been allowed.
+func (m *serveMux) findRoute(r *request) (*route, []string, error) {
+	var l = -1
+	var pattern string
+	// A pattern that matches the whole path, with parameters or without,
+	// beats every prefix.
+	var params map[string]string
+	best := -1
+	rawPath := r.uri
+	if i := strings.IndexAny(rawPath, "?#"); i >= 0 {
+		rawPath = rawPath[:i]
+	}
+	for k := range m.routes {
+		var p map[string]string
+		score, ok := 0, false
+		if isParamPattern(k.pattern) {
+			p, score, ok = matchParams(k.pattern, rawPath)
+		} else if k.pattern == rawPath {
+			// Every segment is literal, so it outranks any parameter.
+			score, ok = strings.Count(k.pattern, "/")+1, true
+		}
+		if ok {
+			if score > best || score == best && len(k.pattern) > len(pattern) {
+				params, best, pattern = p, score, k.pattern
+			}
+			continue
+		}
+		if best < 0 && !isParamPattern(k.pattern) && strings.HasPrefix(r.uri, k.pattern) {
+			if len(k.pattern) > l {
+				l = len(k.pattern)
+				pattern = k.pattern
+			}
+		}
+	}
+	if l < 0 && best < 0 {
+		return nil, nil, errors.New("no handler for path: " + r.uri)
+	}
+	r.params = params
+	if rt := m.routes[routeKey{r.method, pattern}]; rt != nil {
+		return rt, nil, nil
+	}
+	if rt := m.routes[routeKey{"", pattern}]; rt != nil {
+		return rt, nil, nil
+	}
+	if rt := m.routes[routeKey{"GET", pattern}]; rt != nil && r.method == "HEAD" {
+		return rt, nil, nil
+	}
+	var allow []string
+	for k := range m.routes {
+		if k.pattern == pattern {
+			allow = append(allow, k.method)
+			if k.method == "GET" && m.routes[routeKey{"HEAD", pattern}] == nil {
+				allow = append(allow, "HEAD")
+			}
+		}
+	}
+	sort.Strings(allow)
+	return nil, allow, errMethodNotAllowed
+}
+
+// Reports whether a route's pattern matches all of rawPath, rather than
+// just a prefix of it.
+func (m *serveMux) matchesWhole(rawPath string) bool {
+	for k := range m.routes {
+		if k.pattern == rawPath {
+			return true
+		}
+		if isParamPattern(k.pattern) {
+			if _, _, ok := matchParams(k.pattern, rawPath); ok {
+				return true
 			}
 		}
 	}
-	if h == nil {
-		return nil, errors.New("no handler for path: " + r.uri)
+	return false
+}
+
+// Returns the URI to redirect the request to, if no route matches its
+// path as it is but one would with the trailing slash added or removed,
+// the way m.slashes allows. An /assets/ prefix route then also answers
+// /assets, and /hello answers /hello/.
+func (m *serveMux) slashRedirect(r *request) (string, bool) {
+	rawPath := r.uri
+	if i := strings.IndexAny(rawPath, "?#"); i >= 0 {
+		rawPath = rawPath[:i]
+	}
+	if m.slashes == "" || rawPath == "/" || m.matchesWhole(rawPath) {
+		return "", false
+	}
+	var alt string
+	switch trailing := strings.HasSuffix(rawPath, "/"); {
+	case !trailing && m.slashes != slashStrip:
+		alt = rawPath + "/"
+	case trailing && m.slashes != slashAdd:
+		alt = strings.TrimSuffix(rawPath, "/")
+	default:
+		return "", false
 	}
-	return h, nil
+	if !m.matchesWhole(alt) {
+		return "", false
+	}
+	if r.rawQuery != "" {
+		alt += "?" + r.rawQuery
+	}
+	return alt, true
 }
 
 // Writes the response using the handler that best matches the request.
-func (m serveMux) dispatch(w responseWriter, r *request) error {
-	h, err := m.findHandler(r)
-	if err != nil {
-		return err
+func (m *serveMux) dispatch(w responseWriter, r *request) error {
+	start := time.Now()
+	rt, allow, err := m.findRoute(r)
+	target, slash := m.slashRedirect(r)
+	if slash {
+		rt, err = nil, nil
+	}
+	matched := time.Now()
+	for _, h := range m.hooks {
+		if h.before != nil {
+			h.before(r, rt)
+		}
+	}
+	var h handlerFunc
+	switch {
+	case slash:
+		// 308 so the method and body survive.
+		code := 301
+		if r.method != "GET" && r.method != "HEAD" {
+			code = 308
+		}
+		h = func(w responseWriter, r *request) error {
+			return redirect(w, r, target, code)
+		}
+	case err == nil:
+		h = rt.serve
+	case err == errMethodNotAllowed:
+		h = func(w responseWriter, r *request) error {
+			return writeStatus(w, 405, "method not allowed\n", "Allow: "+strings.Join(allow, ", "))
+		}
+	default:
+		h = notFound
 	}
-	return h(w, r)
+	err = chain(h, m.middleware)(w, r)
+	t := dispatchTiming{route: matched.Sub(start), handler: time.Since(matched)}
+	for i := len(m.hooks) - 1; i >= 0; i-- {
+		if h := m.hooks[i]; h.after != nil {
+			h.after(r, rt, t, err)
+		}
+	}
+	return err
 }
 
 func writeHtml(f func(*request) string) handlerFunc {
 	return func(w responseWriter, r *request) error {
 		html := f(r)
-		io.WriteString(w, "HTTP/1.0 200 OK\r\n")
-		io.WriteString(w, "Content-Type: text/html; charset=utf-8\r\n")
-		fmt.Fprintf(w, "Content-Length: %d\r\n", len(html))
-		io.WriteString(w, "\r\n")
-		io.WriteString(w, html)
-		return nil
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(html)))
+		_, err := io.WriteString(w, html)
+		return err
 	}
 }
 
-func notFound(w responseWriter, r *request) error {
-	_, err := io.WriteString(w, "HTTP/1.0 404 Not Found\r\n"+
-		"Content-Type: text/plain; charset=utf-8\r\n"+
-		"Content-Length: 0\r\n"+
-		"Connection: close\r\n"+
-		"\r\n")
+// Writes v as an indented JSON response with the given status code.
+func writeJSON(w responseWriter, code int, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	return err
+}
+
+// Reason phrases for the status codes the server writes.
+var statusText = map[int]string{
+	200: "OK",
+	206: "Partial Content",
+	304: "Not Modified",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	409: "Conflict",
+	413: "Payload Too Large",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	422: "Unprocessable Entity",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	505: "HTTP Version Not Supported",
+}
+
+// Writes a complete plain text response. Each extra header is a full
+// "Name: value" line.
+func writeStatus(w responseWriter, code int, body string, extraHeaders ...string) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, h := range extraHeaders {
+		if i := strings.IndexByte(h, ':'); i >= 0 {
+			w.Header().Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	_, err := io.WriteString(w, body)
 	return err
 }
 
+func notFound(w responseWriter, r *request) error {
+	return writeStatus(w, 404, "")
+}
+
 type request struct {
 	method string // GET, POST, etc.
 	header textproto.MIMEHeader
 	body   []byte
 	uri    string // The raw URI from the request
 	proto  string // "HTTP/1.1"
+
+	// How long each phase of serving the request took, in order.
+	timings []phaseTiming
+	// "hit" or "miss" if a response cache was consulted.
+	cacheStatus string
+	// Who the request was authenticated as, empty if it wasn't.
+	principal string
+	// What the TLS handshake settled on, nil if the request didn't come
+	// over TLS.
+	tls *tls.ConnectionState
+	// The request URI split up by setURI. path is unescaped.
+	path     string
+	rawQuery string
+	fragment string
+	// Values of the route pattern's parameters, by name.
+	params map[string]string
+	// Parsed on first use.
+	queryCache    url.Values
+	formCache     url.Values
+	multipartForm *multipart.Form
+
+	// The client's address, and the one it connected to, nil if they
+	// aren't known.
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// When the first byte of the request was read.
+	start time.Time
+	// The client's country from the GeoIP database, if one is in use.
+	country string
+	// Done when the request is abandoned, see context.go.
+	ctx context.Context
 }
 
-func parseRequest(c *netSocket) (*request, error) {
-	b := bufio.NewReader(*c)
+var (
+	errBodyTooLarge  = errors.New("request body too large")
+	errBadRequestURI = errors.New("invalid request URI")
+)
+
+// A request too malformed to serve, or to find where the next one starts.
+// It's answered with status, the message as the body, and a close.
+type badRequestError struct {
+	status int
+	msg    string
+}
+
+func (e *badRequestError) Error() string { return e.msg }
+
+func (e *badRequestError) serve(w responseWriter, r *request) error {
+	return writeStatus(w, e.status, e.msg+"\n", "Connection: close")
+}
+
+func badRequest(msg string) error { return &badRequestError{400, msg} }
+
+// Reads the next request from b, which persists across the requests on a
+// connection so bytes buffered past one request aren't lost. A body over
+// maxBody(req) bytes, unless that's 0, fails with errBodyTooLarge along with
+// the request minus its body. A URI that doesn't unescape fails with
+// errBadRequestURI along with the rest of the request, all of it read. One
+// that's malformed fails with a *badRequestError along with what of it was
+// read, whose reading can't go on. The headers go in arena, unless it's
+// nil, as views valid until the next request on the connection. headersRead,
+// unless nil, is called between the headers and the body.
+func parseRequest(b *bufio.Reader, maxBody func(*request) int64, arena *headerArena, headersRead func()) (*request, error) {
+	req, err := readRequest(b, maxBody, arena, headersRead)
+	if err == nil && req.setURI(req.uri) != nil {
+		err = errBadRequestURI
+	}
+	return req, err
+}
+
+func readRequest(b *bufio.Reader, maxBody func(*request) int64, arena *headerArena, headersRead func()) (*request, error) {
 	tp := textproto.NewReader(b)
 	req := new(request)
 
+	// The whole head is read before any of it is parsed, so it's held to
+	// maxHeaderBytes however it's parsed.
+	var head []byte
+	if arena != nil {
+		head = arena.reset()
+	}
+	head, err := readHead(head, b)
+	if arena != nil {
+		arena.buf = head
+	}
+	var bad *badRequestError
+	if errors.As(err, &bad) {
+		return req, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	// First line: parse "GET /index.html HTTP/1.0"
-	var s string
-	s, _ = tp.ReadLine()
+	eol := bytes.IndexByte(head, '\n')
+	s := string(bytes.TrimRight(head[:eol], "\r"))
 	sp := strings.Split(s, " ")
+	if len(sp) != 3 || sp[1] == "" {
+		return req, badRequest("malformed request line")
+	}
 	req.method, req.uri, req.proto = sp[0], sp[1], sp[2]
+	if !isToken(req.method) {
+		return req, badRequest("invalid method")
+	}
+	major, ok := parseHTTPVersion(req.proto)
+	if !ok {
+		return req, badRequest("malformed HTTP version")
+	}
+	if major != 1 {
+		return req, &badRequestError{505, "HTTP version not supported"}
+	}
 
 	// Parse headers
-	mimeHeader, _ := tp.ReadMIMEHeader()
+	var mimeHeader textproto.MIMEHeader
+	if arena != nil {
+		mimeHeader, err = parseHeader(head[eol+1:])
+	} else {
+		mimeHeader, err = textproto.NewReader(bufio.NewReader(bytes.NewReader(head[eol+1:]))).ReadMIMEHeader()
+	}
+	if _, ok := err.(textproto.ProtocolError); ok {
+		return req, badRequest("malformed header")
+	}
+	if err != nil {
+		return req, err
+	}
 	req.header = mimeHeader
+	if headersRead != nil {
+		headersRead()
+	}
+	limit := maxBody(req)
 
-	// Parse body
-	if req.method == "GET" || req.method == "HEAD" {
+	// Parse body. Without a Content-Length or chunked encoding a request has
+	// no body.
+	if te := req.header.Get("Transfer-Encoding"); te != "" {
+		// A length alongside chunking is how requests get smuggled past
+		// proxies that disagree about which one wins.
+		if req.header.Get("Content-Length") != "" {
+			return req, badRequest("both Transfer-Encoding and Content-Length")
+		}
+		if !strings.EqualFold(te, "chunked") {
+			return req, &badRequestError{501, "unsupported Transfer-Encoding"}
+		}
+		body, trailer, err := readChunked(tp, limit)
+		if err == errBodyTooLarge {
+			return req, err
+		}
+		if err == errBadChunk {
+			return req, badRequest("malformed chunked body")
+		}
+		if errors.As(err, &bad) {
+			return req, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		mergeTrailer(req.header, trailer)
+		req.header.Del("Transfer-Encoding")
+		req.body = body
 		return req, nil
 	}
-	body, err := ioutil.ReadAll(b)
-	if err != nil {
-		return nil, err
+	if cl := req.header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return req, badRequest("invalid Content-Length")
+		}
+		if limit > 0 && n > limit {
+			return req, errBodyTooLarge
+		}
+		req.body = make([]byte, n)
+		if _, err := io.ReadFull(b, req.body); err != nil {
+			return nil, err
+		}
 	}
-	req.body = body
 	return req, nil
 }
 
+// Largest request head, the request line and headers together.
+const maxHeaderBytes = 1 << 20
+
+// Reads the request line and header lines from b up to the blank line that
+// ends them, onto buf, line endings and all. A head over maxHeaderBytes
+// fails with a *badRequestError, as soon as it's gone over.
+func readHead(buf []byte, b *bufio.Reader) ([]byte, error) {
+	n := len(buf)
+	for {
+		start := len(buf)
+		for {
+			frag, err := b.ReadSlice('\n')
+			if len(buf)-n+len(frag) > maxHeaderBytes {
+				return buf, &badRequestError{431, "request header too large"}
+			}
+			buf = append(buf, frag...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				return buf, err
+			}
+			break
+		}
+		if len(bytes.TrimRight(buf[start:], "\r\n")) == 0 {
+			return buf, nil
+		}
+	}
+}
+
+// Whether s is an HTTP token, as methods and header names are.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// The major version in a protocol like HTTP/1.1, and whether it's in that
+// form at all.
+func parseHTTPVersion(proto string) (int, bool) {
+	if len(proto) != len("HTTP/1.1") || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, false
+	}
+	major, minor := proto[5], proto[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, false
+	}
+	return int(major - '0'), true
+}
+
+func badRequestURI(w responseWriter, r *request) error {
+	return writeStatus(w, 400, "invalid request URI\n")
+}
+
+// Answers a request whose body was refused. The rest of the body is still
+// unread, so the connection can't be reused.
+func bodyTooLarge(w responseWriter, r *request) error {
+	return writeStatus(w, 413, "request body too large\n", "Connection: close")
+}
+
 func main() {
-	ipFlag := flag.String("ip_addr", "127.0.0.1", "The IP address to use")
+	ipFlag := flag.String("ip_addr", "127.0.0.1", "The IP address to use, IPv4 or IPv6. :: listens on every address of both.")
+	ipv6OnlyFlag := flag.Bool("ipv6_only", false, "Accept only IPv6 connections on an IPv6 -ip_addr.")
 	portFlag := flag.Int("port", 8080, "The port to use.")
+	concurrentFlag := flag.Bool("concurrent", true,
+		"Serve each connection on its own goroutine instead of one at a time.")
+	redirectsFlag := flag.String("redirects", "",
+		"Path to a redirect map file, reloaded on SIGHUP.")
+	trailingSlashFlag := flag.String("trailing_slash", "",
+		"Redirect paths that only match a route with a trailing slash added (add), removed (strip), or either (both).")
+	uploadDirFlag := flag.String("upload_dir", "",
+		"Directory for files posted to /upload. Disabled if empty.")
+	uploadMaxFlag := flag.Int64("upload_max_bytes", 32<<20,
+		"Maximum size of an upload request, in place of -max_body_bytes; 0 for no limit.")
+	uploadExtsFlag := flag.String("upload_exts", "",
+		"Comma separated file extensions allowed for uploads, empty for any.")
+	uploadAuthFlag := flag.String("upload_auth", "",
+		"Basic auth credentials required for /upload as user:password. -upload_dir needs these or -api_keys.")
+	kvFlag := flag.Bool("kv", false, "Serve the demo key-value store at /kv/.")
+	graphqlFlag := flag.Bool("graphql", false, "Serve the demo GraphQL schema at /graphql.")
+	graphiqlFlag := flag.Bool("graphiql", false, "Serve the GraphiQL IDE to browsers at /graphql.")
+	graphqlMaxFlag := flag.Int("graphql_max_bytes", 64<<10, "Largest GraphQL request body or query accepted at /graphql.")
+	openAPIFlag := flag.Bool("openapi", false, "Serve the OpenAPI document for documented routes at /openapi.json.")
+	swaggerUIFlag := flag.Bool("swagger_ui", false, "Serve Swagger UI for the OpenAPI document at /docs.")
+	printRoutesFlag := flag.Bool("print_routes", false, "Print the route table and exit.")
+	debugRoutesFlag := flag.Bool("debug_routes", false, "Serve the route table as JSON at /debug/routes.")
+	debugFDsFlag := flag.Bool("debug_fds", false,
+		"Track every socket opened and closed, and list them with the process's fd table at /debug/fds.")
+	replayFlag := flag.String("replay", "",
+		"Replay the requests in this JSON access log or HAR file against -replay_target, print how they went and exit.")
+	replayTargetFlag := flag.String("replay_target", "http://127.0.0.1:8080", "The server -replay sends requests to.")
+	replaySpeedFlag := flag.Float64("replay_speed", 1,
+		"How many times faster than recorded -replay sends requests, 0 for as fast as they're answered.")
+	replayConcurrencyFlag := flag.Int("replay_concurrency", 64, "Requests -replay may have outstanding at once.")
+	selfTestFlag := flag.Bool("self_test", false,
+		"Run requests at an in-process server over socketpairs, print which checks passed and exit.")
+	signingKeyFlag := flag.String("url_signing_key", "",
+		"Secret key for signed URLs; if set /static/ and /download/ only serve URLs signed with it.")
+	signURLFlag := flag.String("sign_url", "",
+		"Print a signed URL for this path using -url_signing_key and exit.")
+	signMethodFlag := flag.String("sign_method", "GET", "The method a URL printed by -sign_url is valid for.")
+	signTTLFlag := flag.Duration("sign_ttl", time.Hour, "How long a URL printed by -sign_url is valid for.")
+	idempotencyTTLFlag := flag.Duration("idempotency_ttl", 0,
+		"How long to replay responses to POSTs with an Idempotency-Key, 0 to disable.")
+	verifyDigestsFlag := flag.Bool("verify_digests", false,
+		"Reject request bodies that don't match their Content-MD5, Digest or Content-Digest headers.")
+	digestResponsesFlag := flag.Bool("digest_responses", false,
+		"Add a Content-Digest header to responses from endpoints that accept request bodies.")
+	signatureKeysFlag := flag.String("signature_keys", "",
+		"File of keys for verifying HTTP message signatures on endpoints that accept request bodies. Disabled if empty.")
+	signatureCoversFlag := flag.String("signature_covers", "@method,@authority,@path",
+		"Comma separated components a message signature must cover.")
+	signatureMaxAgeFlag := flag.Duration("signature_max_age", 5*time.Minute,
+		"Oldest message signature accepted, 0 for any age.")
+	dailyQuotaFlag := flag.Int64("daily_quota", 0,
+		"Requests each authenticated principal may make per UTC day, 0 for no limit.")
+	monthlyQuotaFlag := flag.Int64("monthly_quota", 0,
+		"Requests each authenticated principal may make per UTC month, 0 for no limit.")
+	downloadDirFlag := flag.String("download_dir", "",
+		"Directory whose subdirectories can be downloaded as tarballs from /download/. Disabled if empty.")
+	staticDirFlag := flag.String("static_dir", "",
+		"Directory of files to serve at /static/. Disabled if empty.")
+	staticDotfilesFlag := flag.Bool("static_dotfiles", false,
+		"List and serve files under -static_dir and -locations whose names start with a dot, like .env or .git, which are hidden otherwise.")
+	staticSymlinksFlag := flag.String("static_symlinks", symlinksBeneath,
+		"Symlinks to follow under -static_dir and -locations: none, beneath (those resolving inside the root) or any.")
+	locationsFlag := flag.String("locations", "",
+		"Path to a file of file server locations, each a URL prefix with a root or alias directory and optional try_files.")
+	mediaDirFlag := flag.String("media_dir", "",
+		"Directory of images to serve resized at /media/. Disabled if empty.")
+	mediaCacheFlag := flag.String("media_cache_dir", "",
+		"Directory for cached resized images, a new private one under the temp directory if empty.")
+	mediaCacheBytesFlag := flag.Int64("media_cache_bytes", 256<<20,
+		"Most bytes of resized images to keep in -media_cache_dir.")
+	serverTimingFlag := flag.Bool("server_timing", false,
+		"Report phase durations and cache status in a Server-Timing response header.")
+	assetsDirFlag := flag.String("assets_dir", "",
+		"Directory of static assets to serve fingerprinted at /assets/. Disabled if empty.")
+	certDirFlag := flag.String("cert_dir", "certs",
+		"Directory holding the local development CA and the certificates issued from it, which -https serves without -tls_cert.")
+	issueCertFlag := flag.String("issue_cert", "",
+		"Issue a certificate from the local CA in -cert_dir for these comma separated names and exit.")
+	eventLoopFlag := flag.Bool("event_loop", false,
+		"Serve every connection from one goroutine with non-blocking sockets and epoll or kqueue. Responses are buffered, and cut off past 16 MiB.")
+	idleTimeoutFlag := flag.Duration("idle_timeout", 30*time.Second,
+		"How long a persistent connection may wait for its next request, 0 to close after every response.")
+	readHeaderTimeoutFlag := flag.Duration("read_header_timeout", 10*time.Second,
+		"How long a client may take to send a request's headers, from its first byte; 0 for no limit.")
+	readTimeoutFlag := flag.Duration("read_timeout", 0,
+		"How long a client may take to send a whole request, from its first byte; 0 for no limit.")
+	writeTimeoutFlag := flag.Duration("write_timeout", 0,
+		"How long a client may take to receive a response once the request is read; 0 for no limit.")
+	maxConcurrentFlag := flag.Int("max_concurrent", 0,
+		"Requests that may run at once, 0 for no limit; more wait in a queue or get 503.")
+	admissionQueueFlag := flag.Int("admission_queue", 100, "Requests that may wait for -max_concurrent at once.")
+	admissionWaitFlag := flag.Duration("admission_wait", 5*time.Second,
+		"How long a request may wait for -max_concurrent before getting 503.")
+	warmupWaitFlag := flag.Duration("warmup_wait", 0,
+		"How long requests arriving before warm-up finishes wait for it before getting 503. 0 refuses them at once.")
+	shedP99Flag := flag.Duration("shed_p99", 0,
+		"Start refusing lower priority requests while the p99 latency is above this, 0 for no limit.")
+	shedGoroutinesFlag := flag.Int("shed_goroutines", 0, "Shed load while more goroutines than this run, 0 for no limit.")
+	shedConnsFlag := flag.Int("shed_conns", 0, "Shed load while more connections than this are open, 0 for no limit.")
+	rateLimitFlag := flag.Float64("rate_limit", 0,
+		"Requests a second each client IP may make, with -rate_burst more at once, before getting 429; 0 for no limit.")
+	rateBurstFlag := flag.Int("rate_burst", 20, "Requests a client IP may make at once under -rate_limit.")
+	maxConnsFlag := flag.Int("max_conns", 0,
+		"Connections open at once across every listener and worker; more are closed as they're accepted, 0 for no limit.")
+	memoryLimitFlag := flag.Int64("memory_limit_mb", 0,
+		"Resident memory to stay under: past 80% caches are dropped, past 90% requests below critical get 503, 0 for no limit.")
+	memoryProfileDirFlag := flag.String("memory_profile_dir", os.TempDir(),
+		"Where -memory_limit_mb writes a heap profile once memory passes 95% of the limit.")
+	prioritiesFlag := flag.String("priorities", "",
+		"Request priorities for -max_concurrent and load shedding by path prefix, like /healthz=critical,/reports/=background.")
+	maxBodyFlag := flag.Int64("max_body_bytes", 64<<20,
+		"Largest request body accepted, 0 for no limit.")
+	headerArenaFlag := flag.Bool("header_arena", true,
+		"Read each connection's request headers into a buffer reused from request to request, rather than a string per header.")
+	tarpitFlag := flag.String("tarpit", "",
+		"Answer requests for paths vulnerability scanners probe, like /wp-admin and /.env, with drip (a byte at a time) or junk (a large random body).")
+	tarpitLogFlag := flag.String("tarpit_log", "", "File to log tarpitted requests to, stderr if empty.")
+	tarpitIntervalFlag := flag.Duration("tarpit_interval", time.Second, "Delay between bytes with -tarpit=drip.")
+	tarpitDurationFlag := flag.Duration("tarpit_duration", 10*time.Minute, "How long -tarpit=drip keeps a request going.")
+	tarpitJunkFlag := flag.Int64("tarpit_junk_bytes", 64<<20, "Largest body sent with -tarpit=junk.")
+	anomaliesFlag := flag.String("anomalies", "",
+		"Comma separated request inspectors to run: headers, null_path, user_agent. Add :block to one to refuse what it flags with 403.")
+	anomalyMaxHeadersFlag := flag.Int("anomaly_max_headers", 100, "Header fields a request may have before the headers inspector flags it.")
+	httpsFlag := flag.Bool("https", false, "Serve HTTPS with -tls_cert and -tls_key, -tls_self_signed, or else the certificates issued into -cert_dir.")
+	tlsCertFlag := flag.String("tls_cert", "", "PEM certificate chain for -https.")
+	tlsKeyFlag := flag.String("tls_key", "", "PEM private key for -https.")
+	tlsSelfSignedFlag := flag.String("tls_self_signed", "",
+		"Serve -https with a certificate made at startup for these comma separated names, like localhost,127.0.0.1, signed by itself, in place of -tls_cert and -tls_key.")
+	tlsClientCertsFlag := flag.Bool("tls_client_certs", false,
+		"Ask -https clients for a certificate, which handlers and the access log see unverified.")
+	tlsPolicyFlag := flag.String("tls_policy", "intermediate",
+		"The -https versions and cipher suites to allow, after Mozilla's: modern (TLS 1.3 only), intermediate or old.")
+	tlsMinVersionFlag := flag.String("tls_min_version", "",
+		"The oldest TLS version -https allows, like 1.2, in place of -tls_policy's.")
+	tlsCiphersFlag := flag.String("tls_ciphers", "",
+		"Comma separated TLS 1.2 and older cipher suites -https allows, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, in place of -tls_policy's.")
+	tlsCurvesFlag := flag.String("tls_curves", "",
+		"Comma separated key exchange groups -https allows, in order of preference, out of X25519MLKEM768, X25519, P256, P384 and P521. The default is crypto/tls's.")
+	tlsALPNFlag := flag.String("tls_alpn", "http/1.1,http/1.0",
+		"Comma separated ALPN protocols -https agrees to, out of http/1.1 and http/1.0.")
+	tlsECHKeyFlag := flag.String("tls_ech_key", "",
+		"File with an Encrypted Client Hello key for -https, made for -tls_ech_public_name if it doesn't exist. Its config is served at /debug/ech.")
+	tlsECHPublicNameFlag := flag.String("tls_ech_public_name", "",
+		"The name clients send in the clear with a new -tls_ech_key, which the certificate has to cover as well.")
+	tlsOCSPFlag := flag.Bool("tls_ocsp", false,
+		"Staple the -https certificate's OCSP response, from the responder it names, to handshakes.")
+	tlsSessionTicketsFlag := flag.Bool("tls_session_tickets", true,
+		"Let -https clients resume sessions, which saves their repeat handshakes a round trip and the key exchange.")
+	tlsTicketKeyRotationFlag := flag.Duration("tls_ticket_key_rotation", 24*time.Hour,
+		"How often to make a new session ticket key, with the last two still accepted; 0 leaves the keys to crypto/tls.")
+	tlsSessionCacheFlag := flag.Int("tls_session_cache", 0,
+		"Keep up to this many sessions on the server for -https clients to resume, giving them an ID rather than a ticket.")
+	vsockCIDFlag := flag.Uint("vsock_cid", vsockCIDAny,
+		"The vsock CID to listen on with -vsock_port. The default is any.")
+	vsockPortFlag := flag.Uint("vsock_port", 0,
+		"Listen on this vsock port, for VM guests or their host, instead of -ip_addr and -port.")
+	unixSocketFlag := flag.String("unix_socket", "",
+		"Listen on a Unix socket at this path instead of -ip_addr and -port. One starting with @ is in the abstract namespace.")
+	fdFlag := flag.Int("fd", -1,
+		"Serve on this inherited listening socket instead of binding one, for supervisors and test harnesses that pass it in.")
+	udpPingFlag := flag.String("udp_ping", "",
+		"Also echo UDP datagrams on this host:port, for timing the network path without HTTP. A multicast address is joined.")
+	workersFlag := flag.Int("workers", 1,
+		"Bind this many sockets to the TCP address with SO_REUSEPORT, each with its own accept loop, and let the kernel spread connections across them.")
+	listenConfigFlag := flag.String("listen_config", "",
+		"File of listener settings, like 'port 8443' or 'tls_cert cert.pem', over -ip_addr, -port, -ipv6_only, -https, -tls_cert, -tls_key, -tls_self_signed, -cert_dir, -vsock_cid, -vsock_port and -unix_socket. Reread on SIGHUP.")
+	adaptationSocketFlag := flag.String("adaptation_socket", "",
+		"Unix socket of an adaptation service to show requests and responses to, which may change or veto them.")
+	adaptationModeFlag := flag.String("adaptation_mode", "both", "What -adaptation_socket sees: req, resp or both.")
+	adaptationTimeoutFlag := flag.Duration("adaptation_timeout", 5*time.Second,
+		"How long the -adaptation_socket service has to answer.")
+	adaptationBypassFlag := flag.Bool("adaptation_bypass", false,
+		"Serve requests unadapted when the -adaptation_socket service fails, instead of answering 502.")
+	geoIPDBFlag := flag.String("geoip_db", "", "MaxMind DB country database to look up clients in.")
+	geoIPAllowFlag := flag.String("geoip_allow", "", "Comma separated country codes to allow, all if empty.")
+	geoIPDenyFlag := flag.String("geoip_deny", "", "Comma separated country codes to refuse with 403; - for unknown.")
+	robotsFlag := flag.String("robots_txt", "", "File to serve as /robots.txt.")
+	crawlerRatesFlag := flag.String("crawler_rates", "",
+		"Requests per minute allowed per crawler class, like search=60,ai=0,seo=5,other=10; 0 refuses the class.")
+	robotsTagFlag := flag.String("x_robots_tag", "",
+		"X-Robots-Tag values for path prefixes, like /private/=noindex;/drafts/=noindex, nofollow.")
+	shutdownTimeoutFlag := flag.Duration("shutdown_timeout", 10*time.Second,
+		"How long in-flight requests may run after SIGINT or SIGTERM before their connections are closed.")
+	apiKeysFlag := flag.String("api_keys", "",
+		"File of API keys; if set /upload, /kv/ and /graphql require a bearer token with the matching scope.")
+	createAPIKeyFlag := flag.String("create_api_key", "",
+		"Add an API key with this name to -api_keys, print it and exit.")
+	apiKeyScopesFlag := flag.String("api_key_scopes", "*",
+		"Comma separated scopes for -create_api_key: upload, kv, graphql or * for all.")
+	apiKeyRateFlag := flag.Int("api_key_rate", 0,
+		"Requests per minute allowed for -create_api_key, 0 for no limit.")
+	revokeAPIKeyFlag := flag.String("revoke_api_key", "",
+		"Revoke the API key with this id in -api_keys and exit.")
+	listAPIKeysFlag := flag.Bool("list_api_keys", false, "List the keys in -api_keys and exit.")
+	minifyFlag := flag.Bool("minify", false,
+		"Strip comments and whitespace from HTML, CSS and JavaScript served by pages, /static/ and /assets/.")
+	minifyMinFlag := flag.Int("minify_min_bytes", 256, "Smallest response -minify bothers with.")
+	redactFieldsFlag := flag.String("redact_json_fields", "",
+		"Comma separated JSON field names to redact from responses under -redact_json_paths.")
+	redactPathsFlag := flag.String("redact_json_paths", "/", "Comma separated path prefixes for -redact_json_fields.")
+	compressFlag := flag.Bool("compress", false, "Gzip or deflate compressible responses for clients that accept it.")
+	compressMinFlag := flag.Int("compress_min_bytes", 1024, "Smallest response body -compress bothers with.")
+	captureFlag := flag.String("capture", "",
+		"PCAP-NG file to append every connection's plaintext to, in made-up TCP packets for Wireshark.")
+	accessLogFlag := flag.String("access_log", "-", "File to append the access log to, - for stdout, empty for none.")
+	accessLogFormatFlag := flag.String("access_log_format", "common", "Access log format: common or json.")
+	accessLogMinStatusFlag := flag.Int("access_log_min_status", 0,
+		"Only access log responses with at least this status, like 400 for just errors.")
+	accessLogSkipFlag := flag.String("access_log_skip", "",
+		"Comma-separated paths whose responses aren't access logged, like /healthz; one ending in / covers the paths below it.")
+	accessLogSampleFlag := flag.Float64("access_log_sample", 1,
+		"Fraction, from 0 to 1, of the responses left by the other access log filters to log.")
 	flag.Parse()
 
-	muxes.handle("/hello",
-		writeHtml(func(_ *request) string { return "<h1>Hello world</h1>" }))
+	if *debugFDsFlag {
+		fdTrack = newFDTracker()
+	}
+	if *selfTestFlag {
+		if !selfTest(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *replayFlag != "" {
+		if err := replay(*replayFlag, *replayTargetFlag, *replaySpeedFlag, *replayConcurrencyFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *signURLFlag != "" {
+		if *signingKeyFlag == "" {
+			log.Fatal("-sign_url requires -url_signing_key")
+		}
+		signer := urlSigner{key: []byte(*signingKeyFlag)}
+		u, err := signer.sign(strings.ToUpper(*signMethodFlag), *signURLFlag, clock.Now().Add(*signTTLFlag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(u)
+		return
+	}
+
+	if *issueCertFlag != "" {
+		ca, err := loadOrCreateCA(*certDirFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file, err := ca.issue(*certDirFlag, strings.Split(*issueCertFlag, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(file)
+		log.Printf("Trust %s to trust the certificates it issues",
+			filepath.Join(*certDirFlag, caCertFile))
+		return
+	}
+
+	var apiKeys *apiKeyStore
+	if *apiKeysFlag != "" {
+		var err error
+		if apiKeys, err = openAPIKeyStore(*apiKeysFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *createAPIKeyFlag != "" || *revokeAPIKeyFlag != "" || *listAPIKeysFlag {
+		if apiKeys == nil {
+			log.Fatal("managing API keys requires -api_keys")
+		}
+		var err error
+		switch {
+		case *createAPIKeyFlag != "":
+			var key string
+			key, err = apiKeys.create(*createAPIKeyFlag, strings.Split(*apiKeyScopesFlag, ","), *apiKeyRateFlag)
+			if err == nil {
+				fmt.Println(key)
+			}
+		case *revokeAPIKeyFlag != "":
+			err = apiKeys.revoke(*revokeAPIKeyFlag)
+		default:
+			err = apiKeys.list(os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Routes that take a scope check the key before anything else runs.
+	requireScope := func(scope string) []routeOption {
+		if apiKeys == nil {
+			return nil
+		}
+		return []routeOption{withMiddleware(requireAPIKey(apiKeys, scope))}
+	}
+	if apiKeys != nil {
+		go apiKeys.reloadOnHangup()
+	}
+
+	if *redirectsFlag != "" {
+		if err := redirects.load(*redirectsFlag); err != nil {
+			log.Fatal(err)
+		}
+		go redirects.reloadOnHangup()
+	}
+
+	tasks := newScheduler()
+
+	switch *trailingSlashFlag {
+	case "", slashAdd, slashStrip, slashBoth:
+		muxes.slashes = *trailingSlashFlag
+	default:
+		log.Fatalf("-trailing_slash must be add, strip or both, not %q", *trailingSlashFlag)
+	}
+
+	// Applied to the endpoints that accept request bodies.
+	var bodyMiddleware []middleware
+	if *digestResponsesFlag {
+		bodyMiddleware = append(bodyMiddleware, contentDigest)
+	}
+	if *signatureKeysFlag != "" {
+		keys, err := loadSigKeys(*signatureKeysFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bodyMiddleware = append(bodyMiddleware, requireSignature(keys,
+			strings.Split(*signatureCoversFlag, ","), *signatureMaxAgeFlag))
+	}
+	if *verifyDigestsFlag {
+		bodyMiddleware = append(bodyMiddleware, verifyDigests)
+	}
+	// What the memory watchdog has drop when memory runs short.
+	var reclaimers []func()
+	if *idempotencyTTLFlag > 0 {
+		cache := newIdempotencyCache(*idempotencyTTLFlag)
+		reclaimers = append(reclaimers, cache.reclaim)
+		bodyMiddleware = append(bodyMiddleware, cache.middleware)
+	}
+	// Quotas count requests after authentication, which basicAuth,
+	// requireAPIKey and requireSignature do earlier in the chain.
+	var quotas *quotaTracker
+	if *dailyQuotaFlag > 0 || *monthlyQuotaFlag > 0 {
+		quotas = newQuotaTracker(*dailyQuotaFlag, *monthlyQuotaFlag)
+		bodyMiddleware = append(bodyMiddleware, quotas.middleware)
+	}
+
+	var geo *geoPolicy
+	if *geoIPDBFlag != "" {
+		db, err := openMMDB(*geoIPDBFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		geo = newGeoPolicy(db, *geoIPAllowFlag, *geoIPDenyFlag)
+	}
+
+	// Options for routes serving pages and their assets. Minifying buffers
+	// the body, so it's left off downloads and media.
+	var pageOpts []routeOption
+	if *minifyFlag {
+		pageOpts = append(pageOpts, withOutputFilters(minifyFilter(*minifyMinFlag)))
+	}
+
+	muxes.handleGet("/hello",
+		writeHtml(func(_ *request) string { return "<h1>Hello world</h1>" }), pageOpts...)
 	muxes.handle("/notfound", handlerFunc(notFound))
+	if *uploadDirFlag != "" {
+		if *uploadAuthFlag == "" && apiKeys == nil {
+			log.Fatal("-upload_dir requires -upload_auth or -api_keys, so uploads are authenticated")
+		}
+		opts := append(requireScope("upload"), withMaxBody(*uploadMaxFlag))
+		if *uploadAuthFlag != "" {
+			opts = append(opts, withMiddleware(basicAuth("upload", *uploadAuthFlag)))
+		}
+		opts = append(opts, withMiddleware(bodyMiddleware...))
+		muxes.handle("/upload", uploadHandler(uploadConfig{
+			dir:  *uploadDirFlag,
+			exts: parseExtensions(*uploadExtsFlag),
+		}), opts...)
+	}
+	if *kvFlag {
+		store := newKVStore()
+		tasks.add("kv sweep", "@every 1m", store.sweep)
+		// Entries that haven't expired are data, not cache, and stay.
+		reclaimers = append(reclaimers, func() { store.sweep() })
+		opts := append(requireScope("kv"), kvDocs("/kv/"), withMiddleware(bodyMiddleware...))
+		muxes.handle("/kv/", kvHandler("/kv/", store), opts...)
+	}
+	if *graphqlFlag {
+		opts := append(requireScope("graphql"), withMiddleware(bodyMiddleware...))
+		muxes.handle("/graphql", graphqlHandler(newDemoSchema(), *graphiqlFlag, *graphqlMaxFlag), opts...)
+	}
+	// Checked first, against the URL as it was signed.
+	var signedOpts []routeOption
+	if *signingKeyFlag != "" {
+		signedOpts = append(signedOpts, withMiddleware(requireSignedURL(urlSigner{key: []byte(*signingKeyFlag)})))
+	}
+	if *downloadDirFlag != "" {
+		onWarmup("download root", statRoot(*downloadDirFlag))
+		muxes.handle("/download/", downloadHandler("/download/", *downloadDirFlag), signedOpts...)
+	}
+	if !symlinkPolicies[*staticSymlinksFlag] {
+		log.Fatalf("-static_symlinks must be none, beneath or any, not %q", *staticSymlinksFlag)
+	}
+	policy := filePolicy{dotfiles: *staticDotfilesFlag, symlinks: *staticSymlinksFlag}
+	if *staticDirFlag != "" {
+		onWarmup("static root", statRoot(*staticDirFlag))
+		opts := append(append(signedOpts, withMiddleware(stripPrefix("/static/"))), pageOpts...)
+		muxes.handle("/static/", fileServer(*staticDirFlag, policy), opts...)
+	}
+	if *locationsFlag != "" {
+		locs, err := loadLocations(*locationsFlag, policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, l := range locs {
+			onWarmup(l.prefix+" root", statRoot(l.root))
+			muxes.handle(l.prefix, l.handler(), pageOpts...)
+		}
+	}
+	if *mediaDirFlag != "" {
+		onWarmup("media root", statRoot(*mediaDirFlag))
+		cacheDir := *mediaCacheFlag
+		if cacheDir == "" {
+			// Made fresh, and only readable by this user, so no one else
+			// can plant variants in it.
+			dir, err := ioutil.TempDir("", "media-cache")
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheDir = dir
+		}
+		onWarmup("media cache", statRoot(cacheDir))
+		media := mediaHandler{prefix: "/media/", root: *mediaDirFlag, cache: newMediaCache(cacheDir, *mediaCacheBytesFlag)}
+		muxes.handle("/media/", media.serve)
+	}
+	if *assetsDirFlag != "" {
+		// Requests wait for warm-up, so the manifest is filled in by the
+		// time any reach the handler.
+		assets := new(assetManifest)
+		onWarmup("assets", func() error {
+			m, err := buildAssetManifest(*assetsDirFlag, "/assets/")
+			if err != nil {
+				return err
+			}
+			*assets = *m
+			return nil
+		})
+		muxes.handle("/assets/", assets.handler, pageOpts...)
+	}
+	if *robotsFlag != "" {
+		robots, err := robotsHandler(*robotsFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		muxes.handleGet("/robots.txt", robots)
+	}
+	if *openAPIFlag || *swaggerUIFlag {
+		muxes.handleGet("/openapi.json", openAPIHandler(muxes, "scratch-http-server"))
+	}
+	if *swaggerUIFlag {
+		muxes.handleGet("/docs", handlerFunc(swaggerUIHandler), pageOpts...)
+	}
+	muxes.use(serveRanges)
+	if *redactFieldsFlag != "" {
+		muxes.use(redactJSON(strings.Split(*redactPathsFlag, ","), strings.Split(*redactFieldsFlag, ",")))
+	}
+	if *compressFlag {
+		muxes.use(filterEncoding(compressFilter(*compressMinFlag)))
+	}
+	muxes.addHook(phaseTimingHook)
+	// Debug endpoints are how an operator sees what an overloaded server
+	// is up to.
+	admin := []routeOption{withPriority(priorityCritical)}
+	ready := newReadiness(&prioritizer{mux: muxes}, *warmupWaitFlag)
+	muxes.handleGet("/readyz", ready.handler, admin...)
+	if *debugRoutesFlag {
+		muxes.handleGet("/debug/routes", routesHandler(muxes), admin...)
+	}
+	if quotas != nil {
+		muxes.handleGet("/debug/usage", quotas.handler, admin...)
+	}
+	if geo != nil {
+		muxes.handleGet("/debug/geoip", geo.handler, admin...)
+	}
+	// Shared by every server, so sessions resume on any of them.
+	certs := &certStore{ocsp: *tlsOCSPFlag, noTickets: !*tlsSessionTicketsFlag}
+	if *httpsFlag || *listenConfigFlag != "" {
+		switch {
+		case *tlsSessionCacheFlag > 0:
+			certs.sessions = newSessionCache(*tlsSessionCacheFlag)
+		case *tlsTicketKeyRotationFlag > 0:
+			if err := certs.rotateTicketKeys(); err != nil {
+				log.Fatal(err)
+			}
+			if err := tasks.add("session ticket keys", "@every "+tlsTicketKeyRotationFlag.String(), certs.rotateTicketKeys); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *tlsOCSPFlag {
+			tasks.add("OCSP staples", "@every 1h", certs.staple)
+		}
+		if *tlsECHKeyFlag != "" {
+			ech, err := loadOrCreateECHKey(*tlsECHKeyFlag, *tlsECHPublicNameFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			certs.ech = []tls.EncryptedClientHelloKey{ech.key}
+			muxes.handleGet("/debug/ech", ech.handler, admin...)
+		}
+	}
+	if len(tasks.tasks) > 0 {
+		muxes.handleGet("/debug/tasks", tasks.handler, admin...)
+	}
+	if fdTrack != nil {
+		muxes.handleGet("/debug/fds", fdTrack.handler, admin...)
+	}
 	muxes.handle("/",
 		writeHtml(func(r *request) string {
 			return "<h1>Using fallback matcher for path: " + r.uri + "</h1>"
-		}))
+		}), pageOpts...)
 
-	ip := net.ParseIP(*ipFlag)
-	port := *portFlag
-	socket, err := newNetSocket(ip, port)
-	defer socket.Close()
-	if err != nil {
-		panic(err)
+	if *printRoutesFlag {
+		if err := muxes.printRoutes(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *accessLogFlag != "" {
+		var out io.Writer = os.Stdout
+		if *accessLogFlag != "-" {
+			f, err := os.OpenFile(*accessLogFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			out = f
+		}
+		var err error
+		if accessLog, err = newAccessLogger(out, *accessLogFormatFlag); err != nil {
+			log.Fatal(err)
+		}
+		if *accessLogSampleFlag < 0 || *accessLogSampleFlag > 1 {
+			log.Fatalf("-access_log_sample must be from 0 to 1, not %v", *accessLogSampleFlag)
+		}
+		accessLog.minStatus, accessLog.sample = *accessLogMinStatusFlag, *accessLogSampleFlag
+		if *accessLogSkipFlag != "" {
+			accessLog.skip = strings.Split(*accessLogSkipFlag, ",")
+		}
+	}
+
+	if *captureFlag != "" {
+		if *eventLoopFlag {
+			log.Fatal("-capture doesn't work with -event_loop")
+		}
+		var err error
+		if capture, err = newPcapWriter(*captureFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Redirects are evaluated before the mux.
+	serve := func(w responseWriter, r *request) error {
+		redirected, err := redirects.redirect(w, r)
+		if redirected || err != nil {
+			return err
+		}
+		return muxes.dispatch(w, r)
+	}
+	// The adaptation service sees requests the server will serve, and
+	// the responses as they'll be sent.
+	if *adaptationSocketFlag != "" {
+		adapter, err := newAdapter(*adaptationSocketFlag, *adaptationModeFlag, *adaptationTimeoutFlag, *adaptationBypassFlag, *maxBodyFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve = adapter.middleware(serve)
+	}
+	// Neither handlers nor the adaptation service see the headers that
+	// were only for the hop the request came in on.
+	serve = normalizeHopByHop(serve)
+	if *robotsTagFlag != "" {
+		rules, err := parseRobotsTags(*robotsTagFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		muxes.use(robotsTags(rules))
+	}
+	if *crawlerRatesFlag != "" {
+		limiter, err := parseCrawlerRates(*crawlerRatesFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve = limiter.middleware(serve)
+	}
+	priorities := ready.priorities
+	if *prioritiesFlag != "" {
+		var err error
+		if priorities.rules, err = parsePriorities(*prioritiesFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rateLimitFlag < 0 {
+		log.Fatal("-rate_limit can't be negative")
+	}
+	// Requests over the limit don't wait for admission or count toward
+	// load.
+	if *rateLimitFlag > 0 {
+		limiter := newIPLimiter(priorities, *rateLimitFlag, *rateBurstFlag)
+		tasks.add("rate limit sweep", "@every 1m", limiter.sweep)
+		reclaimers = append(reclaimers, func() { limiter.sweep() })
+		serve = limiter.middleware(serve)
+	}
+	if *warmupWaitFlag > 0 && (*eventLoopFlag || !*concurrentFlag) {
+		log.Fatal("-warmup_wait needs connections served concurrently, without -event_loop; it would stall every other connection")
+	}
+	if *maxConcurrentFlag > 0 {
+		if *eventLoopFlag || !*concurrentFlag {
+			log.Fatal("-max_concurrent needs requests served concurrently, without -event_loop")
+		}
+		serve = newAdmission(priorities, *maxConcurrentFlag, *admissionQueueFlag, *admissionWaitFlag).middleware(serve)
+	}
+	// Requests held for warm-up don't take up an admission slot.
+	serve = ready.middleware(serve)
+	// Latency counts any time spent queued for admission.
+	var shed *shedder
+	if *shedP99Flag > 0 || *shedGoroutinesFlag > 0 || *shedConnsFlag > 0 {
+		shed = newShedder(priorities, shedLimits{p99: *shedP99Flag, goroutines: *shedGoroutinesFlag, conns: *shedConnsFlag})
+		serve = shed.middleware(serve)
+	}
+	if *memoryLimitFlag > 0 {
+		mem := newMemWatchdog(*memoryLimitFlag<<20, priorities, reclaimers, *memoryProfileDirFlag)
+		go mem.run()
+		serve = mem.middleware(serve)
+	}
+	switch *tarpitFlag {
+	case "":
+	case "drip", "junk":
+		if *tarpitFlag == "drip" && (*eventLoopFlag || !*concurrentFlag) {
+			log.Fatal("-tarpit=drip needs connections served concurrently, without -event_loop; it would stall every other connection")
+		}
+		trap, err := newTarpit(*tarpitFlag, *tarpitLogFlag, *tarpitIntervalFlag, *tarpitDurationFlag, *tarpitJunkFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Outside admission and the shedder, so a dripped request
+		// doesn't hold a slot, or count toward latency, for as long as
+		// it lasts.
+		serve = trap.middleware(serve)
+	default:
+		log.Fatalf("-tarpit must be drip or junk, not %q", *tarpitFlag)
+	}
+	// Inspectors see every request, before even the tarpit.
+	if *anomaliesFlag != "" {
+		detector, err := parseAnomalyDetector(*anomaliesFlag, *anomalyMaxHeadersFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve = detector.middleware(serve)
+	}
+	if geo != nil {
+		serve = geo.middleware(serve)
+	}
+	if *serverTimingFlag {
+		serve = serverTiming(serve)
+	}
+
+	if *workersFlag < 1 {
+		log.Fatal("-workers must be at least 1")
+	}
+	// Each worker's event loop keeps its own count, only safe to read
+	// from that loop.
+	if *workersFlag > 1 && *eventLoopFlag && *shedConnsFlag > 0 {
+		log.Fatal("-shed_conns doesn't work with -workers and -event_loop")
+	}
+	if *httpsFlag && *eventLoopFlag {
+		log.Fatal("-https doesn't work with -event_loop")
+	}
+	listen := listenConfig{
+		ip:          net.ParseIP(*ipFlag),
+		port:        *portFlag,
+		v6Only:      *ipv6OnlyFlag,
+		https:       *httpsFlag,
+		certFile:    *tlsCertFlag,
+		keyFile:     *tlsKeyFlag,
+		selfSigned:  *tlsSelfSignedFlag,
+		certDir:     *certDirFlag,
+		clientCerts: *tlsClientCertsFlag,
+		policy:      *tlsPolicyFlag,
+		minVersion:  *tlsMinVersionFlag,
+		ciphers:     *tlsCiphersFlag,
+		curves:      *tlsCurvesFlag,
+		alpn:        *tlsALPNFlag,
+		vsockCID:    uint32(*vsockCIDFlag),
+		vsockPort:   uint32(*vsockPortFlag),
+		unixPath:    *unixSocketFlag,
+		fd:          *fdFlag,
+	}
+	if listen.ip == nil {
+		log.Fatalf("invalid -ip_addr %q", *ipFlag)
+	}
+	if *listenConfigFlag != "" {
+		var err error
+		if listen, err = parseListenConfig(*listenConfigFlag, listen); err != nil {
+			log.Fatal(err)
+		}
 	}
 
+	cfg := connConfig{
+		idleTimeout:   *idleTimeoutFlag,
+		maxBodyBytes:  *maxBodyFlag,
+		bodyLimit:     muxes.bodyLimit,
+		headerTimeout: *readHeaderTimeoutFlag,
+		readTimeout:   *readTimeoutFlag,
+		writeTimeout:  *writeTimeoutFlag,
+		headerArena:   *headerArenaFlag,
+	}
+	if *maxConnsFlag > 0 {
+		cfg.conns = newConnLimit(*maxConnsFlag)
+	}
+	servers := &listeners{
+		certs: certs,
+		newServer: func(socket *netSocket) (*server, error) {
+			return newServer(socket, serve, cfg, *concurrentFlag, *eventLoopFlag)
+		},
+		file:    *listenConfigFlag,
+		drain:   *shutdownTimeoutFlag,
+		tasks:   tasks,
+		workers: *workersFlag,
+	}
 	log.Print("===============")
 	log.Print("Server Started!")
 	log.Print("===============")
 	log.Print("")
-	log.Printf("addr: http://%s:%d", ip, port)
+	if err := servers.start(listen); err != nil {
+		log.Fatal(err)
+	}
+	if shed != nil {
+		shed.conns = servers.connCount
+	}
+	ready.closing = servers.isClosing
+	if *listenConfigFlag != "" {
+		go servers.reloadOnHangup()
+	}
+	if *udpPingFlag != "" {
+		fd, err := newUDPPingSocket(*udpPingFlag)
+		if err != nil {
+			log.Fatalf("-udp_ping: %v", err)
+		}
+		log.Printf("udp ping: %s", *udpPingFlag)
+		go serveUDPPing(fd)
+	}
+	// The first SIGINT or SIGTERM shuts down gracefully, a second one kills
+	// the process.
+	shutdownDone := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down", <-c)
+		signal.Stop(c)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		defer cancel()
+		if err := servers.Shutdown(ctx); err != nil {
+			log.Print("shutdown: ", err)
+		}
+		close(shutdownDone)
+	}()
+	// The listener is already up, so connections queue for warm-up rather
+	// than being refused.
+	go ready.warmUp()
+	select {
+	case err := <-servers.failed:
+		log.Fatal(err)
+	case <-shutdownDone:
+	}
+	log.Print("Server stopped")
+}
 
-	for {
-		// Block until incoming connection
-		rw, e := socket.Accept()
-		log.Print()
-		log.Print()
-		log.Printf("Incoming connection")
-		if e != nil {
-			panic(e)
-		}
-
-		// Read request
-		log.Print("Reading request")
-		req, err := parseRequest(rw)
-		log.Print("request: ", req)
+// Settings for serving the requests on a connection.
+type connConfig struct {
+	idleTimeout  time.Duration // 0 closes the connection after each response.
+	maxBodyBytes int64         // 0 for no limit.
+	// Looks up the body limit for a request's route, which replaces
+	// maxBodyBytes if there is one. nil for none.
+	bodyLimit func(req *request) (int64, bool)
+	// Limits from a request's first byte to the end of its headers, and
+	// to the end of its body, and from then to the end of the response. 0
+	// for none.
+	headerTimeout time.Duration
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	// Counts open connections against -max_conns, nil for no cap.
+	conns *connLimit
+	// Whether each connection keeps its requests' headers in a
+	// headerArena.
+	headerArena bool
+}
+
+// The body limit for req, whose request line has been read.
+func (cfg connConfig) maxBody(req *request) int64 {
+	if cfg.bodyLimit != nil {
+		if max, ok := cfg.bodyLimit(req); ok {
+			return max
+		}
+	}
+	return cfg.maxBodyBytes
+}
+
+// Returns d after t, or the zero time, which never comes, if d is 0.
+func deadlineAfter(t time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return t.Add(d)
+}
+
+// Serves requests from the connection until the client or a response asks
+// to close it, it sits idle for longer than the idle timeout, or the server
+// shuts down. A panic while serving only takes down this connection.
+func (s *server) serveConn(rw *netSocket) {
+	cfg := s.cfg
+	idle := cfg.idleTimeout
+	defer s.wg.Done()
+	defer s.cfg.conns.release()
+	defer rw.Close()
+	defer s.untrack(rw)
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("panic serving connection: %v\n%s", e, debug.Stack())
+		}
+	}()
+	var conn io.ReadWriter = rw
+	var tlsState *tls.ConnectionState
+	if s.tlsConfig != nil {
+		tc := tls.Server(rw, s.tlsConfig)
+		rw.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			log.Print("TLS handshake: ", err)
+			return
+		}
+		rw.SetDeadline(time.Time{})
+		// Tells the client the connection is closing on purpose.
+		defer tc.CloseWrite()
+		conn = tc
+		state := tc.ConnectionState()
+		tlsState = &state
+	}
+	if capture != nil {
+		cc := capture.wrap(conn, rw)
+		defer cc.close()
+		conn = cc
+	}
+	if s.wrapConn != nil {
+		conn = s.wrapConn(conn)
+	}
+	remote, local := rw.RemoteAddr(), rw.LocalAddr()
+	connCtx := context.WithValue(s.ctx, connContextKey, rw)
+	b := bufio.NewReader(conn)
+	var arena *headerArena
+	if cfg.headerArena {
+		arena = new(headerArena)
+	}
+	for s.setIdle(rw, true) {
+		// Read request. Waiting for one longer than the idle timeout, or on
+		// a connection that isn't kept alive the read timeout, closes the
+		// connection.
+		wait := idle
+		if wait <= 0 {
+			wait = cfg.readTimeout
+		}
+		rw.SetWriteDeadline(time.Time{})
+		if err := rw.SetReadDeadline(deadlineAfter(time.Now(), wait)); err != nil {
+			log.Print("setting idle timeout: ", err)
+		}
+		// The connection is busy from the first byte of a request, so
+		// shutting down doesn't cut off one that's partly received.
+		var req *request
+		_, err := b.Peek(1)
+		parseStart := time.Now()
+		if err == nil {
+			s.setIdle(rw, false)
+			// A client trickling in its request only gets so long.
+			headerDeadline := deadlineAfter(parseStart, cfg.headerTimeout)
+			if cfg.readTimeout > 0 && (headerDeadline.IsZero() || cfg.readTimeout < cfg.headerTimeout) {
+				headerDeadline = parseStart.Add(cfg.readTimeout)
+			}
+			rw.SetReadDeadline(headerDeadline)
+			readDeadline := headerDeadline
+			req, err = parseRequest(b, cfg.maxBody, arena, func() {
+				readDeadline = deadlineAfter(parseStart, cfg.readTimeout)
+				rw.SetReadDeadline(readDeadline)
+			})
+			// bufio may hand back a partial line rather than the timeout, so
+			// the error can be anything.
+			if err != nil && !readDeadline.IsZero() && !time.Now().Before(readDeadline) {
+				log.Printf("request from %v took too long to arrive", remote)
+				return
+			}
+		}
+		if req != nil {
+			req.tls = tlsState
+			req.remoteAddr, req.localAddr = remote, local
+			req.start = parseStart
+		}
+		if err == errBodyTooLarge {
+			serveRequest(bodyTooLarge, newConnWriter(conn, req, idle), req)
+			return
+		}
+		var bad *badRequestError
+		if errors.As(err, &bad) {
+			log.Printf("bad request from %v: %v", remote, bad)
+			serveRequest(bad.serve, newConnWriter(conn, req, idle), req)
+			return
+		}
+		serve := s.serve
+		if err == errBadRequestURI {
+			serve, err = badRequestURI, nil
+		}
 		if err != nil {
-			panic(err)
+			switch {
+			case err == io.EOF:
+			case errors.Is(err, errSocketTimeout):
+				log.Print("closing idle connection")
+			default:
+				log.Print("reading request: ", err)
+			}
+			return
 		}
+		req.recordPhase("parse", time.Since(parseStart))
 
 		// Write response
-		log.Print("Writing response")
-		err = muxes.dispatch(responseWriter{rw}, req)
-		if err != nil {
-			log.Print(err.Error())
-			continue
+		rw.SetReadDeadline(time.Time{})
+		rw.SetWriteDeadline(deadlineAfter(time.Now(), cfg.writeTimeout))
+		if s.isClosing() {
+			idle = 0 // Answer with Connection: close.
+		}
+		ctx, cancel := context.WithCancel(connCtx)
+		req.ctx = ctx
+		stop := watchPeer(rw, cancel)
+		ok := serveRequest(serve, newConnWriter(conn, req, idle), req)
+		stop()
+		cancel()
+		if !ok {
+			return
+		}
+	}
+}
+
+// Serves req with serve, writing the response to cw, and reports whether
+// the connection can be reused. A handler that fails or panics before
+// anything is sent gets a 500 in place of its response, and one that
+// panics has its connection closed after, since it may have left the
+// connection's state half done.
+func serveRequest(serve handlerFunc, cw *connWriter, req *request) bool {
+	w := newResponseWriter(cw)
+	w.state.head = req.method == "HEAD"
+	if req.start.IsZero() {
+		req.start = time.Now()
+	}
+	defer req.removeMultipartFiles()
+	panicked, err := callHandler(serve, w, req)
+	if err != nil {
+		log.Print(err.Error())
+		if w.state.wroteHeader {
+			// Part of the response is out, so all that's left is to close.
+			return false
+		}
+		w.reset()
+		var extra []string
+		if panicked {
+			extra = append(extra, "Connection: close")
 		}
+		err = writeStatus(w, 500, "internal server error\n", extra...)
+	}
+	if err == nil {
+		err = w.finish()
+	}
+	if err == nil {
+		err = cw.finish()
+	}
+	if accessLog != nil {
+		accessLog.log(req, w.state.status, w.state.sent, req.start)
 	}
+	return err == nil && !panicked && cw.reusable()
+}
+
+// Calls serve, turning a panic into an error that holds the stack.
+func callHandler(serve handlerFunc, w responseWriter, req *request) (panicked bool, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			panicked, err = true, fmt.Errorf("panic serving %s %s: %v\n%s", req.method, req.uri, e, debug.Stack())
+		}
+	}()
+	return false, serve(w, req)
 }
@@ -0,0 +1,36 @@
+package main
+
+// Server-Timing response header (https://www.w3.org/TR/server-timing/)
+// so browser devtools can show where the server spent its time.
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Reports the phases recorded on the request, and its cache status, by the
+// time the response head goes out. Small bodies are held back until the
+// handler is done, as they are for a Content-Length, so they report every
+// phase; nothing bigger is buffered to wait for the rest, so a large file
+// or a stream only reports the phases finished before its first bytes.
+// Time spent writing to the socket is never included.
+func serverTiming(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		w.state.holdHead = true
+		w.state.onHead = func(header textproto.MIMEHeader) {
+			var metrics []string
+			for _, t := range r.timings {
+				metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", t.name, float64(t.dur)/float64(time.Millisecond)))
+			}
+			if r.cacheStatus != "" {
+				metrics = append(metrics, "cache;desc="+r.cacheStatus)
+			}
+			if len(metrics) > 0 {
+				header.Set("Server-Timing", strings.Join(metrics, ", "))
+			}
+		}
+		return next(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+// Load shedding. Once a second the shedder looks at the p99 latency of the
+// requests served since its last look, and at how many goroutines and
+// connections are open. While any is over its limit it refuses one more
+// class of requests, lowest priority first, with 503; once all are back
+// under 80% of their limits it lets a class back in. Critical requests are
+// never refused.
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type priority int
+
+const (
+	priorityBackground priority = iota
+	priorityNormal
+	priorityCritical
+)
+
+var priorityNames = map[string]priority{
+	"background": priorityBackground,
+	"normal":     priorityNormal,
+	"critical":   priorityCritical,
+}
+
+func (p priority) String() string {
+	for name, q := range priorityNames {
+		if q == p {
+			return name
+		}
+	}
+	return fmt.Sprint(int(p))
+}
+
+// Runs a route's requests at priority p, unless a -priorities rule for
+// their path says otherwise. Routes are normal by default.
+func withPriority(p priority) routeOption {
+	return func(rt *route) {
+		rt.priority = p
+	}
+}
+
+type priorityRule struct {
+	prefix   string
+	priority priority
+}
+
+// Parses rules like "/healthz=critical,/reports/=background".
+func parsePriorities(spec string) ([]priorityRule, error) {
+	var rules []priorityRule
+	for _, item := range strings.Split(spec, ",") {
+		i := strings.IndexByte(item, '=')
+		if i < 0 || !strings.HasPrefix(item, "/") {
+			return nil, fmt.Errorf("priority rule %q isn't /prefix=priority", item)
+		}
+		p, ok := priorityNames[strings.TrimSpace(item[i+1:])]
+		if !ok {
+			return nil, fmt.Errorf("priority rule %q: priority must be critical, normal or background", item)
+		}
+		rules = append(rules, priorityRule{prefix: item[:i], priority: p})
+	}
+	// The longest prefix wins, like routes.
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// Works out the priority of requests, from the rules for their path or
+// else the route they're for.
+type prioritizer struct {
+	rules []priorityRule
+	mux   *serveMux
+}
+
+func (p *prioritizer) classify(r *request) priority {
+	for _, rule := range p.rules {
+		if strings.HasPrefix(r.path, rule.prefix) {
+			return rule.priority
+		}
+	}
+	if rt, _, err := p.mux.findRoute(r); err == nil {
+		return rt.priority
+	}
+	return priorityNormal
+}
+
+type shedLimits struct {
+	p99        time.Duration // 0 for no limit, as for the others.
+	goroutines int
+	conns      int
+}
+
+type shedder struct {
+	priorities *prioritizer
+	limits     shedLimits
+	// Counts open connections. Set once the server exists.
+	conns func() int
+
+	mu        sync.Mutex
+	level     priority // Requests below it are refused.
+	lastCheck time.Time
+	latencies []time.Duration // Since lastCheck.
+}
+
+func newShedder(priorities *prioritizer, limits shedLimits) *shedder {
+	return &shedder{priorities: priorities, limits: limits, lastCheck: clock.Now()}
+}
+
+func (s *shedder) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if s.priorities.classify(r) < s.check() {
+			return writeStatus(w, 503, "server overloaded\n", "Retry-After: 1")
+		}
+		start := clock.Now()
+		err := next(w, r)
+		s.mu.Lock()
+		s.latencies = append(s.latencies, clock.Now().Sub(start))
+		s.mu.Unlock()
+		return err
+	}
+}
+
+// Returns the level to shed below, adjusting it if a second has passed
+// since it last did.
+func (s *shedder) check() priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	if now.Sub(s.lastCheck) < time.Second {
+		return s.level
+	}
+	var p99 time.Duration
+	if n := len(s.latencies); n > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		p99 = s.latencies[(n*99-1)/100]
+	}
+	goroutines := runtime.NumGoroutine()
+	conns := 0
+	if s.conns != nil {
+		conns = s.conns()
+	}
+	s.latencies = s.latencies[:0]
+	s.lastCheck = now
+
+	l := s.limits
+	// Limits are compared scaled by 10, so recovering can wait for 80%.
+	over := func(scale int) bool {
+		return l.p99 > 0 && p99*10 > l.p99*time.Duration(scale) ||
+			l.goroutines > 0 && goroutines*10 > l.goroutines*scale ||
+			l.conns > 0 && conns*10 > l.conns*scale
+	}
+	level := s.level
+	switch {
+	case over(10) && level < priorityCritical:
+		level++
+	case !over(8) && level > priorityBackground:
+		level--
+	}
+	if level != s.level {
+		state := "off"
+		if level > priorityBackground {
+			state = "refusing requests below " + level.String()
+		}
+		log.Printf("load shedding %s: p99 %v, %d goroutines, %d connections", state, p99, goroutines, conns)
+		s.level = level
+	}
+	return level
+}
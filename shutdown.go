@@ -0,0 +1,194 @@
+package main
+
+// Graceful shutdown. Shutdown stops accepting connections, closes the ones
+// waiting for their next request and lets the rest finish the request
+// they're on, answering it with Connection: close. Once the context is
+// done, connections still open are cut off.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// Returned by Serve once Shutdown stops it.
+var errServerClosed = errors.New("server closed")
+
+type server struct {
+	listener   *netSocket
+	serve      handlerFunc
+	cfg        connConfig
+	concurrent bool
+	loop       *eventLoop  // Serves every connection when set.
+	tlsConfig  *tls.Config // Serves HTTPS when set.
+	tasks      *scheduler  // Runs while the server serves, when set.
+	// Wraps each connection once it's in plaintext, for the chaos checks
+	// to inject faults.
+	wrapConn func(io.ReadWriter) io.ReadWriter
+
+	mu             sync.Mutex
+	closing        bool
+	listenerClosed bool
+	conns          map[*netSocket]bool // Whether each is waiting for a request.
+	wg             sync.WaitGroup
+	stopped        chan struct{} // Closed when Serve returns.
+
+	// Parent of the requests' contexts, canceled when Shutdown returns.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Makes a server for connections accepted from listener, which it closes
+// once it's done serving. With eventLoop, connections are served by an
+// eventLoop rather than a goroutine each.
+func newServer(listener *netSocket, serve handlerFunc, cfg connConfig, concurrent, eventLoop bool) (*server, error) {
+	s := &server{
+		listener:   listener,
+		serve:      serve,
+		cfg:        cfg,
+		concurrent: concurrent,
+		conns:      make(map[*netSocket]bool),
+		stopped:    make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if eventLoop {
+		loop, err := newEventLoop(listener, serve, cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.loop = loop
+	}
+	return s, nil
+}
+
+// Returns how many connections are open. With an event loop it's only
+// safe to call from the loop, where handlers run.
+func (s *server) connCount() int {
+	if s.loop != nil {
+		return len(s.loop.conns)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Accepts and serves connections until Shutdown, then returns
+// errServerClosed. Connections may still be finishing when it returns;
+// Shutdown waits for them.
+func (s *server) Serve() error {
+	defer close(s.stopped)
+	if s.tasks != nil {
+		s.tasks.start()
+	}
+	if s.loop != nil {
+		return s.loop.run()
+	}
+	defer s.closeListener()
+	for {
+		// Block until incoming connection
+		rw, err := s.listener.Accept()
+		if s.isClosing() {
+			if err == nil {
+				rw.Close()
+			}
+			return errServerClosed
+		}
+		if err == errSocketTimeout && s.listener.vsock {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Released when serveConn returns.
+		if !s.cfg.conns.acquire() {
+			rw.Close()
+			continue
+		}
+		s.wg.Add(1)
+		if s.concurrent {
+			go s.serveConn(rw)
+		} else {
+			s.serveConn(rw)
+		}
+	}
+}
+
+func (s *server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+func (s *server) closeListener() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.listenerClosed {
+		s.listenerClosed = true
+		s.listener.Close()
+	}
+}
+
+// Records whether rw is waiting for its next request. Reports false once
+// the server is shutting down, in which case an idle connection should
+// close rather than wait.
+func (s *server) setIdle(rw *netSocket, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[rw] = idle
+	return !s.closing
+}
+
+// Forgets rw. It must be called before rw is closed, so Shutdown never
+// touches a file descriptor that's since been reused.
+func (s *server) untrack(rw *netSocket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, rw)
+}
+
+// Stops the server gracefully, returning once every connection has closed
+// or ctx is done, whichever comes first. In the latter case the remaining
+// connections are closed and ctx's error returned.
+func (s *server) Shutdown(ctx context.Context) error {
+	// Requests still going once it gives up are told to stop.
+	defer s.cancel()
+	if s.tasks != nil {
+		s.tasks.shutdown(ctx.Done())
+	}
+	if s.loop != nil {
+		return s.loop.shutdown(ctx)
+	}
+	s.mu.Lock()
+	s.closing = true
+	// Shutting down the read side makes a blocked read return EOF.
+	for rw, idle := range s.conns {
+		if idle {
+			syscall.Shutdown(rw.fd, syscall.SHUT_RD)
+		}
+	}
+	if !s.listenerClosed {
+		wakeAccept(s.listener)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-s.stopped
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for rw := range s.conns {
+			syscall.Shutdown(rw.fd, syscall.SHUT_RDWR)
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
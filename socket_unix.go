@@ -0,0 +1,164 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Socket file descriptors are ints.
+type sysfd = int
+
+const (
+	soRcvTimeo = syscall.SO_RCVTIMEO
+	soSndTimeo = syscall.SO_SNDTIMEO
+)
+
+// What a read or write fails with once its socket timeout passes.
+var errSocketTimeout error = syscall.EAGAIN
+
+func sysRead(fd sysfd, p []byte) (int, error) {
+	return syscall.Read(fd, p)
+}
+
+func sysWrite(fd sysfd, p []byte) (int, error) {
+	return syscall.Write(fd, p)
+}
+
+func sysAccept(fd sysfd) (sysfd, error) {
+	// syscall.ForkLock doc states lock not needed for blocking accept.
+	nfd, _, err := syscall.Accept(fd)
+	if err == nil {
+		syscall.CloseOnExec(nfd)
+	}
+	return nfd, err
+}
+
+func sysClose(fd sysfd) error {
+	return syscall.Close(fd)
+}
+
+// Allows reuse of recently-used addresses.
+func setReuseAddr(fd sysfd) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+// Sets SO_RCVTIMEO or SO_SNDTIMEO to d, or to no timeout if d is 0.
+func setSockTimeout(fd sysfd, opt int, d time.Duration) error {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, opt, &tv)
+}
+
+// Makes an accept blocked on the listener return. Shutting down the read
+// side of a listening socket does that here.
+func wakeAccept(ns *netSocket) {
+	syscall.Shutdown(ns.fd, syscall.SHUT_RD)
+}
+
+// Reports whether the other end of a connection has closed or reset it. It
+// only peeks, so bytes waiting to be read are left for the next read.
+func peerGone(fd sysfd) bool {
+	var b [1]byte
+	n, _, err := syscall.Recvfrom(fd, b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	if err == nil {
+		return n == 0
+	}
+	return err == syscall.ECONNRESET || err == syscall.EPIPE
+}
+
+// Creates a Unix domain socket at path and listens on it. A path starting
+// with @ is in Linux's abstract namespace, which leaves nothing in the
+// filesystem; otherwise a socket left at path by an earlier run is
+// replaced.
+func newUnixSocket(path string) (*netSocket, error) {
+	if strings.HasPrefix(path, "@") {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("abstract unix sockets are only on Linux")
+		}
+	} else if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	syscall.ForkLock.Lock()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	fdTrack.add(fd, "unix listener")
+	return &netSocket{fd: fd}, nil
+}
+
+// Takes over a listening socket the process inherited as fd, from a
+// supervisor or test harness that bound it.
+func inheritSocket(fd int) (*netSocket, error) {
+	accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d: %v", fd, os.NewSyscallError("getsockopt", err))
+	}
+	if accepting == 0 {
+		return nil, fmt.Errorf("fd %d isn't a listening socket", fd)
+	}
+	syscall.CloseOnExec(fd)
+	fdTrack.add(fd, "inherited listener")
+	return &netSocket{fd: fd}, nil
+}
+
+// Makes a pair of connected Unix sockets, each the other's peer, without
+// binding anything.
+func newSocketPair() (*netSocket, *netSocket, error) {
+	syscall.ForkLock.Lock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	fdTrack.add(fds[0], "socketpair")
+	fdTrack.add(fds[1], "socketpair")
+	return &netSocket{fd: fds[0]}, &netSocket{fd: fds[1]}, nil
+}
+
+// Connects to the Unix socket at path, @ first for the abstract namespace.
+func dialUnix(path string) (*netSocket, error) {
+	syscall.ForkLock.Lock()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	for {
+		err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: path})
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	fdTrack.add(fd, "unix client")
+	return &netSocket{fd: fd}, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+// Winsock versions of the calls netSocket makes. They're the plain
+// blocking calls, made from the goroutine serving each connection; there's
+// no IOCP, so -event_loop isn't available.
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Sockets are handles.
+type sysfd = syscall.Handle
+
+const (
+	soRcvTimeo = 0x1006
+	soSndTimeo = 0x1005
+)
+
+// WSAETIMEDOUT, what a read or write fails with once its socket timeout
+// passes.
+var errSocketTimeout error = syscall.Errno(10060)
+
+// syscall.Accept isn't implemented on Windows.
+var procAccept = syscall.NewLazyDLL("ws2_32.dll").NewProc("accept")
+
+func sysRead(fd sysfd, p []byte) (int, error) {
+	buf := syscall.WSABuf{Len: uint32(len(p)), Buf: &p[0]}
+	var n, flags uint32
+	err := syscall.WSARecv(fd, &buf, 1, &n, &flags, nil, nil)
+	return int(n), err
+}
+
+func sysWrite(fd sysfd, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := syscall.WSABuf{Len: uint32(len(p)), Buf: &p[0]}
+	var n uint32
+	err := syscall.WSASend(fd, &buf, 1, &n, 0, nil, nil)
+	return int(n), err
+}
+
+func sysAccept(fd sysfd) (sysfd, error) {
+	r, _, err := procAccept.Call(uintptr(fd), 0, 0)
+	if nfd := syscall.Handle(r); nfd != syscall.InvalidHandle {
+		return nfd, nil
+	}
+	return syscall.InvalidHandle, err
+}
+
+func sysClose(fd sysfd) error {
+	return syscall.Closesocket(fd)
+}
+
+// SO_REUSEADDR lets another socket take over a bound port on Windows, so
+// the port is claimed exclusively instead; recently-used addresses can be
+// bound again regardless.
+func setReuseAddr(fd sysfd) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, ^syscall.SO_REUSEADDR, 1)
+}
+
+// Windows has no SO_REUSEPORT to share a port out between sockets.
+func setReusePort(fd sysfd) error {
+	return errors.New("-workers isn't supported on Windows")
+}
+
+// Sets SO_RCVTIMEO or SO_SNDTIMEO, which Windows takes in milliseconds, to
+// d, or to no timeout if d is 0.
+func setSockTimeout(fd sysfd, opt int, d time.Duration) error {
+	ms := int(d / time.Millisecond)
+	if d > 0 && ms == 0 {
+		ms = 1
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, ms)
+}
+
+// Makes an accept blocked on the listener return. Shutting the listener
+// down doesn't here, so it gets a connection of its own.
+func wakeAccept(ns *netSocket) {
+	addr, ok := ns.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	ip := addr.IP
+	if ip.IsUnspecified() {
+		if ip.To4() != nil {
+			ip = net.IPv4(127, 0, 0, 1)
+		} else {
+			ip = net.IPv6loopback
+		}
+	}
+	c, err := net.DialTimeout("tcp", (&net.TCPAddr{IP: ip, Port: addr.Port}).String(), time.Second)
+	if err == nil {
+		c.Close()
+	}
+}
+
+// Can't be told without a read here, so the client is never seen to go.
+func peerGone(fd sysfd) bool {
+	return false
+}
+
+func newUnixSocket(path string) (*netSocket, error) {
+	return nil, errors.New("unix sockets aren't supported on Windows")
+}
+
+func inheritSocket(fd int) (*netSocket, error) {
+	return nil, errors.New("-fd isn't supported on Windows")
+}
+
+func newSocketPair() (*netSocket, *netSocket, error) {
+	return nil, nil, errors.New("socketpair isn't supported on Windows")
+}
+
+func dialUnix(path string) (*netSocket, error) {
+	return nil, errors.New("unix sockets aren't supported on Windows")
+}
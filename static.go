@@ -0,0 +1,201 @@
+package main
+
+// Static files. fileServer maps request paths onto a directory; a directory
+// is served by its index.html or, without one, a listing of its entries,
+// and with ?archive= by an archive of them, which is in archive.go.
+// Names starting with a dot, like .env, .git and .htpasswd, are neither
+// listed nor served unless the policy's dotfiles is set: a dotfile in a
+// served tree is far more often a secret left there than a page. Symlinks
+// are followed only while they resolve inside the root by default, since
+// one pointing at / would otherwise publish the whole disk.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What fileServer serves besides plain files and directories in its root.
+type filePolicy struct {
+	dotfiles bool
+	symlinks string // symlinksNone, symlinksBeneath or symlinksAny
+}
+
+const (
+	symlinksNone    = "none"    // Never followed.
+	symlinksBeneath = "beneath" // Followed unless they lead outside the root.
+	symlinksAny     = "any"     // Followed anywhere.
+)
+
+var symlinkPolicies = map[string]bool{symlinksNone: true, symlinksBeneath: true, symlinksAny: true}
+
+// Reports whether the policy keeps the slash separated name from being
+// served, because of a dotfile in it, before anything is opened.
+func (p filePolicy) hides(name string) bool {
+	if p.dotfiles {
+		return false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") && seg != "." && seg != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (p filePolicy) open(root, name string) (*os.File, error) {
+	switch p.symlinks {
+	case symlinksNone:
+		return openBeneath(root, name, true)
+	case symlinksAny:
+		return os.Open(filepath.Join(root, filepath.FromSlash(path.Clean("/"+name))))
+	}
+	return openBeneath(root, name, false)
+}
+
+func fileServer(rootDir string, policy filePolicy) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if r.method != "GET" && r.method != "HEAD" {
+			return writeStatus(w, 405, "method not allowed\n", "Allow: GET, HEAD")
+		}
+		for _, seg := range strings.Split(r.path, "/") {
+			if seg == ".." {
+				return writeStatus(w, 403, "forbidden\n")
+			}
+		}
+		// As if it weren't there, since it isn't listed.
+		if policy.hides(r.path) {
+			return notFound(w, r)
+		}
+		name := path.Clean("/" + r.path)
+		f, err := policy.open(rootDir, name)
+		switch {
+		case err == errEscapesRoot || err == errSymlinkPath || os.IsPermission(err):
+			return writeStatus(w, 403, "forbidden\n")
+		case err != nil:
+			return notFound(w, r)
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if format := r.query("archive"); format != "" {
+				return writeArchive(w, r, rootDir, name, format, policy)
+			}
+			// Relative links in the page only resolve against a path ending
+			// in a slash. The redirect is relative too since the handler may
+			// be mounted below a prefix it doesn't see, and keeps the query.
+			if !strings.HasSuffix(r.path, "/") {
+				loc := (&url.URL{Path: path.Base(r.path) + "/", RawQuery: r.rawQuery}).String()
+				return redirect(w, r, loc, 301)
+			}
+			index, err := policy.open(rootDir, path.Join(name, "index.html"))
+			if err != nil {
+				return writeDirListing(w, r, f, r.path, policy)
+			}
+			defer index.Close()
+			if fi, err = index.Stat(); err != nil {
+				return err
+			}
+			f = index
+		}
+		if !fi.Mode().IsRegular() {
+			return writeStatus(w, 403, "forbidden\n")
+		}
+
+		etag := fileETag(fi)
+		if notModified(w, r, etag, fi.ModTime()) {
+			return nil
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(fi.Name()))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("ETag", etag)
+		lastModified := fi.ModTime().UTC().Format(httpDate)
+		h.Set("Last-Modified", lastModified)
+		if r.method == "HEAD" {
+			return nil
+		}
+		if spec := r.header.Get("Range"); spec != "" && ifRangeMatches(r, etag, lastModified) {
+			// Seeking beats reading up to the range through serveRanges.
+			start, end, ok, satisfiable := parseByteRange(spec, fi.Size())
+			if ok && satisfiable {
+				if _, err := f.Seek(start, io.SeekStart); err != nil {
+					return err
+				}
+				h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, fi.Size()))
+				h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+				w.WriteHeader(206)
+				_, err = w.sendFile(f, end-start)
+				return err
+			}
+		}
+		_, err = w.sendFile(f, fi.Size())
+		return err
+	}
+}
+
+// The date format of Last-Modified and other HTTP headers.
+const httpDate = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+func writeDirListing(w responseWriter, r *request, dir *os.File, urlPath string, policy filePolicy) error {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var b bytes.Buffer
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n", title)
+	fmt.Fprintf(&b, "<h1>Index of %s</h1>\n<ul>\n", title)
+	for _, e := range entries {
+		name := e.Name()
+		if policy.hides(name) || policy.symlinks == symlinksNone && e.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	if r.method == "HEAD" {
+		return nil
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// Runs next with prefix removed from the request URI, so a handler that
+// maps paths onto something, like fileServer, can be mounted below the
+// root.
+func stripPrefix(prefix string) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(w responseWriter, r *request) error {
+			uri := r.uri
+			r.setURI("/" + strings.TrimPrefix(strings.TrimPrefix(uri, prefix), "/"))
+			defer r.setURI(uri)
+			return next(w, r)
+		}
+	}
+}
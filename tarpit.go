@@ -0,0 +1,156 @@
+package main
+
+// Tarpit for vulnerability scanners. Requests for paths nothing legitimate
+// asks this server for, like /wp-admin or /.env, are answered as slowly or
+// as wastefully as possible: with drip, a long Content-Length then a byte
+// at a time; with junk, a large body of random text. Each hit is logged to
+// its own log so it doesn't drown in the request log.
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path prefixes scanners probe for, matched case-insensitively.
+var scannerPrefixes = []string{
+	"/.env",
+	"/.git/",
+	"/.aws/",
+	"/.ssh/",
+	"/.ds_store",
+	"/wp-admin",
+	"/wp-login",
+	"/wp-content/",
+	"/wp-includes/",
+	"/xmlrpc.php",
+	"/phpmyadmin",
+	"/pma/",
+	"/cgi-bin/",
+	"/vendor/phpunit/",
+	"/boaform/",
+	"/hnap1",
+	"/actuator/",
+	"/solr/admin",
+	"/config.json",
+	"/server-status",
+}
+
+// Nothing here is PHP, so anything asking for a script is probing.
+var scannerSuffixes = []string{".php", ".asp", ".aspx", ".jsp"}
+
+func isScannerPath(uri string) bool {
+	p := strings.ToLower(uri)
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	for _, prefix := range scannerPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, suffix := range scannerSuffixes {
+		if strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+type tarpit struct {
+	mode     string        // "drip" or "junk".
+	interval time.Duration // Between bytes with drip.
+	maxTime  time.Duration // How long a drip goes on for.
+	maxJunk  int64         // Upper bound on the size of a junk body.
+	log      *log.Logger
+}
+
+// Makes a tarpit logging to file, or to stderr if file is empty.
+func newTarpit(mode, file string, interval, maxTime time.Duration, maxJunk int64) (*tarpit, error) {
+	var out io.Writer = os.Stderr
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return &tarpit{
+		mode:     mode,
+		interval: interval,
+		maxTime:  maxTime,
+		maxJunk:  maxJunk,
+		log:      log.New(out, "tarpit: ", log.LstdFlags),
+	}, nil
+}
+
+// Traps requests for scanner paths and passes the rest to next.
+func (t *tarpit) middleware(next handlerFunc) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		if !isScannerPath(r.uri) {
+			return next(w, r)
+		}
+		start := time.Now()
+		var err error
+		if t.mode == "drip" {
+			err = t.drip(w, r)
+		} else {
+			err = t.junk(w)
+		}
+		t.log.Printf("%s %s %q sent %d bytes in %v (%v)", r.method, r.uri,
+			r.header.Get("User-Agent"), w.state.written, time.Since(start).Round(time.Millisecond), err)
+		// Whatever the client did to end it, there's nothing to report.
+		return nil
+	}
+}
+
+// Promises a body far longer than it will ever send, then sends it one
+// byte per interval until maxTime or the client gives up.
+func (t *tarpit) drip(w responseWriter, r *request) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(1<<30))
+	// The body ends short of its length, so the connection can't be reused.
+	w.Header().Set("Connection", "close")
+	page := "<!DOCTYPE html><html><head><title>Admin</title></head><body>"
+	deadline := clock.Now().Add(t.maxTime)
+	for i := 0; clock.Now().Before(deadline); i++ {
+		if _, err := w.Write([]byte{page[i%len(page)]}); err != nil {
+			return err
+		}
+		tick := clock.NewTimer(t.interval)
+		select {
+		case <-tick.Chan():
+		case <-r.context().Done():
+			tick.Stop()
+			return r.context().Err()
+		}
+	}
+	return nil
+}
+
+// Sends a body of random words, between half of maxJunk and maxJunk long.
+func (t *tarpit) junk(w responseWriter) error {
+	size := t.maxJunk/2 + rand.Int63n(t.maxJunk/2+1)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	const letters = "abcdefghijklmnopqrstuvwxyz     \n"
+	buf := make([]byte, 32<<10)
+	for size > 0 {
+		n := int64(len(buf))
+		if size < n {
+			n = size
+		}
+		for i := range buf[:n] {
+			buf[i] = letters[rand.Intn(len(letters))]
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+// HTTPS. With -https, each accepted connection does a TLS handshake with
+// crypto/tls before any request is read from it, using the certificate and
+// key from -tls_cert and -tls_key. -tls_self_signed makes do without
+// either, and with neither the certificates -issue_cert made in -cert_dir
+// are served, chosen by the name each client asks for. Handlers see what
+// the handshake settled on in request.tls, including any certificate the
+// client sent when asked for one with -tls_client_certs. OCSP stapling is
+// in ocsp.go, session resumption in tlssession.go and the versions and
+// cipher suites allowed in tlspolicy.go, and Encrypted Client Hello in
+// ech.go.
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client has to complete the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+// Serves the certificate in certs, with the policy, client certificates
+// and resumption it says, whatever they are at the time of each handshake.
+func newTLSConfig(certs *certStore) *tls.Config {
+	// ECH keys have to be here, as the outer ClientHello is decrypted
+	// before GetConfigForClient sees the inner one.
+	config := &tls.Config{GetCertificate: certs.get, EncryptedClientHelloKeys: certs.ech}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return certs.configFor(config), nil
+	}
+	return config
+}
+
+// Holds the certificates and session state handshakes use, which a reload
+// may replace while connections are being served. One is shared by every
+// HTTPS server.
+type certStore struct {
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	// The names certs were made for when they're self-signed; a reload
+	// only makes new ones when they change.
+	selfSigned string
+	// Whether clients are asked for a certificate, which isn't verified.
+	clientCerts bool
+	policy      tlsPolicy
+
+	// Set before serving.
+	ocsp      bool          // Staple OCSP responses to certs as they load.
+	noTickets bool          // Sessions aren't resumed at all.
+	sessions  *sessionCache // Sessions are resumed from here, rather than tickets.
+	ech       []tls.EncryptedClientHelloKey
+	// Encrypt tickets, newest first, unless crypto/tls picks its own.
+	ticketKeys [][32]byte
+}
+
+// A copy of base with the policy, client certificate and resumption
+// settings.
+func (c *certStore) configFor(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetConfigForClient = nil
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	config.MinVersion = c.policy.minVersion
+	config.CipherSuites = c.policy.ciphers
+	config.CurvePreferences = c.policy.curves
+	config.NextProtos = c.policy.alpn
+	if c.clientCerts {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	switch {
+	case c.noTickets:
+		config.SessionTicketsDisabled = true
+	case c.sessions != nil:
+		config.WrapSession, config.UnwrapSession = c.sessions.wrap, c.sessions.unwrap
+	case c.ticketKeys != nil:
+		config.SetSessionTicketKeys(c.ticketKeys)
+	}
+	return config
+}
+
+// Loads the certificate cfg names, makes a self-signed one, or, with
+// neither, loads every certificate issued into the -cert_dir.
+func (c *certStore) load(cfg listenConfig) error {
+	policy, err := parseTLSPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.clientCerts, c.policy = cfg.clientCerts, policy
+	c.mu.Unlock()
+	if cfg.selfSigned != "" {
+		c.mu.RLock()
+		same := c.selfSigned == cfg.selfSigned
+		c.mu.RUnlock()
+		if same {
+			return nil
+		}
+		cert, err := selfSignedCert(strings.Split(cfg.selfSigned, ","))
+		if err != nil {
+			return err
+		}
+		c.set([]*tls.Certificate{cert}, cfg.selfSigned)
+		return nil
+	}
+	if cfg.certFile == "" && cfg.keyFile == "" {
+		certs, err := loadIssued(cfg.certDir)
+		if err != nil {
+			return err
+		}
+		c.set(certs, "")
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+	if err != nil {
+		return err
+	}
+	c.set([]*tls.Certificate{&cert}, "")
+	return nil
+}
+
+func (c *certStore) set(certs []*tls.Certificate, selfSigned string) {
+	c.mu.Lock()
+	c.certs, c.selfSigned = certs, selfSigned
+	c.mu.Unlock()
+	if c.ocsp {
+		go c.staple()
+	}
+}
+
+// The first certificate for the name the client asked for, or the first
+// there is if none are.
+func (c *certStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, cert := range c.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+func (r *request) scheme() string {
+	if r.tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// The subject of the certificate the client sent, or "" if it sent none.
+func (r *request) peerSubject() string {
+	if r.tls == nil || len(r.tls.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.tls.PeerCertificates[0].Subject.String()
+}
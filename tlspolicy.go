@@ -0,0 +1,127 @@
+package main
+
+// TLS policy: the protocol versions, cipher suites, key exchange groups and
+// ALPN protocols HTTPS handshakes accept. -tls_policy starts from one of
+// Mozilla's server side TLS configurations:
+//
+//	modern         TLS 1.3 only
+//	intermediate   TLS 1.2 too, with forward secret AEAD cipher suites
+//	old            back to TLS 1.0 with CBC and RSA key exchange suites,
+//	               for clients that predate the rest
+//
+// and -tls_min_version, -tls_ciphers and -tls_curves replace its parts.
+// Cipher suites only apply below TLS 1.3, as crypto/tls doesn't let its
+// suites be picked. Without -tls_curves it picks the groups itself, which
+// gets clients that offer it the post-quantum X25519MLKEM768.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+type tlsPolicy struct {
+	minVersion uint16
+	ciphers    []uint16      // nil for crypto/tls's own
+	curves     []tls.CurveID // nil for crypto/tls's own
+	alpn       []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// The ALPN protocols the server speaks.
+var alpnProtocols = map[string]bool{"http/1.1": true, "http/1.0": true}
+
+var intermediateCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsPresets = map[string]tlsPolicy{
+	"modern":       {minVersion: tls.VersionTLS13},
+	"intermediate": {minVersion: tls.VersionTLS12, ciphers: intermediateCiphers},
+	"old": {minVersion: tls.VersionTLS10, ciphers: append(append([]uint16(nil), intermediateCiphers...),
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	)},
+}
+
+// The policy cfg describes: its preset with the parts its other settings,
+// comma separated lists but for the version, set replaced.
+func parseTLSPolicy(cfg listenConfig) (tlsPolicy, error) {
+	p, ok := tlsPresets[cfg.policy]
+	if !ok {
+		return p, fmt.Errorf("TLS policy must be modern, intermediate or old, not %q", cfg.policy)
+	}
+	if cfg.minVersion != "" {
+		if p.minVersion, ok = tlsVersions[cfg.minVersion]; !ok {
+			return p, fmt.Errorf("TLS version must be 1.0, 1.1, 1.2 or 1.3, not %q", cfg.minVersion)
+		}
+	}
+	if cfg.ciphers != "" {
+		p.ciphers = nil
+		for _, name := range strings.Split(cfg.ciphers, ",") {
+			id, ok := cipherSuiteID(name)
+			if !ok {
+				return p, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			p.ciphers = append(p.ciphers, id)
+		}
+	}
+	if cfg.curves != "" {
+		for _, name := range strings.Split(cfg.curves, ",") {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return p, fmt.Errorf("unknown curve %q", name)
+			}
+			p.curves = append(p.curves, id)
+		}
+	}
+	for _, proto := range strings.Split(cfg.alpn, ",") {
+		if !alpnProtocols[proto] {
+			return p, fmt.Errorf("ALPN protocol must be http/1.1 or http/1.0, not %q", proto)
+		}
+		p.alpn = append(p.alpn, proto)
+	}
+	return p, nil
+}
+
+// Finds a cipher suite by its IANA name, like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+	return 0, false
+}
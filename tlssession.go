@@ -0,0 +1,83 @@
+package main
+
+// TLS session resumption. A client that has been here before can skip most
+// of a full handshake, and its round trip, by presenting what it was left
+// with at the end of the last one. By default that's a session ticket: the
+// session, encrypted with a key only the server holds. The keys are shared
+// by every HTTPS server, so a ticket is good on any of the -workers sockets
+// and after a listener reload, and one is made every
+// -tls_ticket_key_rotation with the two before it still decrypting, so a
+// leaked key only opens up a few periods' sessions. With
+// -tls_session_cache the sessions stay on the server instead, and clients
+// only get an ID to look theirs up by.
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+)
+
+// Ticket keys kept for decrypting, the newest of them encrypting too.
+const ticketKeysKept = 3
+
+// Makes a new key to encrypt tickets with, keeping the previous ones so
+// tickets they encrypted still work.
+func (c *certStore) rotateTicketKeys() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ticketKeys = append([][32]byte{key}, c.ticketKeys...)
+	if len(c.ticketKeys) > ticketKeysKept {
+		c.ticketKeys = c.ticketKeys[:ticketKeysKept]
+	}
+	return nil
+}
+
+// Sessions kept for resumption by ID, the oldest dropped once there are
+// max of them.
+type sessionCache struct {
+	mu       sync.Mutex
+	max      int
+	sessions map[string][]byte
+	order    []string // IDs, oldest first
+}
+
+func newSessionCache(max int) *sessionCache {
+	return &sessionCache{max: max, sessions: make(map[string][]byte)}
+}
+
+// Stores s, handing the client its ID in place of a ticket.
+func (c *sessionCache) wrap(_ tls.ConnectionState, s *tls.SessionState) ([]byte, error) {
+	state, err := s.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.order) >= c.max {
+		delete(c.sessions, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.sessions[string(id)] = state
+	c.order = append(c.order, string(id))
+	return id, nil
+}
+
+// Finds the session a client's ID names. One that's been dropped gets the
+// client a full handshake.
+func (c *sessionCache) unwrap(id []byte, _ tls.ConnectionState) (*tls.SessionState, error) {
+	c.mu.Lock()
+	state, ok := c.sessions[string(id)]
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return tls.ParseSessionState(state)
+}
@@ -0,0 +1,47 @@
+package main
+
+// Hooks that observe dispatch, for instrumentation that shouldn't live in
+// serveMux.dispatch itself.
+
+import (
+	"fmt"
+	"time"
+)
+
+type dispatchTiming struct {
+	route   time.Duration // Finding the route.
+	handler time.Duration // Running the route's middleware and handler.
+}
+
+// Either function may be nil. before runs once the route is resolved and
+// after runs once the handler returns; rt is nil if no route matched.
+// Hooks run before in the order added and after in reverse order.
+type dispatchHook struct {
+	before func(r *request, rt *route)
+	after  func(r *request, rt *route, t dispatchTiming, err error)
+}
+
+func (m *serveMux) addHook(h dispatchHook) {
+	m.hooks = append(m.hooks, h)
+}
+
+type phaseTiming struct {
+	name string
+	dur  time.Duration
+}
+
+func (p phaseTiming) String() string {
+	return fmt.Sprintf("%s=%v", p.name, p.dur)
+}
+
+func (r *request) recordPhase(name string, d time.Duration) {
+	r.timings = append(r.timings, phaseTiming{name, d})
+}
+
+// Records the route lookup and handler phases onto the request.
+var phaseTimingHook = dispatchHook{
+	after: func(r *request, rt *route, t dispatchTiming, err error) {
+		r.recordPhase("route", t.route)
+		r.recordPhase("handler", t.handler)
+	},
+}
@@ -0,0 +1,110 @@
+package main
+
+// UDP ping. With -udp_ping the server also answers datagrams on a UDP port
+// by sending each one straight back, so a prober timing the round trip
+// sees the network path to this process without any HTTP in the way. A
+// multicast group address is joined, so one probe to the group is
+// answered by every server in it.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Largest datagram answered; anything longer is cut short.
+const udpPingMax = 2048
+
+// Binds addr, a host:port, for UDP pings. A multicast host is joined on
+// every interface, with the socket bound to the wildcard address.
+func newUDPPingSocket(addr string) (sysfd, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip := net.IPv4zero
+	if host != "" {
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP address %q", host)
+	}
+	bindIP := ip
+	if ip.IsMulticast() {
+		bindIP = net.IPv4zero
+		if ip.To4() == nil {
+			bindIP = net.IPv6unspecified
+		}
+	}
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := bindIP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], bindIP.To16())
+		sa = sa6
+	}
+
+	syscall.ForkLock.Lock()
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return 0, os.NewSyscallError("socket", err)
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		sysClose(fd)
+		return 0, os.NewSyscallError("bind", err)
+	}
+	if ip.IsMulticast() {
+		if ip4 := ip.To4(); ip4 != nil {
+			mreq := &syscall.IPMreq{}
+			copy(mreq.Multiaddr[:], ip4)
+			err = syscall.SetsockoptIPMreq(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+		} else {
+			mreq := &syscall.IPv6Mreq{}
+			copy(mreq.Multiaddr[:], ip.To16())
+			err = syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		}
+		if err != nil {
+			sysClose(fd)
+			return 0, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	fdTrack.add(fd, "udp ping")
+	return fd, nil
+}
+
+// Echoes every datagram on fd back to its sender, for as long as the
+// process runs.
+func serveUDPPing(fd sysfd) {
+	buf := make([]byte, udpPingMax)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		// Errors here are about earlier datagrams, like an ICMP
+		// unreachable for a reply, so the next one may be fine.
+		if err != nil {
+			log.Printf("udp ping: %v", os.NewSyscallError("recvfrom", err))
+			continue
+		}
+		if err := syscall.Sendto(fd, buf[:n], 0, from); err != nil {
+			log.Printf("udp ping: %v", os.NewSyscallError("sendto", err))
+		}
+	}
+}
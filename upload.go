@@ -0,0 +1,142 @@
+package main
+
+// Optional file drop page: GET /upload shows a form and POST /upload stores
+// the submitted files in a configured directory. Each file is written to
+// a temporary file beside where it goes and only takes its name once it's
+// all there, so a failed upload never leaves part of a file behind.
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const uploadPage = `<!DOCTYPE html>
+<html>
+<head><title>Upload</title></head>
+<body>
+<h1>Upload files</h1>
+<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple>
+<input type="submit" value="Upload">
+</form>
+</body>
+</html>
+`
+
+// How much of an upload is held in memory while it's saved. Bigger files
+// go through temporary files.
+const uploadMemory = 1 << 20
+
+// The size limit is the route's, so it applies while the body arrives.
+type uploadConfig struct {
+	dir  string
+	exts map[string]bool // Allowed lowercase extensions, nil for any.
+}
+
+// Parses a comma separated extension list like ".jpg,png" into a set.
+func parseExtensions(list string) map[string]bool {
+	if list == "" {
+		return nil
+	}
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		exts[e] = true
+	}
+	return exts
+}
+
+func uploadHandler(c uploadConfig) handlerFunc {
+	return func(w responseWriter, r *request) error {
+		switch r.method {
+		case "GET", "HEAD":
+			return writeHtml(func(*request) string { return uploadPage })(w, r)
+		case "POST":
+			return c.save(w, r)
+		default:
+			return writeStatus(w, 405, "method not allowed\n", "Allow: GET, HEAD, POST")
+		}
+	}
+}
+
+// Writes every file part of the multipart body into the upload directory.
+func (c uploadConfig) save(w responseWriter, r *request) error {
+	form, err := r.parseMultipartForm(uploadMemory)
+	if err == errNotMultipart {
+		return writeStatus(w, 415, "expected multipart/form-data\n")
+	}
+	if err != nil {
+		return writeStatus(w, 400, "malformed multipart body\n")
+	}
+
+	var fields []string
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var saved []string
+	for _, field := range fields {
+		for _, fh := range form.File[field] {
+			name := filepath.Base(fh.Filename)
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				return writeStatus(w, 400, "invalid file name\n")
+			}
+			if c.exts != nil && !c.exts[strings.ToLower(filepath.Ext(name))] {
+				return writeStatus(w, 415, "file type not allowed: "+name+"\n")
+			}
+			if err := c.store(fh, name); os.IsExist(err) {
+				return writeStatus(w, 409, "file already exists: "+name+"\n")
+			} else if err != nil {
+				return err
+			}
+			log.Printf("Saved upload %s", name)
+			saved = append(saved, name)
+		}
+	}
+
+	return writeHtml(func(*request) string {
+		return fmt.Sprintf("<h1>Uploaded %d file(s)</h1><p><a href=\"%s\">Upload more</a></p>",
+			len(saved), html.EscapeString(r.uri))
+	})(w, r)
+}
+
+// Copies an uploaded file into the upload directory as name.
+func (c uploadConfig) store(fh *multipart.FileHeader, name string) error {
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := ioutil.TempFile(c.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	// A link rather than a rename, which would clobber an existing file.
+	return os.Link(tmp, filepath.Join(c.dir, name))
+}
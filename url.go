@@ -0,0 +1,121 @@
+package main
+
+// The parts of the request URI, and the query and form values in it and
+// the body, so handlers don't each decode them.
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// Sets the request URI and splits it into path, query and fragment, failing
+// if the path doesn't unescape. A handler that rewrites the URI must go
+// through setURI to keep the parts in step.
+func (r *request) setURI(uri string) error {
+	r.uri = uri
+	rest := uri
+	r.fragment, r.rawQuery = "", ""
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest, r.fragment = rest[:i], rest[i+1:]
+	}
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, r.rawQuery = rest[:i], rest[i+1:]
+	}
+	r.queryCache, r.formCache = nil, nil
+	p, err := url.PathUnescape(rest)
+	if err != nil {
+		r.path = rest
+		return err
+	}
+	r.path = p
+	return nil
+}
+
+// The query parameters. Malformed pairs are skipped.
+func (r *request) queryParams() url.Values {
+	if r.queryCache == nil {
+		r.queryCache, _ = url.ParseQuery(r.rawQuery)
+	}
+	return r.queryCache
+}
+
+// The first value of the query parameter key, or "".
+func (r *request) query(key string) string {
+	return r.queryParams().Get(key)
+}
+
+// The query parameters merged with the fields of an
+// application/x-www-form-urlencoded body, or of a multipart/form-data one
+// once parseMultipartForm has read it, body fields first.
+func (r *request) formValues() url.Values {
+	if r.formCache != nil {
+		return r.formCache
+	}
+	form := make(url.Values)
+	if isFormBody(r) {
+		body, _ := url.ParseQuery(string(r.body))
+		for k, vs := range body {
+			form[k] = append(form[k], vs...)
+		}
+	}
+	if r.multipartForm != nil {
+		for k, vs := range r.multipartForm.Value {
+			form[k] = append(form[k], vs...)
+		}
+	}
+	for k, vs := range r.queryParams() {
+		form[k] = append(form[k], vs...)
+	}
+	r.formCache = form
+	return form
+}
+
+// The first value of the form field key, from the body or the query, or "".
+func (r *request) formValue(key string) string {
+	return r.formValues().Get(key)
+}
+
+func isFormBody(r *request) bool {
+	if r.method != "POST" && r.method != "PUT" && r.method != "PATCH" {
+		return false
+	}
+	ct := r.header.Get("Content-Type")
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.EqualFold(strings.TrimSpace(ct), "application/x-www-form-urlencoded")
+}
+
+var errNotMultipart = errors.New("request body isn't multipart/form-data")
+
+// Parses a multipart/form-data body into its fields and files. Files are
+// kept in memory up to maxMemory bytes in all, along with the fields, and
+// the rest are written to temporary files, which go once the response has
+// been sent. Parsing again returns the same form.
+func (r *request) parseMultipartForm(maxMemory int64) (*multipart.Form, error) {
+	if r.multipartForm != nil {
+		return r.multipartForm, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(r.header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, errNotMultipart
+	}
+	form, err := multipart.NewReader(bytes.NewReader(r.body), params["boundary"]).ReadForm(maxMemory)
+	if err != nil {
+		return nil, err
+	}
+	r.multipartForm, r.formCache = form, nil
+	return form, nil
+}
+
+// Deletes the temporary files parseMultipartForm made, if any.
+func (r *request) removeMultipartFiles() {
+	if r.multipartForm != nil {
+		r.multipartForm.RemoveAll()
+		r.multipartForm = nil
+	}
+}
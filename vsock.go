@@ -0,0 +1,23 @@
+package main
+
+// vsock listening, for serving between a hypervisor host and its guests,
+// as Firecracker and cloud-hypervisor set up, without any network. A
+// guest reaches the host at CID 2, and the host reaches a guest at the CID
+// it was started with; -vsock_cid is the CID to listen on, any by default.
+
+import "strconv"
+
+// Accepts connections from any CID.
+const vsockCIDAny = 0xffffffff
+
+// The address of one end of a vsock connection.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a *vsockAddr) Network() string { return "vsock" }
+
+func (a *vsockAddr) String() string {
+	return strconv.FormatUint(uint64(a.cid), 10) + ":" + strconv.FormatUint(uint64(a.port), 10)
+}
@@ -0,0 +1,73 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The syscall package knows neither AF_VSOCK nor its addresses, and its
+// Accept fails on addresses it doesn't know, so binding and accepting are
+// done with the raw system calls.
+const afVsock = 40
+
+const vsockAcceptTimeout = time.Second
+
+// struct sockaddr_vm.
+type rawSockaddrVM struct {
+	family    uint16
+	reserved1 uint16
+	port      uint32
+	cid       uint32
+	flags     uint8
+	zero      [3]uint8
+}
+
+// Creates a vsock socket bound to cid and port and listens on it.
+func newVsockSocket(cid, port uint32) (*netSocket, error) {
+	syscall.ForkLock.Lock()
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := rawSockaddrVM{family: afVsock, port: port, cid: cid}
+	if _, _, e := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); e != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", e)
+	}
+	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	// Shutting down a vsock listener doesn't wake a blocked accept, so
+	// accept gives up every so often to let Serve see that the server is
+	// closing.
+	if err = setSockTimeout(fd, syscall.SO_RCVTIMEO, vsockAcceptTimeout); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	fdTrack.add(fd, "vsock listener")
+	return &netSocket{fd: fd, vsock: true}, nil
+}
+
+func acceptVsock(fd sysfd) (*netSocket, error) {
+	var sa rawSockaddrVM
+	n := uint32(unsafe.Sizeof(sa))
+	nfd, _, e := syscall.Syscall6(syscall.SYS_ACCEPT4, uintptr(fd), uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)), syscall.SOCK_CLOEXEC, 0, 0)
+	// With a timeout set, signals interrupt accept even under SA_RESTART.
+	if e == syscall.EINTR {
+		e = syscall.EAGAIN
+	}
+	if e != 0 {
+		return nil, e
+	}
+	fdTrack.add(int(nfd), "vsock connection")
+	return &netSocket{fd: int(nfd), remote: &vsockAddr{cid: sa.cid, port: sa.port}}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux || 386
+
+package main
+
+import "errors"
+
+var errNoVsock = errors.New("vsock isn't supported on this platform")
+
+func newVsockSocket(cid, port uint32) (*netSocket, error) {
+	return nil, errNoVsock
+}
+
+func acceptVsock(fd sysfd) (*netSocket, error) {
+	return nil, errNoVsock
+}